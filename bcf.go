@@ -0,0 +1,687 @@
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/clashtest"
+	"github.com/modelhub/core/issue"
+	sj "github.com/robsix/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	bcfVersion           = "2.1"
+	bcfMediaType         = "application/zip"
+	maxBcfFileBytes      = 32 << 20
+	maxBcfBytes          = 128 << 20
+	maxBcfTopics         = 1000
+	maxBcfViewpoints     = 5000
+	bcfClashViewDistance = 10
+	bcfClashFieldOfView  = 60
+	bcfSnapshotName      = "snapshot.png"
+)
+
+const (
+	bcfImportCreated = "created"
+	bcfImportSkipped = "skipped"
+	bcfImportFailed  = "failed"
+)
+
+// bcfImportResult reports what importing a topic did. Issue is the issue created
+// for the topic, or the one it was imported as before when skipped, and may be
+// set when failed if the failure was adding its comments or snapshot. Error is
+// the log id of the failure.
+type bcfImportResult struct {
+	Guid   string       `json:"guid"`
+	Status string       `json:"status"`
+	Issue  *issue.Issue `json:"issue,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// bcfTopic is the JSON form of a BCF topic, as returned when importing and as
+// built from clashes and issues when exporting.
+type bcfTopic struct {
+	Guid        string          `json:"guid"`
+	Type        string          `json:"type,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Priority    string          `json:"priority,omitempty"`
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	Author      string          `json:"author"`
+	Created     string          `json:"created"`
+	DueDate     string          `json:"dueDate,omitempty"`
+	AssignedTo  string          `json:"assignedTo,omitempty"`
+	Labels      []string        `json:"labels,omitempty"`
+	Comments    []*bcfComment   `json:"comments,omitempty"`
+	Viewpoints  []*bcfViewpoint `json:"viewpoints,omitempty"`
+}
+
+type bcfComment struct {
+	Guid      string `json:"guid"`
+	Author    string `json:"author"`
+	Date      string `json:"date"`
+	Comment   string `json:"comment"`
+	Viewpoint string `json:"viewpoint,omitempty"`
+}
+
+// bcfViewpoint carries the camera in the viewer's camera json form. Components
+// are IFC GUIDs or authoring tool ids, SheetTransforms are filled in on import
+// with the sheet transforms of the target project space version containing them.
+type bcfViewpoint struct {
+	Guid            string        `json:"guid"`
+	Camera          *viewerCamera `json:"camera,omitempty"`
+	Components      []string      `json:"components,omitempty"`
+	SheetTransforms []string      `json:"sheetTransforms,omitempty"`
+	Snapshot        []byte        `json:"snapshot,omitempty"`
+}
+
+type viewerCamera struct {
+	Eye                [3]float64 `json:"eye"`
+	Target             [3]float64 `json:"target"`
+	Up                 [3]float64 `json:"up"`
+	FieldOfView        float64    `json:"fieldOfView,omitempty"`
+	IsOrthographic     bool       `json:"isOrthographic"`
+	OrthographicHeight float64    `json:"orthographicHeight,omitempty"`
+}
+
+type bcfXmlVersion struct {
+	XMLName         xml.Name `xml:"Version"`
+	VersionId       string   `xml:"VersionId,attr"`
+	DetailedVersion string   `xml:"DetailedVersion"`
+}
+
+type bcfXmlMarkup struct {
+	XMLName    xml.Name               `xml:"Markup"`
+	Topic      bcfXmlTopic            `xml:"Topic"`
+	Comments   []*bcfXmlComment       `xml:"Comment"`
+	Viewpoints []*bcfXmlViewpointFile `xml:"Viewpoints"`
+}
+
+type bcfXmlTopic struct {
+	Guid           string   `xml:"Guid,attr"`
+	TopicType      string   `xml:"TopicType,attr,omitempty"`
+	TopicStatus    string   `xml:"TopicStatus,attr,omitempty"`
+	Title          string   `xml:"Title"`
+	Priority       string   `xml:"Priority,omitempty"`
+	Labels         []string `xml:"Labels"`
+	CreationDate   string   `xml:"CreationDate"`
+	CreationAuthor string   `xml:"CreationAuthor"`
+	DueDate        string   `xml:"DueDate,omitempty"`
+	AssignedTo     string   `xml:"AssignedTo,omitempty"`
+	Description    string   `xml:"Description,omitempty"`
+}
+
+type bcfXmlComment struct {
+	Guid      string         `xml:"Guid,attr"`
+	Date      string         `xml:"Date"`
+	Author    string         `xml:"Author"`
+	Comment   string         `xml:"Comment"`
+	Viewpoint *bcfXmlGuidRef `xml:"Viewpoint,omitempty"`
+}
+
+type bcfXmlGuidRef struct {
+	Guid string `xml:"Guid,attr"`
+}
+
+type bcfXmlViewpointFile struct {
+	Guid      string `xml:"Guid,attr"`
+	Viewpoint string `xml:"Viewpoint"`
+	Snapshot  string `xml:"Snapshot,omitempty"`
+}
+
+type bcfXmlVisualizationInfo struct {
+	XMLName           xml.Name          `xml:"VisualizationInfo"`
+	Guid              string            `xml:"Guid,attr"`
+	Components        *bcfXmlComponents `xml:"Components"`
+	OrthogonalCamera  *bcfXmlCamera     `xml:"OrthogonalCamera"`
+	PerspectiveCamera *bcfXmlCamera     `xml:"PerspectiveCamera"`
+}
+
+type bcfXmlComponents struct {
+	Selection  []*bcfXmlComponent `xml:"Selection>Component"`
+	Visibility bcfXmlVisibility   `xml:"Visibility"`
+}
+
+type bcfXmlVisibility struct {
+	DefaultVisibility bool `xml:"DefaultVisibility,attr"`
+}
+
+type bcfXmlComponent struct {
+	IfcGuid         string `xml:"IfcGuid,attr,omitempty"`
+	AuthoringToolId string `xml:"AuthoringToolId,omitempty"`
+}
+
+type bcfXmlPoint struct {
+	X float64
+	Y float64
+	Z float64
+}
+
+type bcfXmlCamera struct {
+	CameraViewPoint  bcfXmlPoint
+	CameraDirection  bcfXmlPoint
+	CameraUpVector   bcfXmlPoint
+	ViewToWorldScale float64 `xml:",omitempty"`
+	FieldOfView      float64 `xml:",omitempty"`
+}
+
+// bcfGuid derives a stable GUID from seed so re-exporting the same clash or
+// issue gives the same BCF topic, letting other tools update rather than
+// duplicate it.
+func bcfGuid(seed string) string {
+	sum := sha1.Sum([]byte(seed))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// writeBcf writes topics as a BCF 2.1 zip, one folder per topic containing
+// markup.bcf and a viewpoint.bcfv and snapshot.png per viewpoint.
+func writeBcf(w io.Writer, topics []*bcfTopic) error {
+	z := zip.NewWriter(w)
+	if err := writeBcfXml(z, "bcf.version", &bcfXmlVersion{VersionId: bcfVersion, DetailedVersion: bcfVersion}); err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		markup := &bcfXmlMarkup{
+			Topic: bcfXmlTopic{
+				Guid:           topic.Guid,
+				TopicType:      topic.Type,
+				TopicStatus:    topic.Status,
+				Title:          topic.Title,
+				Priority:       topic.Priority,
+				Labels:         topic.Labels,
+				CreationDate:   topic.Created,
+				CreationAuthor: topic.Author,
+				DueDate:        topic.DueDate,
+				AssignedTo:     topic.AssignedTo,
+				Description:    topic.Description,
+			},
+		}
+		for _, comment := range topic.Comments {
+			c := &bcfXmlComment{Guid: comment.Guid, Date: comment.Date, Author: comment.Author, Comment: comment.Comment}
+			if comment.Viewpoint != "" {
+				c.Viewpoint = &bcfXmlGuidRef{Guid: comment.Viewpoint}
+			}
+			markup.Comments = append(markup.Comments, c)
+		}
+		for i, viewpoint := range topic.Viewpoints {
+			file := &bcfXmlViewpointFile{Guid: viewpoint.Guid, Viewpoint: "viewpoint.bcfv", Snapshot: bcfSnapshotName}
+			if i > 0 {
+				file.Viewpoint = viewpoint.Guid + ".bcfv"
+				file.Snapshot = viewpoint.Guid + ".png"
+			}
+			if err := writeBcfXml(z, path.Join(topic.Guid, file.Viewpoint), viewpoint.visualizationInfo()); err != nil {
+				return err
+			}
+			if len(viewpoint.Snapshot) > 0 {
+				if f, err := z.Create(path.Join(topic.Guid, file.Snapshot)); err != nil {
+					return err
+				} else if _, err := f.Write(viewpoint.Snapshot); err != nil {
+					return err
+				}
+			} else {
+				file.Snapshot = ""
+			}
+			markup.Viewpoints = append(markup.Viewpoints, file)
+		}
+		if err := writeBcfXml(z, path.Join(topic.Guid, "markup.bcf"), markup); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func writeBcfXml(z *zip.Writer, name string, v interface{}) error {
+	if f, err := z.Create(name); err != nil {
+		return err
+	} else if _, err := io.WriteString(f, xml.Header); err != nil {
+		return err
+	} else {
+		encoder := xml.NewEncoder(f)
+		encoder.Indent("", "  ")
+		return encoder.Encode(v)
+	}
+}
+
+func (v *bcfViewpoint) visualizationInfo() *bcfXmlVisualizationInfo {
+	info := &bcfXmlVisualizationInfo{
+		Guid:       v.Guid,
+		Components: &bcfXmlComponents{Visibility: bcfXmlVisibility{DefaultVisibility: true}},
+	}
+	for _, component := range v.Components {
+		// IFC GUIDs are always 22 characters, anything else is an id from the
+		// authoring tool (e.g. a Revit UniqueId)
+		if len(component) == 22 {
+			info.Components.Selection = append(info.Components.Selection, &bcfXmlComponent{IfcGuid: component})
+		} else {
+			info.Components.Selection = append(info.Components.Selection, &bcfXmlComponent{AuthoringToolId: component})
+		}
+	}
+	if c := v.Camera; c != nil {
+		camera := &bcfXmlCamera{
+			CameraViewPoint: bcfXmlPoint{c.Eye[0], c.Eye[1], c.Eye[2]},
+			CameraDirection: bcfXmlPoint{c.Target[0] - c.Eye[0], c.Target[1] - c.Eye[1], c.Target[2] - c.Eye[2]},
+			CameraUpVector:  bcfXmlPoint{c.Up[0], c.Up[1], c.Up[2]},
+		}
+		if c.IsOrthographic {
+			camera.ViewToWorldScale = c.OrthographicHeight
+			info.OrthogonalCamera = camera
+		} else {
+			camera.FieldOfView = c.FieldOfView
+			info.PerspectiveCamera = camera
+		}
+	}
+	return info
+}
+
+// readBcf parses a BCF 2.0 or 2.1 zip, topics without a markup.bcf are skipped.
+// Each entry is read at most once however many viewpoints refer to it, and at
+// most maxBcfBytes are read from the whole archive. Its errors are httpErrors,
+// 413 when the archive is too large once uncompressed and 400 when it is
+// invalid or has more than maxBcfTopics topics or maxBcfViewpoints viewpoints.
+func readBcf(r io.ReaderAt, size int64) ([]*bcfTopic, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, newHttpError(http.StatusBadRequest, err)
+	}
+	br := &bcfReader{files: map[string]*zip.File{}, read: map[string][]byte{}, remaining: maxBcfBytes}
+	markups := []*zip.File{}
+	for _, f := range z.File {
+		br.files[f.Name] = f
+		if path.Base(f.Name) == "markup.bcf" {
+			markups = append(markups, f)
+		}
+	}
+	if len(markups) > maxBcfTopics {
+		return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("BCF files may have at most %d topics", maxBcfTopics))
+	}
+	topics := make([]*bcfTopic, 0, len(markups))
+	viewpoints := 0
+	for _, f := range markups {
+		dir := path.Dir(f.Name)
+		markup := &bcfXmlMarkup{}
+		if err := br.readXml(f.Name, markup); err != nil {
+			return nil, err
+		}
+		if viewpoints += len(markup.Viewpoints); viewpoints > maxBcfViewpoints {
+			return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("BCF files may have at most %d viewpoints", maxBcfViewpoints))
+		}
+		topic := &bcfTopic{
+			Guid:        markup.Topic.Guid,
+			Type:        markup.Topic.TopicType,
+			Status:      markup.Topic.TopicStatus,
+			Priority:    markup.Topic.Priority,
+			Title:       markup.Topic.Title,
+			Description: markup.Topic.Description,
+			Author:      markup.Topic.CreationAuthor,
+			Created:     markup.Topic.CreationDate,
+			DueDate:     markup.Topic.DueDate,
+			AssignedTo:  markup.Topic.AssignedTo,
+			Labels:      markup.Topic.Labels,
+		}
+		for _, c := range markup.Comments {
+			comment := &bcfComment{Guid: c.Guid, Author: c.Author, Date: c.Date, Comment: c.Comment}
+			if c.Viewpoint != nil {
+				comment.Viewpoint = c.Viewpoint.Guid
+			}
+			topic.Comments = append(topic.Comments, comment)
+		}
+		for _, file := range markup.Viewpoints {
+			viewpoint := &bcfViewpoint{Guid: file.Guid}
+			name := file.Viewpoint
+			if name == "" {
+				name = "viewpoint.bcfv"
+			}
+			if name := path.Join(dir, name); br.files[name] != nil {
+				info := &bcfXmlVisualizationInfo{}
+				if err := br.readXml(name, info); err != nil {
+					return nil, err
+				}
+				viewpoint.setVisualizationInfo(info)
+			}
+			if name := path.Join(dir, file.Snapshot); file.Snapshot != "" && br.files[name] != nil {
+				if viewpoint.Snapshot, err = br.readFile(name); err != nil {
+					return nil, err
+				}
+			}
+			topic.Viewpoints = append(topic.Viewpoints, viewpoint)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// bcfReader reads the entries of a BCF zip, keeping what it has read so
+// entries referred to more than once are only uncompressed once, and counting
+// down the bytes it may still read.
+type bcfReader struct {
+	files     map[string]*zip.File
+	read      map[string][]byte
+	remaining int64
+}
+
+func (br *bcfReader) readFile(name string) ([]byte, error) {
+	if b, exists := br.read[name]; exists {
+		return b, nil
+	}
+	f := br.files[name]
+	limit := br.remaining
+	if limit > maxBcfFileBytes {
+		limit = maxBcfFileBytes
+	}
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, bcfTooLarge(f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, newHttpError(http.StatusBadRequest, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("invalid BCF file %s: %v", f.Name, err))
+	} else if int64(len(b)) > limit {
+		return nil, bcfTooLarge(f.Name)
+	}
+	br.remaining -= int64(len(b))
+	br.read[name] = b
+	return b, nil
+}
+
+func (br *bcfReader) readXml(name string, v interface{}) error {
+	if b, err := br.readFile(name); err != nil {
+		return err
+	} else if err := xml.NewDecoder(bytes.NewReader(b)).Decode(v); err != nil {
+		return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid BCF file %s: %v", name, err))
+	}
+	return nil
+}
+
+func bcfTooLarge(name string) error {
+	return newHttpError(http.StatusRequestEntityTooLarge, fmt.Errorf("BCF file %s is too large, files may be %d bytes each and %d bytes in total once uncompressed", name, maxBcfFileBytes, maxBcfBytes))
+}
+
+func (v *bcfViewpoint) setVisualizationInfo(info *bcfXmlVisualizationInfo) {
+	if info.Components != nil {
+		for _, component := range info.Components.Selection {
+			if component.IfcGuid != "" {
+				v.Components = append(v.Components, component.IfcGuid)
+			} else if component.AuthoringToolId != "" {
+				v.Components = append(v.Components, component.AuthoringToolId)
+			}
+		}
+	}
+	camera := info.PerspectiveCamera
+	if camera == nil {
+		camera = info.OrthogonalCamera
+	}
+	if camera != nil {
+		p, d, u := camera.CameraViewPoint, camera.CameraDirection, camera.CameraUpVector
+		v.Camera = &viewerCamera{
+			Eye:    [3]float64{p.X, p.Y, p.Z},
+			Target: [3]float64{p.X + d.X, p.Y + d.Y, p.Z + d.Z},
+			Up:     [3]float64{u.X, u.Y, u.Z},
+		}
+		if camera == info.PerspectiveCamera {
+			v.Camera.FieldOfView = camera.FieldOfView
+		} else {
+			v.Camera.IsOrthographic = true
+			v.Camera.OrthographicHeight = camera.ViewToWorldScale
+		}
+	}
+}
+
+var bcfClashStatuses = map[clashtest.ClashStatus]string{
+	clashtest.New:      "Open",
+	clashtest.Active:   "Active",
+	clashtest.Reviewed: "Reviewed",
+	clashtest.Approved: "Approved",
+	clashtest.Resolved: "Closed",
+}
+
+// clashTopic builds the BCF topic for a clash, its viewpoint looks at the clash
+// point with both elements selected. No snapshot is included as clashes aren't
+// rendered server side.
+func clashTopic(clash *clashtest.Clash, comments []*clashtest.ClashComment, author string) *bcfTopic {
+	topic := &bcfTopic{
+		Guid:        bcfGuid("clash:" + clash.Id),
+		Type:        "Clash",
+		Status:      bcfClashStatuses[clash.Status],
+		Title:       fmt.Sprintf("%s / %s", clash.LeftCategory, clash.RightCategory),
+		Description: fmt.Sprintf("Clash between %s and %s on %s, distance %g.", clash.LeftElement, clash.RightElement, clash.Level, clash.Distance),
+		Author:      author,
+		Created:     clash.FirstFound,
+		AssignedTo:  clash.Assignee,
+	}
+	viewpoint := &bcfViewpoint{
+		Guid:       bcfGuid("clashViewpoint:" + clash.Id),
+		Components: []string{clash.LeftElement, clash.RightElement},
+	}
+	if len(clash.Point) == 3 {
+		p := clash.Point
+		viewpoint.Camera = &viewerCamera{
+			Eye:         [3]float64{p[0] + bcfClashViewDistance, p[1] + bcfClashViewDistance, p[2] + bcfClashViewDistance},
+			Target:      [3]float64{p[0], p[1], p[2]},
+			Up:          [3]float64{0, 0, 1},
+			FieldOfView: bcfClashFieldOfView,
+		}
+	}
+	topic.Viewpoints = []*bcfViewpoint{viewpoint}
+	for _, comment := range comments {
+		topic.Comments = append(topic.Comments, &bcfComment{
+			Guid:    bcfGuid("clashComment:" + comment.Id),
+			Author:  comment.User,
+			Date:    comment.Created,
+			Comment: comment.Body,
+		})
+	}
+	return topic
+}
+
+var bcfIssueStatuses = map[issue.Status]string{
+	issue.Open:       "Open",
+	issue.InProgress: "In Progress",
+	issue.Resolved:   "Resolved",
+	issue.Closed:     "Closed",
+}
+
+// issueTopic builds the BCF topic for an issue, the issue's snapshot.png
+// attachment, if it has one, becomes the viewpoint snapshot.
+func issueTopic(coreApi core.CoreApi, forUser string, iss *issue.Issue) (*bcfTopic, error) {
+	guid := iss.BcfGuid
+	if guid == "" {
+		guid = bcfGuid("issue:" + iss.Id)
+	}
+	topic := &bcfTopic{
+		Guid:        guid,
+		Type:        "Issue",
+		Status:      bcfIssueStatuses[iss.Status],
+		Title:       iss.Title,
+		Description: iss.Description,
+		Author:      iss.CreatedBy,
+		Created:     iss.Created,
+		DueDate:     iss.DueDate,
+		AssignedTo:  iss.Assignee,
+	}
+	err := fetchAll(func(offset int, limit int) (int, int, error) {
+		comments, total, err := coreApi.Issue().GetComments(forUser, iss.Id, offset, limit)
+		for _, comment := range comments {
+			topic.Comments = append(topic.Comments, &bcfComment{
+				Guid:    bcfGuid("issueComment:" + comment.Id),
+				Author:  comment.User,
+				Date:    comment.Created,
+				Comment: comment.Body,
+			})
+		}
+		return len(comments), total, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	viewpoint := &bcfViewpoint{Guid: bcfGuid("issueViewpoint:" + iss.Id)}
+	if iss.Camera != nil {
+		camera := &viewerCamera{}
+		if b, err := json.Marshal(iss.Camera); err == nil && json.Unmarshal(b, camera) == nil {
+			viewpoint.Camera = camera
+		}
+	}
+	if attachments, err := coreApi.Issue().GetAttachments(forUser, iss.Id); err != nil {
+		return nil, err
+	} else {
+		for _, attachment := range attachments {
+			if attachment.Name == bcfSnapshotName {
+				if viewpoint.Snapshot, err = getIssueAttachment(coreApi, forUser, attachment.Id); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	if viewpoint.Camera != nil || viewpoint.Snapshot != nil {
+		topic.Viewpoints = []*bcfViewpoint{viewpoint}
+	}
+	return topic, nil
+}
+
+func getIssueAttachment(coreApi core.CoreApi, forUser string, id string) ([]byte, error) {
+	res, err := coreApi.Issue().GetAttachment(forUser, id)
+	if res != nil && res.Body != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxBcfFileBytes))
+}
+
+// validateBcfTopics checks topics before any are imported so a bad file is
+// rejected as a whole rather than part way through.
+func validateBcfTopics(topics []*bcfTopic) error {
+	seen := map[string]bool{}
+	for _, topic := range topics {
+		if topic.Guid == "" {
+			return errors.New("BCF topic without a Guid")
+		} else if seen[topic.Guid] {
+			return fmt.Errorf("BCF topic %s appears more than once", topic.Guid)
+		} else if topic.DueDate != "" && !isBcfDate(topic.DueDate) {
+			return fmt.Errorf("BCF topic %s has an invalid DueDate %q", topic.Guid, topic.DueDate)
+		}
+		seen[topic.Guid] = true
+	}
+	return nil
+}
+
+func isBcfDate(s string) bool {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func bcfTopicGuids(topics []*bcfTopic) []string {
+	guids := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		guids = append(guids, topic.Guid)
+	}
+	return guids
+}
+
+// createTopicIssue creates an issue on projectSpaceVersion from an imported
+// topic, keeping the topic's GUID so importing it again is skipped and exporting
+// the issue gives back the same topic. Comments are added as the importing user,
+// prefixed with their original author and date, and the first viewpoint's
+// snapshot is attached as snapshot.png. BCF authors and assignees are email
+// addresses rather than modelhub users so the issue is left unassigned. If adding
+// a comment or the snapshot fails the created issue is returned with the error.
+func createTopicIssue(coreApi core.CoreApi, forUser string, projectSpaceVersion string, topic *bcfTopic) (*issue.Issue, error) {
+	status := issue.Open
+	switch strings.ToLower(strings.Replace(topic.Status, " ", "", -1)) {
+	case "inprogress", "active":
+		status = issue.InProgress
+	case "resolved":
+		status = issue.Resolved
+	case "closed":
+		status = issue.Closed
+	}
+	title := topic.Title
+	if strings.TrimSpace(title) == "" {
+		title = "Untitled"
+	}
+	var camera *sj.Json
+	var snapshot []byte
+	if len(topic.Viewpoints) > 0 {
+		if topic.Viewpoints[0].Camera != nil {
+			if b, err := json.Marshal(topic.Viewpoints[0].Camera); err != nil {
+				return nil, err
+			} else if camera, err = sj.FromString(string(b)); err != nil {
+				return nil, err
+			}
+		}
+		snapshot = topic.Viewpoints[0].Snapshot
+	}
+
+	iss, err := coreApi.Issue().CreateFromBcf(forUser, projectSpaceVersion, topic.Guid, title, topic.Description, status, topic.DueDate, camera)
+	if err != nil {
+		return nil, err
+	}
+	for _, comment := range topic.Comments {
+		if _, err := coreApi.Issue().AddComment(forUser, iss.Id, "", fmt.Sprintf("%s (%s): %s", comment.Author, comment.Date, comment.Comment)); err != nil {
+			return iss, err
+		}
+	}
+	if len(snapshot) > 0 {
+		if _, err := coreApi.Issue().AddAttachment(forUser, iss.Id, bcfSnapshotName, "image/png", bytes.NewReader(snapshot)); err != nil {
+			return iss, err
+		}
+	}
+	return iss, nil
+}
+
+// bcfComponents returns the distinct components selected in the topics'
+// viewpoints.
+func bcfComponents(topics []*bcfTopic) []string {
+	seen := map[string]bool{}
+	components := []string{}
+	for _, topic := range topics {
+		for _, viewpoint := range topic.Viewpoints {
+			for _, component := range viewpoint.Components {
+				if !seen[component] {
+					seen[component] = true
+					components = append(components, component)
+				}
+			}
+		}
+	}
+	return components
+}
+
+// setBcfSheetTransforms fills in the sheet transforms of each viewpoint given
+// the sheet transform each component was found in.
+func setBcfSheetTransforms(topics []*bcfTopic, componentSheetTransforms map[string]string) {
+	for _, topic := range topics {
+		for _, viewpoint := range topic.Viewpoints {
+			seen := map[string]bool{}
+			for _, component := range viewpoint.Components {
+				if st, exists := componentSheetTransforms[component]; exists && !seen[st] {
+					seen[st] = true
+					viewpoint.SheetTransforms = append(viewpoint.SheetTransforms, st)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"github.com/modelhub/core/clashtest"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBcfRoundTrip(t *testing.T) {
+	topics := []*bcfTopic{
+		{
+			Guid:        bcfGuid("issue:1"),
+			Type:        "Issue",
+			Status:      "Open",
+			Priority:    "High",
+			Title:       "Duct through beam",
+			Description: "Reroute the duct",
+			Author:      "a@example.com",
+			Created:     "2016-01-02T03:04:05Z",
+			DueDate:     "2016-02-01",
+			AssignedTo:  "b@example.com",
+			Labels:      []string{"mep", "structure"},
+			Comments: []*bcfComment{
+				{Guid: bcfGuid("c1"), Author: "b@example.com", Date: "2016-01-03T00:00:00Z", Comment: "On it", Viewpoint: bcfGuid("v1")},
+				{Guid: bcfGuid("c2"), Author: "a@example.com", Date: "2016-01-04T00:00:00Z", Comment: "Thanks"},
+			},
+			Viewpoints: []*bcfViewpoint{
+				{
+					Guid:       bcfGuid("v1"),
+					Camera:     &viewerCamera{Eye: [3]float64{1, 2, 3}, Target: [3]float64{4, 6, 8}, Up: [3]float64{0, 0, 1}, FieldOfView: 60},
+					Components: []string{"0123456789abcdefghijkl", "revit-unique-id"},
+					Snapshot:   []byte("png one"),
+				},
+				{
+					Guid:   bcfGuid("v2"),
+					Camera: &viewerCamera{Eye: [3]float64{0, 0, 10}, Target: [3]float64{0, 0, 0}, Up: [3]float64{0, 1, 0}, IsOrthographic: true, OrthographicHeight: 25},
+				},
+			},
+		},
+		{Guid: bcfGuid("issue:2"), Title: "No viewpoints", Author: "a@example.com", Created: "2016-01-05T00:00:00Z"},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeBcf(buf, topics); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readBcf(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, topics) {
+		t.Fatalf("got %+v, want %+v", got, topics)
+	}
+}
+
+func TestReadBcfSkipsFoldersWithoutMarkup(t *testing.T) {
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	if err := writeBcfXml(z, "bcf.version", &bcfXmlVersion{VersionId: "2.0"}); err != nil {
+		t.Fatal(err)
+	} else if f, err := z.Create("orphan/snapshot.png"); err != nil {
+		t.Fatal(err)
+	} else if _, err := f.Write([]byte("png")); err != nil {
+		t.Fatal(err)
+	} else if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if topics, err := readBcf(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil || len(topics) != 0 {
+		t.Fatalf("got %v %v", topics, err)
+	}
+}
+
+func TestReadBcfRejectsInvalidMarkup(t *testing.T) {
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	if f, err := z.Create("t/markup.bcf"); err != nil {
+		t.Fatal(err)
+	} else if _, err := f.Write([]byte("<Markup><Topic")); err != nil {
+		t.Fatal(err)
+	} else if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBcf(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// testBcfZip zips the named files, in order.
+func testBcfZip(t *testing.T, files ...string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	for i := 0; i < len(files); i += 2 {
+		if f, err := z.Create(files[i]); err != nil {
+			t.Fatal(err)
+		} else if _, err := f.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBcfReadsSharedEntriesOnce(t *testing.T) {
+	viewpoints := strings.Repeat(`<Viewpoints Guid="v"><Snapshot>snapshot.png</Snapshot></Viewpoints>`, 3)
+	b := testBcfZip(t,
+		"t/markup.bcf", `<Markup><Topic Guid="t"><Title>t</Title></Topic>`+viewpoints+`</Markup>`,
+		"t/snapshot.png", "png",
+	)
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := &bcfReader{files: map[string]*zip.File{}, read: map[string][]byte{}, remaining: 100}
+	for _, f := range z.File {
+		br.files[f.Name] = f
+	}
+	for i := 0; i < 3; i++ {
+		if snapshot, err := br.readFile("t/snapshot.png"); err != nil || string(snapshot) != "png" {
+			t.Fatalf("got %q %v", snapshot, err)
+		}
+	}
+	if br.remaining != 97 {
+		t.Fatalf("%d bytes remaining, want 97", br.remaining)
+	}
+	br.remaining = 10
+	_, err = br.readFile("t/markup.bcf")
+	assertStatus(t, err, http.StatusRequestEntityTooLarge)
+
+	topics, err := readBcf(bytes.NewReader(b), int64(len(b)))
+	if err != nil || len(topics[0].Viewpoints) != 3 || string(topics[0].Viewpoints[2].Snapshot) != "png" {
+		t.Fatalf("got %+v %v", topics, err)
+	}
+}
+
+func TestReadBcfLimitsTopicsAndViewpoints(t *testing.T) {
+	files := []string{}
+	for i := 0; i <= maxBcfTopics; i++ {
+		files = append(files, fmt.Sprintf("%d/markup.bcf", i), "<Markup/>")
+	}
+	b := testBcfZip(t, files...)
+	_, err := readBcf(bytes.NewReader(b), int64(len(b)))
+	assertStatus(t, err, http.StatusBadRequest)
+
+	b = testBcfZip(t, "t/markup.bcf", "<Markup>"+strings.Repeat(`<Viewpoints Guid="v"/>`, maxBcfViewpoints+1)+"</Markup>")
+	_, err = readBcf(bytes.NewReader(b), int64(len(b)))
+	assertStatus(t, err, http.StatusBadRequest)
+}
+
+func TestBcfGuid(t *testing.T) {
+	guid := bcfGuid("clash:1")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(guid) {
+		t.Fatalf("%s is not a version 5 UUID", guid)
+	} else if guid != bcfGuid("clash:1") || guid == bcfGuid("clash:2") {
+		t.Fatal("guids must be stable per seed and differ between seeds")
+	}
+}
+
+func TestValidateBcfTopics(t *testing.T) {
+	for _, topics := range [][]*bcfTopic{
+		{{Title: "no guid"}},
+		{{Guid: "a"}, {Guid: "a"}},
+		{{Guid: "a", DueDate: "next week"}},
+	} {
+		if err := validateBcfTopics(topics); err == nil {
+			t.Errorf("%+v: expected an error", topics[0])
+		}
+	}
+	if err := validateBcfTopics([]*bcfTopic{{Guid: "a", DueDate: "2016-01-02"}, {Guid: "b", DueDate: "2016-01-02T03:04:05+01:00"}, {Guid: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClashTopic(t *testing.T) {
+	clash := &clashtest.Clash{Id: "c", LeftElement: "l", RightElement: "r", Point: []float64{1, 2, 3}, Status: clashtest.Resolved}
+	topic := clashTopic(clash, []*clashtest.ClashComment{{Id: "cc", User: "u", Body: "b"}}, "me")
+	if topic.Guid != bcfGuid("clash:c") || topic.Status != "Closed" || len(topic.Comments) != 1 || topic.Comments[0].Comment != "b" {
+		t.Fatalf("topic %+v", topic)
+	}
+	viewpoint := topic.Viewpoints[0]
+	if !reflect.DeepEqual(viewpoint.Components, []string{"l", "r"}) || viewpoint.Camera.Target != [3]float64{1, 2, 3} {
+		t.Fatalf("viewpoint %+v", viewpoint)
+	}
+}
+
+func TestSetBcfSheetTransforms(t *testing.T) {
+	topics := []*bcfTopic{{Viewpoints: []*bcfViewpoint{{Components: []string{"a", "b", "c", "d"}}}}}
+	if got := bcfComponents(topics); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("components %v", got)
+	}
+	setBcfSheetTransforms(topics, map[string]string{"a": "st1", "b": "st1", "c": "st2"})
+	if got := topics[0].Viewpoints[0].SheetTransforms; !reflect.DeepEqual(got, []string{"st1", "st2"}) {
+		t.Fatalf("sheet transforms %v", got)
+	}
+}
@@ -0,0 +1,222 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ugorji/go/codec"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	jsonMediaType    = "application/json"
+	msgpackMediaType = "application/msgpack"
+	cborMediaType    = "application/cbor"
+)
+
+// Codec encodes response bodies and decodes request bodies for a media type.
+// Values passed to Encode and Decode are the same structs used for JSON, so
+// codecs should honour their json tags.
+type Codec interface {
+	MediaType() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// WithCodec registers an additional codec, replacing any existing codec for
+// the same media type. JSON, MessagePack and CBOR are registered by default.
+func WithCodec(c Codec) Option {
+	return func(o *options) {
+		o.codecs[c.MediaType()] = c
+	}
+}
+
+func defaultCodecs() map[string]Codec {
+	msgpack := newBinaryCodec(msgpackMediaType, &codec.MsgpackHandle{WriteExt: true})
+	return map[string]Codec{
+		jsonMediaType:           &jsonCodec{},
+		msgpackMediaType:        msgpack,
+		"application/x-msgpack": msgpack,
+		cborMediaType:           newBinaryCodec(cborMediaType, &codec.CborHandle{}),
+	}
+}
+
+type jsonCodec struct{}
+
+func (c *jsonCodec) MediaType() string {
+	return jsonMediaType
+}
+
+func (c *jsonCodec) Encode(w io.Writer, v interface{}) error {
+	if b, err := json.Marshal(v); err != nil {
+		return err
+	} else {
+		_, err = w.Write(b)
+		return err
+	}
+}
+
+func (c *jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// binaryCodec round trips values through their JSON form so json tags and
+// custom json marshalers (e.g. camera json) are respected, then encodes the
+// generic form with the given handle.
+type binaryCodec struct {
+	mediaType string
+	handle    codec.Handle
+}
+
+func newBinaryCodec(mediaType string, handle codec.Handle) *binaryCodec {
+	switch h := handle.(type) {
+	case *codec.MsgpackHandle:
+		h.RawToString = true
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	case *codec.CborHandle:
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	}
+	return &binaryCodec{mediaType: mediaType, handle: handle}
+}
+
+func (c *binaryCodec) MediaType() string {
+	return c.mediaType
+}
+
+func (c *binaryCodec) Encode(w io.Writer, v interface{}) error {
+	if b, err := json.Marshal(v); err != nil {
+		return err
+	} else {
+		var generic interface{}
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		if err := decoder.Decode(&generic); err != nil {
+			return err
+		}
+		return codec.NewEncoder(w, c.handle).Encode(compactNumbers(generic))
+	}
+}
+
+func (c *binaryCodec) Decode(r io.Reader, v interface{}) error {
+	var generic interface{}
+	if err := codec.NewDecoder(r, c.handle).Decode(&generic); err != nil {
+		return err
+	} else if b, err := json.Marshal(generic); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(b, v)
+	}
+}
+
+// compactNumbers replaces json.Numbers with int64s where possible so they
+// don't all get encoded as 8 byte floats.
+func compactNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = compactNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = compactNumbers(v[k])
+		}
+	}
+	return v
+}
+
+// responseWriter carries the request and api options through to the write
+// utils so they can negotiate the response encoding.
+type responseWriter struct {
+	http.ResponseWriter
+	req  *http.Request
+	opts *options
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets room/join take over the connection for a websocket.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking is not supported")
+}
+
+// acceptedMediaTypes returns the media types listed in an Accept header, most
+// preferred first.
+func acceptedMediaTypes(accept string) []string {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	ranges := []*mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil {
+			q := 1.0
+			if qs, exists := params["q"]; exists {
+				if q, err = strconv.ParseFloat(qs, 64); err != nil {
+					continue
+				}
+			}
+			if q > 0 {
+				ranges = append(ranges, &mediaRange{mediaType: mediaType, q: q})
+			}
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	mediaTypes := make([]string, 0, len(ranges))
+	for _, mr := range ranges {
+		mediaTypes = append(mediaTypes, mr.mediaType)
+	}
+	return mediaTypes
+}
+
+// responseCodec picks the registered codec the client prefers, falling back to
+// JSON when the Accept header doesn't name one.
+func responseCodec(w http.ResponseWriter) Codec {
+	rw, ok := w.(*responseWriter)
+	if !ok {
+		return &jsonCodec{}
+	}
+	for _, mediaType := range acceptedMediaTypes(rw.req.Header.Get("Accept")) {
+		if c, exists := rw.opts.codecs[mediaType]; exists {
+			return c
+		} else if mediaType == "*/*" || mediaType == "application/*" {
+			break
+		}
+	}
+	return rw.opts.codecs[jsonMediaType]
+}
+
+// requestCodec picks the codec for the request's Content-Type, defaulting to
+// JSON when none or an unregistered one is given, as before content negotiation
+// was supported.
+func requestCodec(r *http.Request) Codec {
+	codecs := optionsFrom(r).codecs
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		if c, exists := codecs[mediaType]; exists {
+			return c
+		}
+	}
+	return codecs[jsonMediaType]
+}
@@ -0,0 +1,112 @@
+package rest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type upperCase string
+
+func (u upperCase) MarshalJSON() ([]byte, error) {
+	return []byte(`"UPPER"`), nil
+}
+
+type codecTestValue struct {
+	Id       string                 `json:"id"`
+	Count    int                    `json:"count"`
+	Big      int64                  `json:"big"`
+	Ratio    float64                `json:"ratio"`
+	Flag     bool                   `json:"flag"`
+	Empty    string                 `json:"empty,omitempty"`
+	Hidden   string                 `json:"-"`
+	Tags     []string               `json:"tags"`
+	Nested   *codecTestValue        `json:"nested,omitempty"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	src := &codecTestValue{
+		Id:       "a",
+		Count:    3,
+		Big:      1 << 53,
+		Ratio:    0.25,
+		Flag:     true,
+		Hidden:   "not sent",
+		Tags:     []string{"x", "y"},
+		Nested:   &codecTestValue{Id: "b", Tags: []string{}},
+		Metadata: map[string]interface{}{"due": "2016-01-02", "n": 1.5},
+	}
+	want := *src
+	want.Hidden = ""
+	for mediaType, c := range defaultCodecs() {
+		buf := &bytes.Buffer{}
+		if err := c.Encode(buf, src); err != nil {
+			t.Fatalf("%s encode: %v", mediaType, err)
+		}
+		dst := &codecTestValue{}
+		if err := c.Decode(buf, dst); err != nil {
+			t.Fatalf("%s decode: %v", mediaType, err)
+		}
+		if !reflect.DeepEqual(dst, &want) {
+			t.Errorf("%s: got %+v, want %+v", mediaType, dst, &want)
+		}
+	}
+}
+
+func TestBinaryCodecsUseJsonForm(t *testing.T) {
+	for _, mediaType := range []string{msgpackMediaType, cborMediaType} {
+		c := defaultCodecs()[mediaType]
+		buf := &bytes.Buffer{}
+		if err := c.Encode(buf, map[string]interface{}{"camera": upperCase("lower"), "n": 7}); err != nil {
+			t.Fatal(err)
+		}
+		var dst map[string]interface{}
+		if err := c.Decode(buf, &dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst["camera"] != "UPPER" || dst["n"] != float64(7) {
+			t.Errorf("%s: got %v", mediaType, dst)
+		}
+	}
+}
+
+func TestAcceptedMediaTypes(t *testing.T) {
+	got := acceptedMediaTypes("text/html;q=0.2, application/cbor, application/msgpack;q=0.5, application/json;q=0, bad;;q")
+	want := []string{"application/cbor", "application/msgpack", "text/html"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestNegotiateCodecs(t *testing.T) {
+	opts := newOptions(nil)
+	for accept, want := range map[string]string{
+		"":                                    jsonMediaType,
+		"application/cbor":                    cborMediaType,
+		"application/x-msgpack":               msgpackMediaType,
+		"text/html, application/msgpack;q=.1": msgpackMediaType,
+		"*/*, application/cbor;q=0.5":         jsonMediaType,
+	} {
+		r := withOptions(httptest.NewRequest(http.MethodPost, "/", nil), opts)
+		r.Header.Set("Accept", accept)
+		w := &responseWriter{ResponseWriter: httptest.NewRecorder(), req: r, opts: opts}
+		if got := responseCodec(w).MediaType(); got != want {
+			t.Errorf("Accept %q: got %s, want %s", accept, got, want)
+		}
+	}
+	for contentType, want := range map[string]string{
+		"":                                jsonMediaType,
+		"text/plain":                      jsonMediaType,
+		"application/cbor":                cborMediaType,
+		"application/json; charset=utf-8": jsonMediaType,
+	} {
+		r := withOptions(httptest.NewRequest(http.MethodPost, "/", nil), opts)
+		r.Header.Set("Content-Type", contentType)
+		if got := requestCodec(r).MediaType(); got != want {
+			t.Errorf("Content-Type %q: got %s, want %s", contentType, got, want)
+		}
+	}
+}
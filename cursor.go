@@ -0,0 +1,134 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/modelhub/core/paging"
+	"net/http"
+	"reflect"
+)
+
+// pageArgs is embedded in the args of every list handler. Offset/Limit give the
+// classic offset mode. Endpoints backed by a keyset query in core also accept
+// After/Before cursors, which hold the sort key and id of the item they were
+// issued for so pages neither shift nor repeat when items are inserted or
+// removed ahead of them, and SkipTotal, which stops core counting the results.
+type pageArgs struct {
+	Offset    int    `json:"offset"`
+	Limit     int    `json:"limit"`
+	After     string `json:"after"`
+	Before    string `json:"before"`
+	SkipTotal bool   `json:"skipTotal"`
+}
+
+func (p *pageArgs) capLimit(max int) {
+	if max > 0 && (p.Limit <= 0 || p.Limit > max) {
+		p.Limit = max
+	}
+}
+
+type pageFetcher func(offset int, limit int) (interface{}, int, error)
+
+// keysetFetcher fetches a page from a core keyset query.
+type keysetFetcher func(query *paging.Query) (interface{}, *paging.Info, error)
+
+type offsetResult struct {
+	TotalResults *int        `json:"totalResults,omitempty"`
+	Results      interface{} `json:"results"`
+	Before       string      `json:"before,omitempty"`
+	After        string      `json:"after,omitempty"`
+}
+
+// cursor is a keyset along with the sort order it was issued for, a cursor is
+// meaningless in any other order.
+type cursor struct {
+	SortBy string `json:"s,omitempty"`
+	paging.Keyset
+}
+
+func encodeCursor(sortBy string, keyset *paging.Keyset) string {
+	b, _ := json.Marshal(&cursor{SortBy: sortBy, Keyset: *keyset})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string, sortBy string) (*paging.Keyset, error) {
+	c := &cursor{}
+	if b, err := base64.RawURLEncoding.DecodeString(s); err != nil {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("invalid cursor"))
+	} else if err := json.Unmarshal(b, c); err != nil || c.Id == "" {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("invalid cursor"))
+	} else if c.SortBy != sortBy {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("cursor was issued for a different sortBy"))
+	}
+	return &c.Keyset, nil
+}
+
+// offsetOnly rejects the args only keyset endpoints support.
+func (p *pageArgs) offsetOnly() error {
+	if p.After != "" || p.Before != "" {
+		return newHttpError(http.StatusBadRequest, errors.New("cursors are not supported by this endpoint, use offset"))
+	} else if p.SkipTotal {
+		return newHttpError(http.StatusBadRequest, errors.New("skipTotal is not supported by this endpoint"))
+	}
+	return nil
+}
+
+// query builds the core keyset query for the args, sortBy is the handler's sort
+// order which cursors must have been issued for.
+func (p *pageArgs) query(sortBy string) (*paging.Query, error) {
+	q := &paging.Query{Offset: p.Offset, Limit: p.Limit, SkipTotal: p.SkipTotal}
+	if p.After == "" && p.Before == "" {
+		return q, nil
+	} else if p.After != "" && p.Before != "" {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("after and before cursors can not be used together"))
+	} else if p.Offset != 0 {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("offset can not be used with a cursor"))
+	} else if p.Limit <= 0 {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("limit must be greater than zero when using a cursor"))
+	}
+	var err error
+	if p.After != "" {
+		q.After, err = decodeCursor(p.After, sortBy)
+	} else {
+		q.Before, err = decodeCursor(p.Before, sortBy)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func offsetPage(res interface{}, total int) *offsetResult {
+	return &offsetResult{TotalResults: &total, Results: nonNilResults(res)}
+}
+
+// keysetPage issues cursors for the neighbouring pages core reported.
+func keysetPage(res interface{}, info *paging.Info, sortBy string) *offsetResult {
+	page := &offsetResult{Results: nonNilResults(res)}
+	if info.Total >= 0 {
+		page.TotalResults = &info.Total
+	}
+	if info.HasBefore && info.First != nil {
+		page.Before = encodeCursor(sortBy, info.First)
+	}
+	if info.HasAfter && info.Last != nil {
+		page.After = encodeCursor(sortBy, info.Last)
+	}
+	return page
+}
+
+func nonNilResults(res interface{}) interface{} {
+	if resultSlice(res).Len() == 0 {
+		return []interface{}{}
+	}
+	return res
+}
+
+func resultSlice(res interface{}) reflect.Value {
+	v := reflect.ValueOf(res)
+	if v.Kind() != reflect.Slice {
+		return reflect.ValueOf([]interface{}{})
+	}
+	return v
+}
@@ -0,0 +1,252 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/modelhub/core/paging"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type testItem struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func keysetOf(it *testItem) *paging.Keyset {
+	return &paging.Keyset{SortKey: it.Name, Id: it.Id}
+}
+
+func keysetLess(a, b *paging.Keyset) bool {
+	return a.SortKey < b.SortKey || (a.SortKey == b.SortKey && a.Id < b.Id)
+}
+
+// testKeysetSource answers keyset queries over items the way core does, items
+// are kept sorted by name then id.
+type testKeysetSource struct {
+	items []*testItem
+}
+
+func (s *testKeysetSource) put(items ...*testItem) {
+	s.items = append(s.items, items...)
+	sort.Slice(s.items, func(i, j int) bool { return keysetLess(keysetOf(s.items[i]), keysetOf(s.items[j])) })
+}
+
+func (s *testKeysetSource) remove(id string) {
+	for i, it := range s.items {
+		if it.Id == id {
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *testKeysetSource) fetch(q *paging.Query) (interface{}, *paging.Info, error) {
+	from, to := q.Offset, len(s.items)
+	if q.After != nil {
+		from = sort.Search(len(s.items), func(i int) bool { return keysetLess(q.After, keysetOf(s.items[i])) })
+	} else if q.Before != nil {
+		to = sort.Search(len(s.items), func(i int) bool { return !keysetLess(keysetOf(s.items[i]), q.Before) })
+		from = 0
+		if q.Limit > 0 && to-q.Limit > 0 {
+			from = to - q.Limit
+		}
+	}
+	if from > len(s.items) {
+		from = len(s.items)
+	}
+	if q.Before == nil && q.Limit > 0 && from+q.Limit < to {
+		to = from + q.Limit
+	}
+	res := s.items[from:to]
+	info := &paging.Info{Total: len(s.items), HasBefore: from > 0, HasAfter: to < len(s.items)}
+	if q.SkipTotal {
+		info.Total = -1
+	}
+	if len(res) > 0 {
+		info.First, info.Last = keysetOf(res[0]), keysetOf(res[len(res)-1])
+	}
+	return res, info, nil
+}
+
+func testSource(names ...string) *testKeysetSource {
+	s := &testKeysetSource{}
+	for _, name := range names {
+		s.put(&testItem{Id: name, Name: name})
+	}
+	return s
+}
+
+// page runs args through writeKeysetJson as the handlers do and decodes the
+// response.
+func (s *testKeysetSource) page(t *testing.T, args *pageArgs) (ids []string, page *offsetResult) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := writeKeysetJson(w, args, "nameAsc", nil, s.fetch, nil); err != nil {
+		t.Fatalf("writeKeysetJson: %v", err)
+	}
+	page = &offsetResult{}
+	items := []*testItem{}
+	page.Results = &items
+	if err := json.Unmarshal(w.Body.Bytes(), page); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body.String(), err)
+	}
+	for _, it := range items {
+		ids = append(ids, it.Id)
+	}
+	return ids, page
+}
+
+func assertIds(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != 0 || len(want) != 0 {
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func assertStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	if he, ok := err.(*httpError); !ok || he.status != status {
+		t.Fatalf("got %v, want a %d httpError", err, status)
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	keyset := &paging.Keyset{SortKey: "b", Id: "2"}
+	c := encodeCursor("nameAsc", keyset)
+	if got, err := decodeCursor(c, "nameAsc"); err != nil || *got != *keyset {
+		t.Fatalf("got %v %v, want %v", got, err, keyset)
+	}
+	_, err := decodeCursor(c, "nameDesc")
+	assertStatus(t, err, http.StatusBadRequest)
+	for _, invalid := range []string{"!!", "bm90IGpzb24", encodeCursor("nameAsc", &paging.Keyset{SortKey: "b"})} {
+		_, err := decodeCursor(invalid, "nameAsc")
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+}
+
+func TestPageArgsQuery(t *testing.T) {
+	c := encodeCursor("", &paging.Keyset{Id: "1"})
+	for _, args := range []*pageArgs{
+		{After: c, Before: c, Limit: 1},
+		{After: c, Offset: 1, Limit: 1},
+		{After: c},
+		{Before: "invalid", Limit: 1},
+	} {
+		_, err := args.query("")
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+	if q, err := (&pageArgs{Offset: 2, Limit: 3, SkipTotal: true}).query(""); err != nil || q.Offset != 2 || q.Limit != 3 || !q.SkipTotal || q.After != nil || q.Before != nil {
+		t.Fatalf("got %+v %v", q, err)
+	}
+	if q, err := (&pageArgs{Before: c, Limit: 3}).query(""); err != nil || q.Before == nil || q.Before.Id != "1" {
+		t.Fatalf("got %+v %v", q, err)
+	}
+}
+
+func TestOffsetOnly(t *testing.T) {
+	for _, args := range []*pageArgs{{After: "a"}, {Before: "a"}, {SkipTotal: true}} {
+		assertStatus(t, args.offsetOnly(), http.StatusBadRequest)
+	}
+	if err := (&pageArgs{Offset: 10, Limit: 5}).offsetOnly(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeysetPagingEdges(t *testing.T) {
+	s := testSource("a", "b", "c", "d", "e")
+
+	ids, first := s.page(t, &pageArgs{Limit: 2})
+	assertIds(t, ids, "a", "b")
+	if first.Before != "" || first.After == "" || first.TotalResults == nil || *first.TotalResults != 5 {
+		t.Fatalf("first page %+v", first)
+	}
+	ids, second := s.page(t, &pageArgs{After: first.After, Limit: 2})
+	assertIds(t, ids, "c", "d")
+	ids, last := s.page(t, &pageArgs{After: second.After, Limit: 2})
+	assertIds(t, ids, "e")
+	if last.After != "" || last.Before == "" {
+		t.Fatalf("last page %+v", last)
+	}
+
+	ids, back := s.page(t, &pageArgs{Before: last.Before, Limit: 2})
+	assertIds(t, ids, "c", "d")
+	ids, start := s.page(t, &pageArgs{Before: back.Before, Limit: 2})
+	assertIds(t, ids, "a", "b")
+	if start.Before != "" || start.After == "" {
+		t.Fatalf("start page %+v", start)
+	}
+	// paging back from the start page has nowhere to go
+	ids, again := s.page(t, &pageArgs{Before: second.Before, Limit: 2})
+	assertIds(t, ids, "a", "b")
+	if again.Before != "" {
+		t.Fatalf("page before the start %+v", again)
+	}
+}
+
+func TestKeysetPagingIsStable(t *testing.T) {
+	s := testSource("b", "d", "f", "h", "j")
+	ids, first := s.page(t, &pageArgs{Limit: 2})
+	assertIds(t, ids, "b", "d")
+
+	// more than a page of inserts ahead of the cursor and after it
+	s.put(&testItem{Id: "a", Name: "a"}, &testItem{Id: "a1", Name: "a1"}, &testItem{Id: "a2", Name: "a2"}, &testItem{Id: "c", Name: "c"})
+	ids, second := s.page(t, &pageArgs{After: first.After, Limit: 2})
+	assertIds(t, ids, "f", "h")
+
+	// the items the cursors were issued for going away doesn't matter
+	s.remove("f")
+	s.remove("h")
+	ids, _ = s.page(t, &pageArgs{After: second.After, Limit: 2})
+	assertIds(t, ids, "j")
+	ids, _ = s.page(t, &pageArgs{Before: second.Before, Limit: 2})
+	assertIds(t, ids, "c", "d")
+}
+
+func TestKeysetPagingSkipTotal(t *testing.T) {
+	s := testSource("a", "b", "c")
+	ids, page := s.page(t, &pageArgs{Limit: 2, SkipTotal: true})
+	assertIds(t, ids, "a", "b")
+	if page.TotalResults != nil || page.After == "" {
+		t.Fatalf("page %+v", page)
+	}
+	if _, p := s.page(t, &pageArgs{}); len(*p.Results.(*[]*testItem)) != 3 {
+		t.Fatalf("unlimited page %+v", p)
+	}
+}
+
+func TestKeysetPagingEmpty(t *testing.T) {
+	ids, page := testSource().page(t, &pageArgs{Limit: 2})
+	assertIds(t, ids)
+	if page.Before != "" || page.After != "" || *page.TotalResults != 0 {
+		t.Fatalf("page %+v", page)
+	}
+	w := httptest.NewRecorder()
+	writeKeysetJson(w, &pageArgs{Limit: 2}, "", nil, testSource().fetch, nil)
+	if body := w.Body.String(); body != `{"totalResults":0,"results":[]}`+"\n" && body != `{"totalResults":0,"results":[]}` {
+		t.Fatalf("body %q", body)
+	}
+}
+
+func TestKeysetChunks(t *testing.T) {
+	s := testSource("a", "b", "c", "d", "e")
+	next := keysetChunks(s.fetch, &paging.Query{Offset: 1})
+	ids := []string{}
+	for more, total := true, 0; more; {
+		var res interface{}
+		var err error
+		if res, total, more, err = next(2); err != nil {
+			t.Fatal(err)
+		} else if len(ids) == 0 && total != 5 || len(ids) > 0 && total != -1 {
+			t.Fatalf("total %d after %v", total, ids)
+		}
+		for _, it := range res.([]*testItem) {
+			ids = append(ids, it.Id)
+		}
+	}
+	assertIds(t, ids, "b", "c", "d", "e")
+}
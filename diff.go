@@ -0,0 +1,257 @@
+package rest
+
+import (
+	"errors"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/documentversion"
+	"github.com/modelhub/core/projectspaceversion"
+	"github.com/modelhub/core/sheet"
+	"github.com/modelhub/core/sheettransform"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// documentVersionDiffIgnored are the document version properties that always
+// differ between versions or describe the upload rather than the file, labels
+// and thumbnails can be changed without a new file.
+var documentVersionDiffIgnored = map[string]bool{
+	"id":            true,
+	"document":      true,
+	"project":       true,
+	"version":       true,
+	"uploaded":      true,
+	"uploadedBy":    true,
+	"uploadComment": true,
+	"status":        true,
+	"sheetCount":    true,
+	"labels":        true,
+	"thumbnailType": true,
+}
+
+type documentVersionChanges struct {
+	From     string                              `json:"from"`
+	To       string                              `json:"to"`
+	Sheets   []*sheetChange                      `json:"sheets"`
+	Metadata []*propertyChange                   `json:"metadata"`
+	Elements *documentversion.ElementDiffSummary `json:"elements"`
+}
+
+type sheetChange struct {
+	Change string       `json:"change"`
+	From   *sheet.Sheet `json:"from,omitempty"`
+	To     *sheet.Sheet `json:"to,omitempty"`
+}
+
+type propertyChange struct {
+	Property string      `json:"property"`
+	From     interface{} `json:"from"`
+	To       interface{} `json:"to"`
+}
+
+// diffSheets pairs sheets by manifest path, which follows a view through a
+// rename, then by name and role. Unchanged sheets aren't reported.
+func diffSheets(from []*sheet.Sheet, to []*sheet.Sheet) []*sheetChange {
+	changes := []*sheetChange{}
+	claimed := make([]bool, len(to))
+	match := func(matches func(*sheet.Sheet) bool) *sheet.Sheet {
+		for i, s := range to {
+			if !claimed[i] && matches(s) {
+				claimed[i] = true
+				return s
+			}
+		}
+		return nil
+	}
+	for _, f := range from {
+		if t := match(func(s *sheet.Sheet) bool { return f.Manifest != "" && s.Manifest == f.Manifest }); t != nil {
+			if t.Name != f.Name {
+				changes = append(changes, &sheetChange{Change: "renamed", From: f, To: t})
+			}
+		} else if t := match(func(s *sheet.Sheet) bool { return s.Name == f.Name && s.Role == f.Role }); t == nil {
+			changes = append(changes, &sheetChange{Change: "removed", From: f})
+		}
+	}
+	for i, t := range to {
+		if !claimed[i] {
+			changes = append(changes, &sheetChange{Change: "added", To: t})
+		}
+	}
+	return changes
+}
+
+// diffProperties compares the JSON properties of from and to, skipping ignored
+// ones, in property name order.
+func diffProperties(from interface{}, to interface{}, ignored map[string]bool) ([]*propertyChange, error) {
+	var f, t interface{}
+	if err := toGeneric(from, &f); err != nil {
+		return nil, err
+	} else if err := toGeneric(to, &t); err != nil {
+		return nil, err
+	}
+	fm, _ := f.(map[string]interface{})
+	tm, _ := t.(map[string]interface{})
+	names := []string{}
+	for name := range fm {
+		names = append(names, name)
+	}
+	for name := range tm {
+		if _, exists := fm[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := []*propertyChange{}
+	for _, name := range names {
+		if !ignored[name] && !reflect.DeepEqual(fm[name], tm[name]) {
+			changes = append(changes, &propertyChange{Property: name, From: fm[name], To: tm[name]})
+		}
+	}
+	return changes, nil
+}
+
+// getDocumentVersionPair returns the from and to versions of a diff, which
+// must be different versions of the same document.
+func getDocumentVersionPair(coreApi core.CoreApi, forUser string, from string, to string) (*documentversion.DocumentVersion, *documentversion.DocumentVersion, error) {
+	if from == to {
+		return nil, nil, newHttpError(http.StatusBadRequest, errors.New("from and to must be different versions"))
+	}
+	dvs, err := coreApi.DocumentVersion().Get(forUser, []string{from, to})
+	if err != nil {
+		return nil, nil, err
+	} else if len(dvs) != 2 {
+		return nil, nil, newHttpError(http.StatusNotFound, errors.New("document version not found"))
+	}
+	// core doesn't guarantee the order of results
+	fromDv, toDv := dvs[0], dvs[1]
+	if fromDv.Id != from {
+		fromDv, toDv = toDv, fromDv
+	}
+	if fromDv.Document != toDv.Document {
+		return nil, nil, newHttpError(http.StatusBadRequest, errors.New("document versions must be of the same document"))
+	}
+	return fromDv, toDv, nil
+}
+
+type projectSpaceVersionChanges struct {
+	From            string                  `json:"from"`
+	To              string                  `json:"to"`
+	SheetTransforms []*sheetTransformChange `json:"sheetTransforms"`
+	Camera          []*propertyChange       `json:"camera"`
+}
+
+// sheetTransformChange has a Delta for moved sheets when both transforms are
+// matrices, other transform changes are reported without one.
+type sheetTransformChange struct {
+	Change string                         `json:"change"`
+	From   *sheettransform.SheetTransform `json:"from,omitempty"`
+	To     *sheettransform.SheetTransform `json:"to,omitempty"`
+	Delta  *transformDelta                `json:"delta,omitempty"`
+}
+
+// transformDelta is the translation from the old to the new origin and the
+// angle in degrees of the rotation taking the old orientation to the new.
+type transformDelta struct {
+	Translation [3]float64 `json:"translation"`
+	Distance    float64    `json:"distance"`
+	Rotation    float64    `json:"rotation"`
+}
+
+// diffSheetTransforms pairs sheet transforms by sheet, a sheet may be placed
+// more than once so each transform on the from side claims the first unclaimed
+// one for the same sheet on the to side.
+func diffSheetTransforms(from []*sheettransform.SheetTransform, to []*sheettransform.SheetTransform) ([]*sheetTransformChange, error) {
+	changes := []*sheetTransformChange{}
+	claimed := make([]bool, len(to))
+	for _, f := range from {
+		var t *sheettransform.SheetTransform
+		for i, st := range to {
+			if !claimed[i] && st.Sheet == f.Sheet {
+				claimed[i] = true
+				t = st
+				break
+			}
+		}
+		if t == nil {
+			changes = append(changes, &sheetTransformChange{Change: "removed", From: f})
+			continue
+		}
+		var fTransform, tTransform interface{}
+		if err := toGeneric(f.Transform, &fTransform); err != nil {
+			return nil, err
+		} else if err := toGeneric(t.Transform, &tTransform); err != nil {
+			return nil, err
+		} else if !reflect.DeepEqual(fTransform, tTransform) {
+			changes = append(changes, &sheetTransformChange{Change: "moved", From: f, To: t, Delta: diffTransforms(fTransform, tTransform)})
+		}
+	}
+	for i, t := range to {
+		if !claimed[i] {
+			changes = append(changes, &sheetTransformChange{Change: "added", To: t})
+		}
+	}
+	return changes, nil
+}
+
+// transformMatrix reads a 4x4 column major matrix, as the viewer's placement
+// transforms are, given either as a plain array or as a serialized matrix
+// object with an elements array.
+func transformMatrix(transform interface{}) ([]float64, bool) {
+	if obj, ok := transform.(map[string]interface{}); ok {
+		transform = obj["elements"]
+	}
+	elements, ok := transform.([]interface{})
+	if !ok || len(elements) != 16 {
+		return nil, false
+	}
+	m := make([]float64, 16)
+	for i, e := range elements {
+		if m[i], ok = e.(float64); !ok {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func diffTransforms(from interface{}, to interface{}) *transformDelta {
+	f, fOk := transformMatrix(from)
+	t, tOk := transformMatrix(to)
+	if !fOk || !tOk {
+		return nil
+	}
+	delta := &transformDelta{}
+	for i := 0; i < 3; i++ {
+		delta.Translation[i] = t[12+i] - f[12+i]
+		delta.Distance += delta.Translation[i] * delta.Translation[i]
+	}
+	delta.Distance = math.Sqrt(delta.Distance)
+	// the trace of the relative rotation to * from^T is the sum of the dot
+	// products of matching basis vectors, scale is divided out of each.
+	trace := 0.0
+	for col := 0; col < 3; col++ {
+		dot, fLen, tLen := 0.0, 0.0, 0.0
+		for row := 0; row < 3; row++ {
+			fe, te := f[col*4+row], t[col*4+row]
+			dot += fe * te
+			fLen += fe * fe
+			tLen += te * te
+		}
+		if fLen == 0 || tLen == 0 {
+			return delta
+		}
+		trace += dot / math.Sqrt(fLen*tLen)
+	}
+	cos := math.Max(-1, math.Min(1, (trace-1)/2))
+	delta.Rotation = math.Acos(cos) * 180 / math.Pi
+	return delta
+}
+
+// projectSpaceVersionPair returns the from and to versions of a pair fetched
+// from core, which doesn't guarantee the order of results.
+func projectSpaceVersionPair(psvs []*projectspaceversion.ProjectSpaceVersion, from string) (*projectspaceversion.ProjectSpaceVersion, *projectspaceversion.ProjectSpaceVersion) {
+	if psvs[0].Id == from {
+		return psvs[0], psvs[1]
+	}
+	return psvs[1], psvs[0]
+}
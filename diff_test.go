@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/documentversion"
+	"github.com/modelhub/core/sheet"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testMatrix builds a column major 4x4 matrix, as the viewer serializes them,
+// rotating by degrees about z, scaling uniformly and translating.
+func testMatrix(degrees, scale float64, translation [3]float64) []interface{} {
+	cos, sin := math.Cos(degrees*math.Pi/180)*scale, math.Sin(degrees*math.Pi/180)*scale
+	m := []float64{
+		cos, sin, 0, 0,
+		-sin, cos, 0, 0,
+		0, 0, scale, 0,
+		translation[0], translation[1], translation[2], 1,
+	}
+	res := make([]interface{}, len(m))
+	for i, e := range m {
+		res[i] = e
+	}
+	return res
+}
+
+func assertDelta(t *testing.T, got *transformDelta, translation [3]float64, rotation float64) {
+	t.Helper()
+	if got == nil {
+		t.Fatal("got no delta")
+	}
+	for i := range translation {
+		if math.Abs(got.Translation[i]-translation[i]) > 1e-9 {
+			t.Fatalf("translation %v, want %v", got.Translation, translation)
+		}
+	}
+	distance := math.Sqrt(translation[0]*translation[0] + translation[1]*translation[1] + translation[2]*translation[2])
+	if math.Abs(got.Distance-distance) > 1e-9 {
+		t.Fatalf("distance %g, want %g", got.Distance, distance)
+	} else if math.Abs(got.Rotation-rotation) > 1e-6 {
+		t.Fatalf("rotation %g, want %g", got.Rotation, rotation)
+	}
+}
+
+func TestDiffTransformsTranslation(t *testing.T) {
+	delta := diffTransforms(testMatrix(30, 1, [3]float64{1, 2, 3}), testMatrix(30, 1, [3]float64{4, 6, 3}))
+	assertDelta(t, delta, [3]float64{3, 4, 0}, 0)
+}
+
+func TestDiffTransformsRotation(t *testing.T) {
+	for _, c := range []struct {
+		from, to, rotation float64
+	}{
+		{0, 90, 90},
+		{90, 0, 90},
+		{10, 190, 180},
+		{-45, 45, 90},
+		{0, 270, 90},
+	} {
+		delta := diffTransforms(testMatrix(c.from, 1, [3]float64{}), testMatrix(c.to, 1, [3]float64{}))
+		assertDelta(t, delta, [3]float64{}, c.rotation)
+	}
+}
+
+func TestDiffTransformsIgnoresScale(t *testing.T) {
+	delta := diffTransforms(testMatrix(0, 1, [3]float64{}), testMatrix(60, 0.3048, [3]float64{0, 0, -1}))
+	assertDelta(t, delta, [3]float64{0, 0, -1}, 60)
+}
+
+func TestDiffTransformsMatrixObject(t *testing.T) {
+	from := map[string]interface{}{"elements": testMatrix(0, 1, [3]float64{})}
+	to := map[string]interface{}{"elements": testMatrix(90, 1, [3]float64{1, 0, 0})}
+	assertDelta(t, diffTransforms(from, to), [3]float64{1, 0, 0}, 90)
+}
+
+func TestDiffTransformsNotMatrices(t *testing.T) {
+	for _, transform := range []interface{}{
+		nil,
+		map[string]interface{}{"position": []interface{}{1.0, 2.0, 3.0}},
+		[]interface{}{1.0, 2.0},
+		append(testMatrix(0, 1, [3]float64{})[:15], "1"),
+	} {
+		if delta := diffTransforms(transform, testMatrix(0, 1, [3]float64{})); delta != nil {
+			t.Errorf("%v: got %+v, want no delta", transform, delta)
+		}
+	}
+	// a degenerate basis still reports the translation
+	delta := diffTransforms(testMatrix(0, 0, [3]float64{}), testMatrix(0, 1, [3]float64{1, 0, 0}))
+	if delta == nil || delta.Distance != 1 || delta.Rotation != 0 {
+		t.Fatalf("got %+v", delta)
+	}
+}
+
+func TestDiffSheets(t *testing.T) {
+	from := []*sheet.Sheet{
+		{Id: "1", Name: "Level 1", Role: "2d", Manifest: "m1"},
+		{Id: "2", Name: "3D", Role: "3d"},
+		{Id: "3", Name: "Gone", Role: "2d"},
+	}
+	to := []*sheet.Sheet{
+		{Id: "4", Name: "3D", Role: "3d"},
+		{Id: "5", Name: "Ground floor", Role: "2d", Manifest: "m1"},
+		{Id: "6", Name: "New", Role: "2d"},
+	}
+	got := []string{}
+	for _, change := range diffSheets(from, to) {
+		ids := change.Change
+		if change.From != nil {
+			ids += " " + change.From.Id
+		}
+		if change.To != nil {
+			ids += " " + change.To.Id
+		}
+		got = append(got, ids)
+	}
+	if want := []string{"renamed 1 5", "removed 3", "added 6"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiffProperties(t *testing.T) {
+	from := map[string]interface{}{"id": "a", "name": "x", "size": 1, "gone": true}
+	to := map[string]interface{}{"id": "b", "name": "x", "size": 2, "new": "y"}
+	changes, err := diffProperties(from, to, map[string]bool{"id": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*propertyChange{
+		{Property: "gone", From: true},
+		{Property: "new", To: "y"},
+		{Property: "size", From: float64(1), To: float64(2)},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got %+v, want %+v", changes, want)
+	}
+}
+
+func TestDocumentVersionDiffIgnoresLabels(t *testing.T) {
+	from := map[string]interface{}{"id": "a", "version": 1, "labels": []string{}, "thumbnailType": "", "fileType": "rvt"}
+	to := map[string]interface{}{"id": "b", "version": 2, "labels": []string{"issued"}, "thumbnailType": "image/png", "fileType": "rvt"}
+	if changes, err := diffProperties(from, to, documentVersionDiffIgnored); err != nil || len(changes) != 0 {
+		t.Fatalf("got %+v %v", changes, err)
+	}
+}
+
+// testDiffCore has versions a1 and a2 of document a and b1 of document b, it
+// fails the test if elements are diffed.
+type testDiffCore struct {
+	core.CoreApi
+	versions testDiffVersions
+}
+
+type testDiffVersions struct {
+	documentversion.DocumentVersionApi
+	t *testing.T
+}
+
+func (c *testDiffCore) DocumentVersion() documentversion.DocumentVersionApi { return c.versions }
+
+func (v testDiffVersions) Get(forUser string, ids []string) ([]*documentversion.DocumentVersion, error) {
+	res := []*documentversion.DocumentVersion{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if id := ids[i]; id != "missing" {
+			res = append(res, &documentversion.DocumentVersion{Id: id, Document: id[:1]})
+		}
+	}
+	return res, nil
+}
+
+func (v testDiffVersions) DiffElements(forUser, from, to string, change documentversion.ElementChangeKind, offset, limit int) ([]*documentversion.ElementChange, int, bool, error) {
+	v.t.Fatalf("diffed %s and %s", from, to)
+	return nil, 0, false, nil
+}
+
+func TestGetDocumentVersionPair(t *testing.T) {
+	c := &testDiffCore{versions: testDiffVersions{t: t}}
+	if from, to, err := getDocumentVersionPair(c, "u", "a1", "a2"); err != nil || from.Id != "a1" || to.Id != "a2" {
+		t.Fatalf("got %v %v %v", from, to, err)
+	}
+	for _, c := range []struct {
+		from, to string
+		status   int
+	}{
+		{"a1", "a1", http.StatusBadRequest},
+		{"a1", "b1", http.StatusBadRequest},
+		{"a1", "missing", http.StatusNotFound},
+	} {
+		r := testJsonRequest(nil, fmt.Sprintf(`{"from": %q, "to": %q}`, c.from, c.to))
+		err := documentVersionDiffElements(&testDiffCore{versions: testDiffVersions{t: t}}, "u", nil, httptest.NewRecorder(), r, nil)
+		assertStatus(t, err, c.status)
+	}
+}
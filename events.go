@@ -0,0 +1,278 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/clashtest"
+	"github.com/modelhub/core/documentversion"
+	"github.com/robsix/golog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventStreamMediaType    = "text/event-stream"
+	defaultEventHistorySize = 1000
+	eventBufferSize         = 64
+	eventKeepAliveInterval  = 30 * time.Second
+)
+
+type eventType string
+
+const (
+	nodeCreated              eventType = "nodeCreated"
+	nodeRenamed              eventType = "nodeRenamed"
+	nodeMoved                eventType = "nodeMoved"
+	versionUploaded          eventType = "versionUploaded"
+	translationStatusChanged eventType = "translationStatusChanged"
+	membershipChanged        eventType = "membershipChanged"
+	clashTestFinished        eventType = "clashTestFinished"
+	// resetEvent tells a resuming client events were missed, it should refetch
+	// anything it's showing.
+	resetEvent eventType = "reset"
+)
+
+// event is sent to subscribers of its project and to the user streams of the
+// users it concerns.
+type event struct {
+	Id      string      `json:"id"`
+	Type    eventType   `json:"type"`
+	Project string      `json:"project,omitempty"`
+	Time    string      `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+	seq     uint64
+	users   []string
+}
+
+type membershipChange struct {
+	Change string   `json:"change"`
+	Users  []string `json:"users"`
+	Role   string   `json:"role,omitempty"`
+}
+
+// eventBus fans events out to subscribers and keeps the most recent ones so
+// clients can resume with Last-Event-ID. Event ids are prefixed with the bus's
+// start time, after a restart ids from the previous process are unknown and
+// resuming clients are sent a reset event.
+type eventBus struct {
+	mtx         sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []*event
+	historySize int
+	subscribers map[*eventSubscription]bool
+}
+
+type eventSubscription struct {
+	matches func(*event) bool
+	events  chan *event
+}
+
+func newEventBus(historySize int, now time.Time) *eventBus {
+	return &eventBus{
+		epoch:       strconv.FormatInt(now.UnixNano(), 36),
+		historySize: historySize,
+		subscribers: map[*eventSubscription]bool{},
+	}
+}
+
+// publish never blocks, subscribers that have fallen eventBufferSize events
+// behind are dropped and can resume from where they got to.
+func (b *eventBus) publish(ev *event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.seq++
+	ev.seq = b.seq
+	ev.Id = b.epoch + "-" + strconv.FormatUint(b.seq, 10)
+	b.history = append(b.history, ev)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+	for sub := range b.subscribers {
+		if sub.matches(ev) {
+			select {
+			case sub.events <- ev:
+			default:
+				b.remove(sub)
+			}
+		}
+	}
+}
+
+// subscribe returns the events after lastEventId to replay before those sent
+// on the subscription, resetId is set if some of them are no longer known and
+// is the id to give the reset event.
+func (b *eventBus) subscribe(lastEventId string, matches func(*event) bool) (sub *eventSubscription, replay []*event, resetId string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	sub = &eventSubscription{matches: matches, events: make(chan *event, eventBufferSize)}
+	b.subscribers[sub] = true
+	if lastEventId == "" {
+		return sub, nil, ""
+	}
+	parts := strings.SplitN(lastEventId, "-", 2)
+	seq, err := uint64(0), error(nil)
+	if len(parts) == 2 {
+		seq, err = strconv.ParseUint(parts[1], 10, 64)
+	}
+	oldest := b.seq + 1
+	if len(b.history) > 0 {
+		oldest = b.history[0].seq
+	}
+	if len(parts) != 2 || err != nil || parts[0] != b.epoch || seq > b.seq || seq+1 < oldest {
+		return sub, nil, b.epoch + "-" + strconv.FormatUint(b.seq, 10)
+	}
+	for _, ev := range b.history {
+		if ev.seq > seq && matches(ev) {
+			replay = append(replay, ev)
+		}
+	}
+	return sub, replay, ""
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscription) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.subscribers[sub] {
+		b.remove(sub)
+	}
+}
+
+func (b *eventBus) remove(sub *eventSubscription) {
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// publishEvent is called by handlers after a mutation has succeeded, events
+// aren't kept when the event endpoints are disabled.
+func publishEvent(opts *options, typ eventType, project string, users []string, data interface{}) {
+	if opts.disabled[EventGroup] {
+		return
+	}
+	opts.events.publish(&event{
+		Type:    typ,
+		Project: project,
+		Time:    opts.clock().UTC().Format(time.RFC3339),
+		Data:    data,
+		users:   users,
+	})
+}
+
+func publishMembershipChange(r *http.Request, project string, change string, users []string, role string) {
+	publishEvent(optionsFrom(r), membershipChanged, project, users, &membershipChange{Change: change, Users: users, Role: role})
+}
+
+// publishNodes publishes an event with the current state of each node, failing
+// to fetch them is only logged as the mutation has already succeeded.
+func publishNodes(coreApi core.CoreApi, forUser string, typ eventType, ids []string, r *http.Request, log golog.Log) {
+	if nodes, err := coreApi.TreeNode().Get(forUser, ids); err != nil {
+		log.Warning("RestApi failed to get tree nodes for %s events: %v", typ, err)
+	} else {
+		for _, node := range nodes {
+			publishEvent(optionsFrom(r), typ, node.Project, nil, node)
+		}
+	}
+}
+
+func translationFinished(status documentversion.Status) bool {
+	switch status {
+	case documentversion.Success, documentversion.Failed, documentversion.FailedToRegister, documentversion.WontRegister:
+		return true
+	default:
+		return false
+	}
+}
+
+// publishVersion publishes an event for dv and watches its translation.
+func publishVersion(forUser string, typ eventType, dv *documentversion.DocumentVersion, r *http.Request) {
+	if opts := optionsFrom(r); !opts.disabled[EventGroup] {
+		publishEvent(opts, typ, dv.Project, nil, dv)
+		opts.watcher.watchTranslation(forUser, dv)
+	}
+}
+
+// publishFirstVersion is publishVersion for the version a document was created
+// with, it's fetched by the watcher so the create isn't held up.
+func publishFirstVersion(forUser string, document string, r *http.Request) {
+	if opts := optionsFrom(r); !opts.disabled[EventGroup] {
+		opts.watcher.watchFirstVersion(forUser, document)
+	}
+}
+
+// publishClashTests watches tests to publish clashTestFinished events.
+func publishClashTests(forUser string, projectSpaceVersion string, tests []*clashtest.ClashTest, r *http.Request) {
+	if opts := optionsFrom(r); !opts.disabled[EventGroup] {
+		opts.watcher.watchClashTests(forUser, projectSpaceVersion, tests)
+	}
+}
+
+// eventFilter picks the events for a stream, a project stream gets all of the
+// project's events, a user stream those of every project the user is a member
+// of and any concerning the user.
+type eventFilter struct {
+	user     string
+	project  string
+	mtx      sync.RWMutex
+	projects map[string]bool
+}
+
+func (f *eventFilter) matches(ev *event) bool {
+	if f.project != "" {
+		return ev.Project == f.project
+	} else if f.concerns(ev) {
+		return true
+	}
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return f.projects[ev.Project]
+}
+
+func (f *eventFilter) concerns(ev *event) bool {
+	for _, user := range ev.users {
+		if user == f.user {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh checks the user's access to the project or, for a user stream,
+// reloads the user's projects.
+func (f *eventFilter) refresh(coreApi core.CoreApi) error {
+	if f.project != "" {
+		_, err := coreApi.Project().GetRole(f.user, f.project)
+		return err
+	}
+	projects := map[string]bool{}
+	err := fetchAll(func(offset int, limit int) (int, int, error) {
+		res, total, err := coreApi.Project().GetInUserContext(f.user, f.user, "", offset, limit, "")
+		for _, p := range res {
+			projects[p.Id] = true
+		}
+		return len(res), total, err
+	})
+	if err == nil {
+		f.mtx.Lock()
+		f.projects = projects
+		f.mtx.Unlock()
+	}
+	return err
+}
+
+// writeEvent writes ev in the text/event-stream format, the data is the whole
+// event as a single line of JSON.
+func writeEvent(w http.ResponseWriter, ev *event) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "id: %s\nevent: %s\ndata: ", ev.Id, ev.Type)
+	if err := json.NewEncoder(buf).Encode(ev); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,84 @@
+package rest
+
+import (
+	"testing"
+	"time"
+)
+
+func allEvents(*event) bool { return true }
+
+func publishTestEvents(b *eventBus, projects ...string) {
+	for _, project := range projects {
+		b.publish(&event{Type: nodeCreated, Project: project})
+	}
+}
+
+func assertReplay(t *testing.T, replay []*event, projects ...string) {
+	t.Helper()
+	if len(replay) != len(projects) {
+		t.Fatalf("replayed %d events, want %d", len(replay), len(projects))
+	}
+	for i, ev := range replay {
+		if ev.Project != projects[i] {
+			t.Fatalf("replayed %s at %d, want %s", ev.Project, i, projects[i])
+		}
+	}
+}
+
+func TestEventBusResume(t *testing.T) {
+	b := newEventBus(10, time.Unix(1, 0))
+	publishTestEvents(b, "a", "b", "c")
+	_, replay, resetId := b.subscribe(b.history[0].Id, allEvents)
+	if resetId != "" {
+		t.Fatalf("reset %s", resetId)
+	}
+	assertReplay(t, replay, "b", "c")
+
+	// resuming from the latest event replays nothing
+	if _, replay, resetId := b.subscribe(b.history[2].Id, allEvents); resetId != "" || len(replay) != 0 {
+		t.Fatalf("replay %v, reset %s", replay, resetId)
+	}
+	// only matching events are replayed
+	_, replay, _ = b.subscribe(b.history[0].Id, func(ev *event) bool { return ev.Project == "c" })
+	assertReplay(t, replay, "c")
+}
+
+func TestEventBusReset(t *testing.T) {
+	b := newEventBus(2, time.Unix(1, 0))
+	publishTestEvents(b, "a", "b", "c", "d")
+	first := b.epoch + "-1"
+	restarted := newEventBus(2, time.Unix(2, 0)).epoch + "-3"
+	for _, lastEventId := range []string{first, restarted, b.epoch + "-9", b.epoch, "junk", b.epoch + "-x"} {
+		_, replay, resetId := b.subscribe(lastEventId, allEvents)
+		if resetId != b.epoch+"-4" || len(replay) != 0 {
+			t.Errorf("%s: replay %v, reset %q", lastEventId, replay, resetId)
+		}
+	}
+	// the oldest event kept is still enough to resume from the one before it
+	_, replay, resetId := b.subscribe(b.epoch+"-2", allEvents)
+	if resetId != "" {
+		t.Fatalf("reset %s", resetId)
+	}
+	assertReplay(t, replay, "c", "d")
+}
+
+func TestEventBusDeliversAndDropsSlowSubscribers(t *testing.T) {
+	b := newEventBus(eventBufferSize*2, time.Unix(1, 0))
+	sub, _, _ := b.subscribe("", func(ev *event) bool { return ev.Project == "p" })
+	publishTestEvents(b, "other", "p")
+	if ev := <-sub.events; ev.Project != "p" || ev.Id != b.epoch+"-2" {
+		t.Fatalf("got %+v", ev)
+	}
+	for i := 0; i <= eventBufferSize; i++ {
+		publishTestEvents(b, "p")
+	}
+	count := 0
+	for range sub.events {
+		count++
+	}
+	if count != eventBufferSize || len(b.subscribers) != 0 {
+		t.Fatalf("received %d events before being dropped, %d subscribers", count, len(b.subscribers))
+	}
+	// unsubscribing after being dropped is harmless
+	b.unsubscribe(sub)
+}
@@ -1,181 +1,685 @@
 package rest
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/modelhub/core"
+	"github.com/modelhub/core/clashtest"
 	"github.com/modelhub/core/documentversion"
 	"github.com/modelhub/core/helper"
+	"github.com/modelhub/core/issue"
+	"github.com/modelhub/core/metadata"
+	"github.com/modelhub/core/paging"
 	"github.com/modelhub/core/project"
 	"github.com/modelhub/core/projectspaceversion"
 	"github.com/modelhub/core/sheet"
 	"github.com/modelhub/core/sheettransform"
 	"github.com/modelhub/core/treenode"
 	"github.com/modelhub/core/user"
+	"github.com/modelhub/core/viewpoint"
 	"github.com/modelhub/session"
 	"github.com/modelhub/vada"
 	"github.com/robsix/golog"
 	sj "github.com/robsix/json"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-const (
-	sheetGetItemPath = "/api/v1/sheet/getItem/"
-)
-
-func NewRestApi(coreApi core.CoreApi, getSession session.SessionGetter, vada vada.VadaClient, log golog.Log) *http.ServeMux {
-	mux := http.NewServeMux()
+func NewRestApi(coreApi core.CoreApi, getSession session.SessionGetter, vada vada.VadaClient, log golog.Log, opts ...Option) http.Handler {
+	api := newRestApi(coreApi, getSession, log, newOptions(opts))
+	propertyDbs := newPropertyDbCache(vada, api.opts.propertyDbCacheSize)
 	//user
-	mux.HandleFunc("/api/v1/user/getCurrent", handlerWrapper(coreApi, getSession, userGetCurrent, log))
-	mux.HandleFunc("/api/v1/user/setProperty", handlerWrapper(coreApi, getSession, userSetProperty, log))
-	mux.HandleFunc("/api/v1/user/get", handlerWrapper(coreApi, getSession, userGet, log))
-	mux.HandleFunc("/api/v1/user/search", handlerWrapper(coreApi, getSession, userSearch, log))
+	api.handleRead(UserGroup, "/user/getCurrent", userGetCurrent)
+	api.handle(UserGroup, "/user/setProperty", userSetProperty)
+	api.handleRead(UserGroup, "/user/get", userGet)
+	api.handleRead(UserGroup, "/user/search", userSearch)
+	api.handleRead(UserGroup, "/user/getRecent", userGetRecent)
+	api.handle(UserGroup, "/user/addRecent", userAddRecent)
+	api.handleRead(UserGroup, "/user/getFavorites", userGetFavorites)
+	api.handle(UserGroup, "/user/addFavorites", userAddFavorites)
+	api.handle(UserGroup, "/user/removeFavorites", userRemoveFavorites)
 	//project
-	mux.HandleFunc("/api/v1/project/create", handlerWrapper(coreApi, getSession, projectCreate, log))
-	mux.HandleFunc("/api/v1/project/setName", handlerWrapper(coreApi, getSession, projectSetName, log))
-	mux.HandleFunc("/api/v1/project/setThumbnail", handlerWrapper(coreApi, getSession, projectSetThumbnail, log))
-	mux.HandleFunc("/api/v1/project/addUsers", handlerWrapper(coreApi, getSession, projectAddUsers, log))
-	mux.HandleFunc("/api/v1/project/removeUsers", handlerWrapper(coreApi, getSession, projectRemoveUsers, log))
-	mux.HandleFunc("/api/v1/project/acceptInvite", handlerWrapper(coreApi, getSession, projectAcceptInvite, log))
-	mux.HandleFunc("/api/v1/project/declineInvite", handlerWrapper(coreApi, getSession, projectDeclineInvite, log))
-	mux.HandleFunc("/api/v1/project/getRole", handlerWrapper(coreApi, getSession, projectGetRole, log))
-	mux.HandleFunc("/api/v1/project/getMemberships", handlerWrapper(coreApi, getSession, projectGetMemberships, log))
-	mux.HandleFunc("/api/v1/project/getMembershipInvites", handlerWrapper(coreApi, getSession, projectGetMembershipInvites, log))
-	mux.HandleFunc("/api/v1/project/getThumbnail/", getThumbnailWrapper(coreApi.Project().GetThumbnail, getSession, log))
-	mux.HandleFunc("/api/v1/project/get", handlerWrapper(coreApi, getSession, projectGet, log))
-	mux.HandleFunc("/api/v1/project/getInUserContext", handlerWrapper(coreApi, getSession, projectGetInUserContext, log))
-	mux.HandleFunc("/api/v1/project/getInUserInviteContext", handlerWrapper(coreApi, getSession, projectGetInUserInviteContext, log))
-	mux.HandleFunc("/api/v1/project/search", handlerWrapper(coreApi, getSession, projectSearch, log))
+	api.handle(ProjectGroup, "/project/create", projectCreate)
+	api.handle(ProjectGroup, "/project/setName", projectSetName)
+	api.handle(ProjectGroup, "/project/setThumbnail", projectSetThumbnail)
+	api.handle(ProjectGroup, "/project/addUsers", projectAddUsers)
+	api.handle(ProjectGroup, "/project/removeUsers", projectRemoveUsers)
+	api.handle(ProjectGroup, "/project/setUserRoles", projectSetUserRoles)
+	api.handle(ProjectGroup, "/project/transferOwnership", projectTransferOwnership)
+	api.handle(ProjectGroup, "/project/leave", projectLeave)
+	api.handle(ProjectGroup, "/project/acceptInvite", projectAcceptInvite)
+	api.handle(ProjectGroup, "/project/declineInvite", projectDeclineInvite)
+	api.handle(ProjectGroup, "/project/inviteByEmail", projectInviteByEmail)
+	api.handleRead(ProjectGroup, "/project/getEmailInvites", projectGetEmailInvites)
+	api.handle(ProjectGroup, "/project/revokeEmailInvites", projectRevokeEmailInvites)
+	api.handle(ProjectGroup, "/project/acceptEmailInvite", projectAcceptEmailInvite)
+	api.handleRead(ProjectGroup, "/project/getRole", projectGetRole)
+	api.handleRead(ProjectGroup, "/project/getMemberships", projectGetMemberships)
+	api.handleRead(ProjectGroup, "/project/getMembershipInvites", projectGetMembershipInvites)
+	api.handleRead(ProjectGroup, "/project/getThumbnail/", getThumbnailHandler(coreApi.Project().GetThumbnail))
+	api.handleRead(ProjectGroup, "/project/get", projectGet)
+	api.handleRead(ProjectGroup, "/project/getInUserContext", projectGetInUserContext)
+	api.handleRead(ProjectGroup, "/project/getInUserInviteContext", projectGetInUserInviteContext)
+	api.handleRead(ProjectGroup, "/project/search", projectSearch)
+	api.handle(ProjectGroup, "/project/archive", projectArchive)
+	api.handle(ProjectGroup, "/project/unarchive", projectUnarchive)
+	api.handle(ProjectGroup, "/project/scheduleDelete", projectScheduleDelete)
+	api.handle(ProjectGroup, "/project/cancelDelete", projectCancelDelete)
+	api.handle(ProjectGroup, "/project/setMetadataSchema", projectSetMetadataSchema)
+	api.handleRead(ProjectGroup, "/project/getMetadataSchema", projectGetMetadataSchema)
 	//treeNode
-	mux.HandleFunc("/api/v1/treeNode/createFolder", handlerWrapper(coreApi, getSession, treeNodeCreateFolder, log))
-	mux.HandleFunc("/api/v1/treeNode/createDocument", handlerWrapper(coreApi, getSession, treeNodeCreateDocument, log))
-	mux.HandleFunc("/api/v1/treeNode/createProjectSpace", handlerWrapper(coreApi, getSession, treeNodeCreateProjectSpace, log))
-	mux.HandleFunc("/api/v1/treeNode/setName", handlerWrapper(coreApi, getSession, treeNodeSetName, log))
-	mux.HandleFunc("/api/v1/treeNode/move", handlerWrapper(coreApi, getSession, treeNodeMove, log))
-	mux.HandleFunc("/api/v1/treeNode/get", handlerWrapper(coreApi, getSession, treeNodeGet, log))
-	mux.HandleFunc("/api/v1/treeNode/getChildren", handlerWrapper(coreApi, getSession, treeNodeGetChildren, log))
-	mux.HandleFunc("/api/v1/treeNode/getParents", handlerWrapper(coreApi, getSession, treeNodeGetParents, log))
-	mux.HandleFunc("/api/v1/treeNode/globalSearch", handlerWrapper(coreApi, getSession, treeNodeGlobalSearch, log))
-	mux.HandleFunc("/api/v1/treeNode/projectSearch", handlerWrapper(coreApi, getSession, treeNodeProjectSearch, log))
+	api.handle(TreeNodeGroup, "/treeNode/createFolder", treeNodeCreateFolder)
+	api.handle(TreeNodeGroup, "/treeNode/createDocument", treeNodeCreateDocument)
+	api.handle(TreeNodeGroup, "/treeNode/createProjectSpace", treeNodeCreateProjectSpace)
+	api.handle(TreeNodeGroup, "/treeNode/setName", treeNodeSetName)
+	api.handle(TreeNodeGroup, "/treeNode/move", treeNodeMove)
+	api.handle(TreeNodeGroup, "/treeNode/setMetadata", treeNodeSetMetadata)
+	api.handle(TreeNodeGroup, "/treeNode/lock", treeNodeLock)
+	api.handle(TreeNodeGroup, "/treeNode/unlock", treeNodeUnlock)
+	api.handleRead(TreeNodeGroup, "/treeNode/getLocks", treeNodeGetLocks)
+	api.handleRead(TreeNodeGroup, "/treeNode/get", treeNodeGet)
+	api.handleRead(TreeNodeGroup, "/treeNode/getChildren", treeNodeGetChildren)
+	api.handleRead(TreeNodeGroup, "/treeNode/getParents", treeNodeGetParents)
+	api.handleRead(TreeNodeGroup, "/treeNode/globalSearch", treeNodeGlobalSearch)
+	api.handleRead(TreeNodeGroup, "/treeNode/projectSearch", treeNodeProjectSearch)
+	api.handle(TreeNodeGroup, "/treeNode/trash", treeNodeTrash)
+	api.handleRead(TreeNodeGroup, "/treeNode/getTrash", treeNodeGetTrash)
+	api.handle(TreeNodeGroup, "/treeNode/restore", treeNodeRestore)
+	api.handle(TreeNodeGroup, "/treeNode/purge", treeNodePurge)
 	//documentVersion
-	mux.HandleFunc("/api/v1/documentVersion/create", handlerWrapper(coreApi, getSession, documentVersionCreate, log))
-	mux.HandleFunc("/api/v1/documentVersion/get", handlerWrapper(coreApi, getSession, documentVersionGet, log))
-	mux.HandleFunc("/api/v1/documentVersion/getForDocument", handlerWrapper(coreApi, getSession, documentVersionGetForDocument, log))
-	mux.HandleFunc("/api/v1/documentVersion/getSeedFile/", handlerWrapper(coreApi, getSession, documentVersionGetSeedFile, log))
-	mux.HandleFunc("/api/v1/documentVersion/getThumbnail/", getThumbnailWrapper(coreApi.DocumentVersion().GetThumbnail, getSession, log))
+	api.handle(DocumentVersionGroup, "/documentVersion/create", documentVersionCreate)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/get", documentVersionGet)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/getForDocument", documentVersionGetForDocument)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/getForProject", documentVersionGetForProject)
+	api.handle(DocumentVersionGroup, "/documentVersion/restore", documentVersionRestore)
+	api.handle(DocumentVersionGroup, "/documentVersion/addLabels", documentVersionAddLabels)
+	api.handle(DocumentVersionGroup, "/documentVersion/removeLabels", documentVersionRemoveLabels)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/getTranslationProgress", documentVersionGetTranslationProgress)
+	api.handle(DocumentVersionGroup, "/documentVersion/retryTranslation", documentVersionRetryTranslation)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/diff", documentVersionDiff)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/diffElements", documentVersionDiffElements)
+	api.handleRead(DocumentVersionGroup, "/documentVersion/getSeedFile/", documentVersionGetSeedFile(api.path("/documentVersion/getSeedFile/")))
+	api.handleRead(DocumentVersionGroup, "/documentVersion/getThumbnail/", getThumbnailHandler(coreApi.DocumentVersion().GetThumbnail))
 	//projectSpaceVersion
-	mux.HandleFunc("/api/v1/projectSpaceVersion/create", handlerWrapper(coreApi, getSession, projectSpaceVersionCreate, log))
-	mux.HandleFunc("/api/v1/projectSpaceVersion/get", handlerWrapper(coreApi, getSession, projectSpaceVersionGet, log))
-	mux.HandleFunc("/api/v1/projectSpaceVersion/getForProjectSpace", handlerWrapper(coreApi, getSession, projectSpaceVersionGetForProjectSpace, log))
-	mux.HandleFunc("/api/v1/projectSpaceVersion/getThumbnail/", getThumbnailWrapper(coreApi.ProjectSpaceVersion().GetThumbnail, getSession, log))
+	api.handle(ProjectSpaceVersionGroup, "/projectSpaceVersion/create", projectSpaceVersionCreate)
+	api.handleRead(ProjectSpaceVersionGroup, "/projectSpaceVersion/get", projectSpaceVersionGet)
+	api.handleRead(ProjectSpaceVersionGroup, "/projectSpaceVersion/getForProjectSpace", projectSpaceVersionGetForProjectSpace)
+	api.handleRead(ProjectSpaceVersionGroup, "/projectSpaceVersion/getThumbnail/", getThumbnailHandler(coreApi.ProjectSpaceVersion().GetThumbnail))
+	api.handle(ProjectSpaceVersionGroup, "/projectSpaceVersion/previewBcf", projectSpaceVersionPreviewBcf)
+	api.handleRead(ProjectSpaceVersionGroup, "/projectSpaceVersion/diff", projectSpaceVersionDiff)
 	//sheet
-	mux.HandleFunc("/api/v1/sheet/setName", handlerWrapper(coreApi, getSession, sheetSetName, log))
-	mux.HandleFunc(sheetGetItemPath, handlerWrapper(coreApi, getSession, sheetGetItem(vada), log))
-	mux.HandleFunc("/api/v1/sheet/get", handlerWrapper(coreApi, getSession, sheetGet, log))
-	mux.HandleFunc("/api/v1/sheet/getForDocumentVersion", handlerWrapper(coreApi, getSession, sheetGetForDocumentVersion, log))
-	mux.HandleFunc("/api/v1/sheet/globalSearch", handlerWrapper(coreApi, getSession, sheetGlobalSearch, log))
-	mux.HandleFunc("/api/v1/sheet/projectSearch", handlerWrapper(coreApi, getSession, sheetProjectSearch, log))
+	api.handle(SheetGroup, "/sheet/setName", sheetSetName)
+	api.handleRead(SheetGroup, "/sheet/getItem/", sheetGetItem(vada, api.path("/sheet/getItem/")))
+	api.handleRead(SheetGroup, "/sheet/get", sheetGet)
+	api.handleRead(SheetGroup, "/sheet/getForDocumentVersion", sheetGetForDocumentVersion)
+	api.handleRead(SheetGroup, "/sheet/globalSearch", sheetGlobalSearch)
+	api.handleRead(SheetGroup, "/sheet/projectSearch", sheetProjectSearch)
+	api.handleRead(SheetGroup, "/sheet/getProperties", sheetGetProperties(propertyDbs))
+	api.handleRead(SheetGroup, "/sheet/searchProperties", sheetSearchProperties(propertyDbs))
+	api.handleRead(SheetGroup, "/sheet/getCategories", sheetGetCategories(propertyDbs))
 	//sheetTransform
-	mux.HandleFunc("/api/v1/sheetTransform/get", handlerWrapper(coreApi, getSession, sheetTransformGet, log))
-	mux.HandleFunc("/api/v1/sheetTransform/getForProjectSpaceVersion", handlerWrapper(coreApi, getSession, sheetTransformGetForProjectSpaceVersion, log))
+	api.handleRead(SheetTransformGroup, "/sheetTransform/get", sheetTransformGet)
+	api.handleRead(SheetTransformGroup, "/sheetTransform/getForProjectSpaceVersion", sheetTransformGetForProjectSpaceVersion)
 	//clashTest
-	mux.HandleFunc("/api/v1/clashTest/getForSheetTransforms", handlerWrapper(coreApi, getSession, clashTestGetForSheetTransforms, log))
+	api.handle(ClashTestGroup, "/clashTest/start", clashTestStart)
+	api.handleRead(ClashTestGroup, "/clashTest/get", clashTestGet)
+	api.handleRead(ClashTestGroup, "/clashTest/getForSheetTransforms", clashTestGetForSheetTransforms)
+	api.handleRead(ClashTestGroup, "/clashTest/getClashes", clashTestGetClashes)
+	api.handleRead(ClashTestGroup, "/clashTest/getClashGroups", clashTestGetClashGroups)
+	api.handle(ClashTestGroup, "/clashTest/setClashStatus", clashTestSetClashStatus)
+	api.handle(ClashTestGroup, "/clashTest/setClashAssignee", clashTestSetClashAssignee)
+	api.handle(ClashTestGroup, "/clashTest/addClashComment", clashTestAddClashComment)
+	api.handleRead(ClashTestGroup, "/clashTest/getClashComments", clashTestGetClashComments)
+	api.handleRead(ClashTestGroup, "/clashTest/exportBcf", clashTestExportBcf)
+	//issue
+	api.handle(IssueGroup, "/issue/create", issueCreate)
+	api.handle(IssueGroup, "/issue/update", issueUpdate)
+	api.handle(IssueGroup, "/issue/delete", issueDelete)
+	api.handleRead(IssueGroup, "/issue/get", issueGet)
+	api.handleRead(IssueGroup, "/issue/getForProject", issueGetForProject)
+	api.handleRead(IssueGroup, "/issue/projectSearch", issueProjectSearch)
+	api.handle(IssueGroup, "/issue/addComment", issueAddComment)
+	api.handleRead(IssueGroup, "/issue/getComments", issueGetComments)
+	api.handle(IssueGroup, "/issue/addAttachment", issueAddAttachment)
+	api.handleRead(IssueGroup, "/issue/getAttachments", issueGetAttachments)
+	api.handleRead(IssueGroup, "/issue/getAttachment/", issueGetAttachment(api.path("/issue/getAttachment/")))
+	api.handleRead(IssueGroup, "/issue/exportBcf", issueExportBcf)
+	api.handle(IssueGroup, "/issue/importBcf", issueImportBcf)
+	//viewpoint
+	api.handle(ViewpointGroup, "/viewpoint/create", viewpointCreate)
+	api.handle(ViewpointGroup, "/viewpoint/update", viewpointUpdate)
+	api.handle(ViewpointGroup, "/viewpoint/setThumbnail", viewpointSetThumbnail)
+	api.handle(ViewpointGroup, "/viewpoint/delete", viewpointDelete)
+	api.handleRead(ViewpointGroup, "/viewpoint/get", viewpointGet)
+	api.handleRead(ViewpointGroup, "/viewpoint/getForSheet", viewpointGetForSheet)
+	api.handleRead(ViewpointGroup, "/viewpoint/getForProjectSpaceVersion", viewpointGetForProjectSpaceVersion)
+	api.handleRead(ViewpointGroup, "/viewpoint/getThumbnail/", getThumbnailHandler(coreApi.Viewpoint().GetThumbnail))
+	api.handleRead(ViewpointGroup, "/viewpoint/open/", viewpointOpen(api.path("/viewpoint/open/")))
+	//event
+	api.handleRead(EventGroup, "/event/stream", eventStream)
+	//room
+	api.handleRead(RoomGroup, "/room/join", roomJoin)
 	//helpers
-	mux.HandleFunc("/api/v1/helper/getChildrenDocumentsWithLatestVersionAndFirstSheetInfo", handlerWrapper(coreApi, getSession, helperGetChildrenDocumentsWithLatestVersionAndFirstSheetInfo, log))
-	mux.HandleFunc("/api/v1/helper/getDocumentVersionsWithFirstSheetInfo", handlerWrapper(coreApi, getSession, helperGetDocumentVersionsWithFirstSheetInfo, log))
-	mux.HandleFunc("/api/v1/helper/getChildrenProjectSpacesWithLatestVersion", handlerWrapper(coreApi, getSession, helperGetChildrenProjectSpacesWithLatestVersion, log))
+	api.handleRead(HelperGroup, "/helper/getChildrenDocumentsWithLatestVersionAndFirstSheetInfo", helperGetChildrenDocumentsWithLatestVersionAndFirstSheetInfo)
+	api.handleRead(HelperGroup, "/helper/getDocumentVersionsWithFirstSheetInfo", helperGetDocumentVersionsWithFirstSheetInfo)
+	api.handleRead(HelperGroup, "/helper/getChildrenProjectSpacesWithLatestVersion", helperGetChildrenProjectSpacesWithLatestVersion)
 
-	return mux
+	return chain(api.mux, api.opts.middleware)
 }
 
 //START Util
 
-func handlerWrapper(coreApi core.CoreApi, getSession session.SessionGetter, handler handler, log golog.Log) http.HandlerFunc {
+type restApi struct {
+	coreApi    core.CoreApi
+	getSession session.SessionGetter
+	log        golog.Log
+	opts       *options
+	mux        *http.ServeMux
+}
+
+func newRestApi(coreApi core.CoreApi, getSession session.SessionGetter, log golog.Log, opts *options) *restApi {
+	opts.watcher = newStatusWatcher(coreApi, opts, log)
+	return &restApi{
+		coreApi:    coreApi,
+		getSession: getSession,
+		log:        log,
+		opts:       opts,
+		mux:        http.NewServeMux(),
+	}
+}
+
+func (api *restApi) path(path string) string {
+	return api.opts.prefix + path
+}
+
+// handle registers an endpoint that changes state, it can't be called with GET.
+func (api *restApi) handle(group Group, path string, handler handler) {
+	if !api.opts.disabled[group] {
+		api.mux.Handle(api.path(path), chain(api.handlerWrapper(handler, false), api.opts.groupMiddleware[group]))
+	}
+}
+
+// handleRead registers a read only endpoint, it can be called with a POST json
+// body or with GET and query string args, GET responses are cacheable.
+func (api *restApi) handleRead(group Group, path string, handler handler) {
+	if !api.opts.disabled[group] {
+		api.mux.Handle(api.path(path), chain(api.handlerWrapper(handler, true), api.opts.groupMiddleware[group]))
+	}
+}
+
+func (api *restApi) handlerWrapper(handler handler, read bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !read && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, newHttpError(http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed on "+r.URL.Path)), api.log)
+			return
+		}
 		if r != nil && r.Body != nil {
 			defer r.Body.Close()
+			if api.opts.limits.MaxBodyBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, api.opts.limits.MaxBodyBytes)
+			}
 		}
-		if session, err := getSession(w, r); err != nil {
-			writeError(w, err, log)
+		r = withOptions(r, api.opts)
+		w = &responseWriter{ResponseWriter: w, req: r, opts: api.opts}
+		if session, err := api.getSession(w, r); err != nil {
+			writeError(w, err, api.log)
 		} else if session == nil {
-			writeError(w, errors.New("no session found"), log)
+			writeError(w, errors.New("no session found"), api.log)
 		} else if forUser, err := session.User(); err != nil {
-			writeError(w, err, log)
+			writeError(w, err, api.log)
 		} else if forUser == "" {
-			writeError(w, errors.New("no valid user id in session"), log)
-		} else if err := handler(coreApi, forUser, session, w, r, log); err != nil {
-			writeError(w, err, log)
+			writeError(w, errors.New("no valid user id in session"), api.log)
+		} else if err := handler(api.coreApi, forUser, session, w, r, api.log); err != nil {
+			writeError(w, err, api.log)
 		}
 	}
 }
 
-func getThumbnailWrapper(getThumbnail getThumbnail, getSession session.SessionGetter, log golog.Log) http.HandlerFunc {
-	return handlerWrapper(nil, getSession, func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func getThumbnailHandler(getThumbnail getThumbnail) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 		pathSegments := strings.Split(r.URL.Path, "/")
 		id := pathSegments[len(pathSegments)-3]
 		mimeType := pathSegments[len(pathSegments)-2]
 		mimeSubtype := pathSegments[len(pathSegments)-1]
-		var res *http.Response
-		var err error
-		if res, err = getThumbnail(forUser, id); res != nil && res.Body != nil {
+		res, err := getThumbnail(forUser, id)
+		if res != nil && res.Body != nil {
 			defer res.Body.Close()
 		}
+		if err != nil {
+			return err
+		}
 		w.Header().Set("Content-Type", mimeType+"/"+mimeSubtype)
 		if res.ContentLength >= 0 {
 			w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
 		}
-		if err != nil {
-			return err
-		} else if _, err := io.Copy(w, res.Body); err != nil {
+		if _, err := io.Copy(w, res.Body); err != nil {
 			return err
 		} else {
 			return nil
 		}
-	}, log)
+	}
 }
 
 type handler func(core.CoreApi, string, session.Session, http.ResponseWriter, *http.Request, golog.Log) error
 type getThumbnail func(forUser string, id string) (*http.Response, error)
 
+// writeJson writes src with the codec negotiated from the request's Accept
+// header, JSON unless the client asked for another registered codec.
 func writeJson(w http.ResponseWriter, src interface{}, log golog.Log) {
-	if b, err := json.Marshal(src); err != nil {
+	codec := responseCodec(w)
+	buf := &bytes.Buffer{}
+	if err := codec.Encode(buf, src); err != nil {
 		writeError(w, err, log)
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(b)
+		w.Header().Set("Content-Type", codec.MediaType())
+		w.Header().Add("Vary", "Accept")
+		if notModified := setCacheHeaders(w, buf.Bytes()); notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(buf.Bytes())
+	}
+}
+
+// writeOffsetJson writes a page of an endpoint core can only page by offset.
+func writeOffsetJson(w http.ResponseWriter, page *pageArgs, shape shaper, fetch pageFetcher, log golog.Log) error {
+	if err := page.offsetOnly(); err != nil {
+		return err
+	} else if wantsNdjson(w) {
+		return streamNdjson(w, page, shape, offsetChunks(fetch, page.Offset), log)
+	}
+	if rw, ok := w.(*responseWriter); ok {
+		page.capLimit(rw.opts.limits.MaxPageLimit)
+	}
+	if res, total, err := fetch(page.Offset, page.Limit); err != nil {
+		return err
+	} else {
+		return writePage(w, offsetPage(res, total), shape, log)
+	}
+}
+
+// writeKeysetJson writes a page of an endpoint backed by a core keyset query,
+// which also accepts cursors and skipTotal. sortBy is the order the page is in.
+func writeKeysetJson(w http.ResponseWriter, page *pageArgs, sortBy string, shape shaper, fetch keysetFetcher, log golog.Log) error {
+	if wantsNdjson(w) {
+		if page.Before != "" {
+			return newHttpError(http.StatusBadRequest, errors.New("before cursors are not supported when streaming"))
+		} else if query, err := page.query(sortBy); err != nil {
+			return err
+		} else {
+			return streamNdjson(w, page, shape, keysetChunks(fetch, query), log)
+		}
+	}
+	if rw, ok := w.(*responseWriter); ok {
+		page.capLimit(rw.opts.limits.MaxPageLimit)
+	}
+	if query, err := page.query(sortBy); err != nil {
+		return err
+	} else if res, info, err := fetch(query); err != nil {
+		return err
+	} else {
+		return writePage(w, keysetPage(res, info, sortBy), shape, log)
 	}
 }
 
-func writeOffsetJson(w http.ResponseWriter, res interface{}, totalResults int, log golog.Log) {
-	if res == nil {
-		res = []interface{}{}
+func writePage(w http.ResponseWriter, page *offsetResult, shape shaper, log golog.Log) error {
+	if shape != nil {
+		var err error
+		if page.Results, err = shape(page.Results); err != nil {
+			return err
+		}
 	}
-	writeJson(w, &struct {
-		TotalResults int         `json:"totalResults"`
-		Results      interface{} `json:"results"`
-	}{
-		TotalResults: totalResults,
-		Results:      res,
-	}, log)
+	writeJson(w, page, log)
+	return nil
 }
 
+// readJson decodes the request body into dst with the codec matching its
+// Content-Type, for GET requests dst is filled from the query string instead.
 func readJson(r *http.Request, dst interface{}) error {
+	if r != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return decodeQuery(r.URL.Query(), dst)
+	}
 	if r != nil && r.Body != nil {
-		decoder := json.NewDecoder(r.Body)
-		return decoder.Decode(dst)
+		if err := requestCodec(r).Decode(r.Body, dst); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// httpError lets handlers respond with a status other than 500.
+type httpError struct {
+	status int
+	err    error
+}
+
+func newHttpError(status int, err error) error {
+	return &httpError{status: status, err: err}
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
 func writeError(w http.ResponseWriter, err error, log golog.Log) {
 	le := log.Error("RestApi error: %v", err)
-	w.WriteHeader(500)
+	status := http.StatusInternalServerError
+	if he, ok := err.(*httpError); ok {
+		status = he.status
+	} else if isBodyTooLarge(err) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	w.WriteHeader(status)
 	w.Write([]byte(le.LogId))
 }
 
+// isBodyTooLarge reports whether err came from reading past Limits.MaxBodyBytes,
+// the codecs and multipart reader wrap the http.MaxBytesReader error in their
+// own so only its message survives.
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
+
+const (
+	clashTestPollInterval = 2 * time.Second
+	maxClashTestWait      = 60 * time.Second
+)
+
+// awaitClashTests polls core until none of the clash tests identified by ids
+// are pending or running, wait elapses by the api's clock, the client goes away
+// or the api's context is done, whichever comes first, returning their latest
+// state.
+func awaitClashTests(coreApi core.CoreApi, forUser string, ids []string, wait time.Duration, r *http.Request) ([]*clashtest.ClashTest, error) {
+	opts := optionsFrom(r)
+	if wait > maxClashTestWait {
+		wait = maxClashTestWait
+	}
+	deadline := opts.clock().Add(wait)
+	for {
+		res, err := coreApi.ClashTest().Get(forUser, ids)
+		remaining := deadline.Sub(opts.clock())
+		if err != nil || remaining <= 0 || clashTestsFinished(res) {
+			return res, err
+		} else if remaining > clashTestPollInterval {
+			remaining = clashTestPollInterval
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return res, nil
+		case <-opts.ctx.Done():
+			timer.Stop()
+			return res, nil
+		case <-timer.C:
+		}
+	}
+}
+
+func clashTestsFinished(tests []*clashtest.ClashTest) bool {
+	for _, test := range tests {
+		if test.Status == clashtest.Pending || test.Status == clashtest.Running {
+			return false
+		}
+	}
+	return true
+}
+
+func parseClashStatus(status string) (clashtest.ClashStatus, error) {
+	switch s := clashtest.ClashStatus(status); s {
+	case clashtest.New, clashtest.Active, clashtest.Reviewed, clashtest.Approved, clashtest.Resolved:
+		return s, nil
+	default:
+		return "", newHttpError(http.StatusBadRequest, fmt.Errorf("invalid clash status %q", status))
+	}
+}
+
+// clashFilterArgs are embedded in the args of endpoints listing clashes,
+// unset fields don't filter.
+type clashFilterArgs struct {
+	MinDistance *float64 `json:"minDistance"`
+	MaxDistance *float64 `json:"maxDistance"`
+	Categories  []string `json:"categories"`
+	Statuses    []string `json:"statuses"`
+	Assignee    string   `json:"assignee"`
+}
+
+func (a *clashFilterArgs) filter() (*clashtest.ClashFilter, error) {
+	filter := &clashtest.ClashFilter{
+		MinDistance: a.MinDistance,
+		MaxDistance: a.MaxDistance,
+		Categories:  a.Categories,
+		Assignee:    a.Assignee,
+	}
+	for _, status := range a.Statuses {
+		if s, err := parseClashStatus(status); err != nil {
+			return nil, err
+		} else {
+			filter.Statuses = append(filter.Statuses, s)
+		}
+	}
+	return filter, nil
+}
+
+// writeBcfZip buffers the BCF zip so failures can still be reported with an
+// error status.
+func writeBcfZip(w http.ResponseWriter, topics []*bcfTopic, name string) error {
+	buf := &bytes.Buffer{}
+	if err := writeBcf(buf, topics); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", bcfMediaType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".bcfzip"}))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// fetchAll calls fetch a chunk at a time until every result has been fetched,
+// fetch returns how many results it got and the total.
+func fetchAll(fetch func(offset int, limit int) (int, int, error)) error {
+	for offset, total := 0, 1; offset < total; {
+		n, t, err := fetch(offset, defaultStreamChunkSize)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			return nil
+		}
+		offset, total = offset+n, t
+	}
+	return nil
+}
+
+func parseIssueStatus(status string) (issue.Status, error) {
+	switch s := issue.Status(status); s {
+	case issue.Open, issue.InProgress, issue.Resolved, issue.Closed:
+		return s, nil
+	default:
+		return "", newHttpError(http.StatusBadRequest, fmt.Errorf("invalid issue status %q", status))
+	}
+}
+
+// checkDueDate rejects due dates in a form BCF can't carry, as dates are checked
+// when importing BCF, empty clears the due date.
+func checkDueDate(dueDate string) error {
+	if dueDate != "" && !isBcfDate(dueDate) {
+		return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid dueDate %q, use an RFC 3339 date or date time", dueDate))
+	}
+	return nil
+}
+
+// checkCamera rejects cameras that aren't viewer camera json objects, which is
+// what viewpoints and issues are exported to BCF from.
+func checkCamera(camera *sj.Json) error {
+	if camera == nil {
+		return nil
+	}
+	b, err := json.Marshal(camera)
+	if err == nil && !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		err = errors.New("not an object")
+	} else if err == nil {
+		err = json.Unmarshal(b, &viewerCamera{})
+	}
+	if err != nil {
+		return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid camera: %v", err))
+	}
+	return nil
+}
+
+// issueFilterArgs are embedded in the args of endpoints listing issues, unset
+// fields don't filter.
+type issueFilterArgs struct {
+	Statuses            []string `json:"statuses"`
+	Assignee            string   `json:"assignee"`
+	Sheet               string   `json:"sheet"`
+	ProjectSpaceVersion string   `json:"projectSpaceVersion"`
+	DueBefore           string   `json:"dueBefore"`
+}
+
+func (a *issueFilterArgs) filter() (*issue.Filter, error) {
+	filter := &issue.Filter{
+		Assignee:            a.Assignee,
+		Sheet:               a.Sheet,
+		ProjectSpaceVersion: a.ProjectSpaceVersion,
+		DueBefore:           a.DueBefore,
+	}
+	for _, status := range a.Statuses {
+		if s, err := parseIssueStatus(status); err != nil {
+			return nil, err
+		} else {
+			filter.Statuses = append(filter.Statuses, s)
+		}
+	}
+	return filter, nil
+}
+
+var recentKinds = map[user.ItemKind]bool{user.Sheet: true, user.Document: true, user.ProjectSpace: true}
+var favoriteKinds = map[user.ItemKind]bool{user.Folder: true, user.Document: true, user.ProjectSpace: true, user.Project: true}
+
+func parseItemKinds(kinds []string, valid map[user.ItemKind]bool) ([]user.ItemKind, error) {
+	parsed := make([]user.ItemKind, 0, len(kinds))
+	for _, kind := range kinds {
+		if !valid[user.ItemKind(kind)] {
+			return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("invalid kind %q", kind))
+		}
+		parsed = append(parsed, user.ItemKind(kind))
+	}
+	return parsed, nil
+}
+
+// recordAccess adds an item to the user's recently viewed list, failures are
+// only logged so they don't stop the item being served. Items are recorded at
+// most once per accessThrottleInterval per user as viewing one, a sheet say,
+// takes many requests.
+func recordAccess(coreApi core.CoreApi, forUser string, kind user.ItemKind, id string, r *http.Request, log golog.Log) {
+	opts := optionsFrom(r)
+	now := opts.clock().UTC()
+	if !opts.recentAccess.due(forUser+"/"+string(kind)+"/"+id, now) {
+		return
+	}
+	if err := coreApi.User().RecordAccess(forUser, kind, id, now); err != nil {
+		log.Warning("RestApi failed to record access to %s %s: %v", kind, id, err)
+	}
+}
+
+const (
+	accessThrottleInterval = time.Minute
+	maxAccessThrottleKeys  = 10000
+)
+
+// accessThrottle remembers when each user last had each item recorded.
+type accessThrottle struct {
+	mtx  sync.Mutex
+	last map[string]time.Time
+}
+
+func newAccessThrottle() *accessThrottle {
+	return &accessThrottle{last: map[string]time.Time{}}
+}
+
+func (t *accessThrottle) due(key string, now time.Time) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if last, exists := t.last[key]; exists && now.Sub(last) < accessThrottleInterval {
+		return false
+	}
+	if len(t.last) >= maxAccessThrottleKeys {
+		for k, last := range t.last {
+			if now.Sub(last) >= accessThrottleInterval {
+				delete(t.last, k)
+			}
+		}
+		if len(t.last) >= maxAccessThrottleKeys {
+			t.last = map[string]time.Time{}
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+func parseDocumentVersionStatuses(statuses []string) ([]documentversion.Status, error) {
+	parsed := make([]documentversion.Status, 0, len(statuses))
+	for _, status := range statuses {
+		switch s := documentversion.Status(status); s {
+		case documentversion.WontRegister, documentversion.FailedToRegister, documentversion.Registered, documentversion.Pending, documentversion.InProgress, documentversion.Success, documentversion.Failed:
+			parsed = append(parsed, s)
+		default:
+			return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("invalid document version status %q", status))
+		}
+	}
+	return parsed, nil
+}
+
+const maxLabelLength = 64
+
+// parseLabels trims labels and drops duplicates, labels are matched exactly
+// so "Tender" and "Tender " would otherwise be different milestones.
+func parseLabels(labels []string) ([]string, error) {
+	parsed := make([]string, 0, len(labels))
+	seen := map[string]bool{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return nil, newHttpError(http.StatusBadRequest, errors.New("labels may not be empty"))
+		} else if utf8.RuneCountInString(label) > maxLabelLength {
+			return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("label %q is longer than %d characters", label, maxLabelLength))
+		} else if !seen[label] {
+			seen[label] = true
+			parsed = append(parsed, label)
+		}
+	}
+	return parsed, nil
+}
+
+func getAllSheets(coreApi core.CoreApi, forUser string, documentVersion string) ([]*sheet.Sheet, error) {
+	sheets := []*sheet.Sheet{}
+	err := fetchAll(func(offset int, limit int) (int, int, error) {
+		res, total, err := coreApi.Sheet().GetForDocumentVersion(forUser, documentVersion, offset, limit, "")
+		sheets = append(sheets, res...)
+		return len(res), total, err
+	})
+	return sheets, err
+}
+
+func getAllSheetTransforms(coreApi core.CoreApi, forUser string, projectSpaceVersion string) ([]*sheettransform.SheetTransform, error) {
+	sheetTransforms := []*sheettransform.SheetTransform{}
+	err := fetchAll(func(offset int, limit int) (int, int, error) {
+		res, total, err := coreApi.SheetTransform().GetForProjectSpaceVersion(forUser, projectSpaceVersion, offset, limit, "")
+		sheetTransforms = append(sheetTransforms, res...)
+		return len(res), total, err
+	})
+	return sheetTransforms, err
+}
+
 //END Util
 
 //START Handlers
@@ -208,11 +712,14 @@ func userSetProperty(coreApi core.CoreApi, forUser string, session session.Sessi
 func userGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Ids []string `json:"ids"`
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
 	} else if res, err := coreApi.User().Get(args.Ids); err != nil {
 		return err
+	} else if res, err := args.shape(coreApi, forUser, "user", res); err != nil {
+		return err
 	} else {
 		writeJson(w, res, log)
 		return nil
@@ -223,16 +730,95 @@ func userSearch(coreApi core.CoreApi, forUser string, session session.Session, w
 	args := &struct {
 		Search string `json:"search"`
 		Role   string `json:"role"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
 		SortBy string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "user"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			return coreApi.User().SearchPage(args.Search, query, user.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func userGetRecent(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Kinds []string `json:"kinds"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if kinds, err := parseItemKinds(args.Kinds, recentKinds); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.User().GetRecent(forUser, kinds, offset, limit)
+		}, log)
+	}
+}
+
+func userAddRecent(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Kind string `json:"kind"`
+		Id   string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if kinds, err := parseItemKinds([]string{args.Kind}, recentKinds); err != nil {
+		return err
+	} else if err := coreApi.User().RecordAccess(forUser, kinds[0], args.Id, optionsFrom(r).clock().UTC()); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func userGetFavorites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Kinds []string `json:"kinds"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if kinds, err := parseItemKinds(args.Kinds, favoriteKinds); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.User().GetFavorites(forUser, kinds, offset, limit)
+		}, log)
+	}
+}
+
+func userAddFavorites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Kind string   `json:"kind"`
+		Ids  []string `json:"ids"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if kinds, err := parseItemKinds([]string{args.Kind}, favoriteKinds); err != nil {
+		return err
+	} else if err := coreApi.User().AddFavorites(forUser, kinds[0], args.Ids); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func userRemoveFavorites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Kind string   `json:"kind"`
+		Ids  []string `json:"ids"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.User().Search(args.Search, args.Offset, args.Limit, user.SortBy(args.SortBy)); err != nil {
+	} else if kinds, err := parseItemKinds([]string{args.Kind}, favoriteKinds); err != nil {
+		return err
+	} else if err := coreApi.User().RemoveFavorites(forUser, kinds[0], args.Ids); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
 		return nil
 	}
 }
@@ -293,6 +879,7 @@ func projectAddUsers(coreApi core.CoreApi, forUser string, session session.Sessi
 	} else if err := coreApi.Project().AddUsers(forUser, args.Id, project.Role(args.Role), args.Users); err != nil {
 		return err
 	} else {
+		publishMembershipChange(r, args.Id, "invited", args.Users, args.Role)
 		return nil
 	}
 }
@@ -307,149 +894,415 @@ func projectRemoveUsers(coreApi core.CoreApi, forUser string, session session.Se
 	} else if err := coreApi.Project().RemoveUsers(forUser, args.Id, args.Users); err != nil {
 		return err
 	} else {
+		publishMembershipChange(r, args.Id, "removed", args.Users, "")
 		return nil
 	}
 }
 
-func projectAcceptInvite(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+// memberRoles are the roles a project member can hold, project.Any only
+// filters memberships.
+var memberRoles = map[project.Role]bool{
+	project.Owner:       true,
+	project.Admin:       true,
+	project.Organiser:   true,
+	project.Contributor: true,
+	project.Observer:    true,
+}
+
+// projectSetUserRoles relies on core to refuse demoting the last owner, only
+// core can check and change the roles in one step.
+func projectSetUserRoles(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id string `json:"id"`
+		Id    string   `json:"id"`
+		Role  string   `json:"role"`
+		Users []string `json:"users"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if err := coreApi.Project().AcceptInvite(forUser, args.Id); err != nil {
+	} else if !memberRoles[project.Role(args.Role)] {
+		return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid role %q", args.Role))
+	} else if err := coreApi.Project().SetUserRoles(forUser, args.Id, project.Role(args.Role), args.Users); err != nil {
 		return err
 	} else {
+		publishMembershipChange(r, args.Id, "roleChanged", args.Users, args.Role)
 		return nil
 	}
 }
 
-func projectDeclineInvite(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectTransferOwnership(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id string `json:"id"`
+		Id   string `json:"id"`
+		User string `json:"user"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if err := coreApi.Project().DeclineInvite(forUser, args.Id); err != nil {
+	} else if args.User == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("user is required"))
+	} else if args.User == forUser {
+		return newHttpError(http.StatusBadRequest, errors.New("can not transfer ownership to yourself"))
+	} else if err := coreApi.Project().TransferOwnership(forUser, args.Id, args.User); err != nil {
 		return err
 	} else {
+		publishMembershipChange(r, args.Id, "ownershipTransferred", []string{forUser, args.User}, "")
 		return nil
 	}
 }
 
-func projectGetRole(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+// projectLeave relies on core to refuse the last owner, only core can check and
+// remove the membership in one step.
+func projectLeave(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Id string `json:"id"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.Project().GetRole(forUser, args.Id); err != nil {
+	} else if err := coreApi.Project().Leave(forUser, args.Id); err != nil {
 		return err
 	} else {
-		writeJson(w, res, log)
+		publishMembershipChange(r, args.Id, "left", []string{forUser}, "")
 		return nil
 	}
 }
 
-func projectGetMemberships(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectAcceptInvite(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id     string `json:"id"`
-		Role   string `json:"role"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
-		SortBy string `json:"sortBy"`
+		Id string `json:"id"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Project().GetMemberships(forUser, args.Id, project.Role(args.Role), args.Offset, args.Limit, project.SortBy(args.SortBy)); err != nil {
+	} else if err := coreApi.Project().AcceptInvite(forUser, args.Id); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
+		publishMembershipChange(r, args.Id, "joined", []string{forUser}, "")
 		return nil
 	}
 }
 
-func projectGetMembershipInvites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectDeclineInvite(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id     string `json:"id"`
-		Role   string `json:"role"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
-		SortBy string `json:"sortBy"`
+		Id string `json:"id"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Project().GetMembershipInvites(forUser, args.Id, project.Role(args.Role), args.Offset, args.Limit, project.SortBy(args.SortBy)); err != nil {
+	} else if err := coreApi.Project().DeclineInvite(forUser, args.Id); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
+		publishMembershipChange(r, args.Id, "declined", []string{forUser}, "")
 		return nil
 	}
 }
 
-func projectGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectInviteByEmail(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Ids []string `json:"ids"`
+		Id      string   `json:"id"`
+		Role    string   `json:"role"`
+		Emails  []string `json:"emails"`
+		Message string   `json:"message"`
 	}{}
-	if err := readJson(r, args); err != nil {
+	opts := optionsFrom(r)
+	expires := opts.clock().Add(opts.emailInviteTtl)
+	if opts.mailSender == nil {
+		return newHttpError(http.StatusNotImplemented, errors.New("email invites are not configured"))
+	} else if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.Project().Get(forUser, args.Ids); err != nil {
+	} else if emails, err := parseEmails(args.Emails); err != nil {
+		return newHttpError(http.StatusBadRequest, err)
+	} else if err := checkInviteMessage(args.Message); err != nil {
+		return err
+	} else if projects, err := coreApi.Project().Get(forUser, []string{args.Id}); err != nil {
+		return err
+	} else if len(projects) != 1 {
+		return newHttpError(http.StatusNotFound, errors.New("project not found"))
+	} else if inviters, err := coreApi.User().Get([]string{forUser}); err != nil {
+		return err
+	} else if len(inviters) != 1 {
+		return errors.New("current user not found")
+	} else if invites, err := coreApi.Project().InviteByEmail(forUser, args.Id, project.Role(args.Role), emails, args.Message, expires); err != nil {
 		return err
 	} else {
+		// an invite whose mail failed is revoked so a retry starts afresh and
+		// no unreachable invite is left pending
+		res := make([]*emailInviteResult, 0, len(invites))
+		failed := []string{}
+		for i, invite := range invites {
+			result := &emailInviteResult{Email: invite.Email, Sent: true}
+			if err := opts.mailSender.Send(newInviteMail(opts.emailInviteUrl, signInviteToken(opts.emailInviteKey, invite.Token, expires), invite, projects[0].Name, inviters[0].FullName)); err != nil {
+				result.Sent = false
+				result.Error = log.Error("RestApi failed to send email invite for project %s: %v", args.Id, err).LogId
+				failed = append(failed, invite.Email)
+			} else {
+				result.Invite = toEmailInvites(invites[i : i+1])[0]
+			}
+			res = append(res, result)
+		}
+		if len(failed) > 0 {
+			if err := coreApi.Project().RevokeEmailInvites(forUser, args.Id, failed); err != nil {
+				log.Error("RestApi failed to revoke unsent email invites for project %s: %v", args.Id, err)
+			}
+		}
 		writeJson(w, res, log)
 		return nil
 	}
 }
 
-func projectGetInUserContext(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectGetEmailInvites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		User   string `json:"user"`
-		Role   string `json:"role"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
+		Id     string `json:"id"`
 		SortBy string `json:"sortBy"`
+		pageArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Project().GetInUserContext(forUser, args.User, project.Role(args.Role), args.Offset, args.Limit, project.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			res, total, err := coreApi.Project().GetEmailInvites(forUser, args.Id, offset, limit, project.SortBy(args.SortBy))
+			return toEmailInvites(res), total, err
+		}, log)
 	}
 }
 
-func projectGetInUserInviteContext(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectRevokeEmailInvites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		User   string `json:"user"`
+		Id     string   `json:"id"`
+		Emails []string `json:"emails"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.Project().RevokeEmailInvites(forUser, args.Id, args.Emails); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func projectAcceptEmailInvite(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Token string `json:"token"`
+	}{}
+	opts := optionsFrom(r)
+	if opts.mailSender == nil {
+		return newHttpError(http.StatusNotImplemented, errors.New("email invites are not configured"))
+	} else if err := readJson(r, args); err != nil {
+		return err
+	} else if token, err := verifyInviteToken(opts.emailInviteKey, args.Token, opts.clock()); err != nil {
+		return err
+	} else if res, err := coreApi.Project().AcceptEmailInvite(forUser, token); err != nil {
+		return err
+	} else {
+		publishMembershipChange(r, res.Id, "joined", []string{forUser}, "")
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func projectSetMetadataSchema(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id     string            `json:"id"`
+		Fields []*metadata.Field `json:"fields"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := validateMetadataSchema(args.Fields); err != nil {
+		return newHttpError(http.StatusBadRequest, err)
+	} else if err := coreApi.Project().SetMetadataSchema(forUser, args.Id, args.Fields); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func projectGetMetadataSchema(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.Project().GetMetadataSchema(forUser, args.Id); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func projectGetRole(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.Project().GetRole(forUser, args.Id); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func projectGetMemberships(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id     string `json:"id"`
+		Role   string `json:"role"`
+		SortBy string `json:"sortBy"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Project().GetMemberships(forUser, args.Id, project.Role(args.Role), offset, limit, project.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func projectGetMembershipInvites(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id     string `json:"id"`
 		Role   string `json:"role"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
 		SortBy string `json:"sortBy"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Project().GetMembershipInvites(forUser, args.Id, project.Role(args.Role), offset, limit, project.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func projectGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Project().GetInUserInviteContext(forUser, args.User, project.Role(args.Role), args.Offset, args.Limit, project.SortBy(args.SortBy)); err != nil {
+	} else if res, err := coreApi.Project().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "project", res); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
+		writeJson(w, res, log)
 		return nil
 	}
 }
 
-func projectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func projectGetInUserContext(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Search string `json:"search"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
+		User            string `json:"user"`
+		Role            string `json:"role"`
+		IncludeArchived bool   `json:"includeArchived"`
+		SortBy          string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "project"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			return coreApi.Project().GetInUserContextPage(forUser, args.User, project.Role(args.Role), args.IncludeArchived, query, project.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func projectGetInUserInviteContext(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		User   string `json:"user"`
+		Role   string `json:"role"`
 		SortBy string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "project"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Project().GetInUserInviteContext(forUser, args.User, project.Role(args.Role), offset, limit, project.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func projectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Search          string `json:"search"`
+		IncludeArchived bool   `json:"includeArchived"`
+		SortBy          string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "project"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			return coreApi.Project().SearchPage(forUser, args.Search, args.IncludeArchived, query, project.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func projectArchive(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.Project().Archive(forUser, args.Id); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func projectUnarchive(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.Project().Unarchive(forUser, args.Id); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func projectScheduleDelete(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id          string `json:"id"`
+		ConfirmName string `json:"confirmName"`
+	}{}
+	opts := optionsFrom(r)
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.Project().Get(forUser, []string{args.Id}); err != nil {
+		return err
+	} else if len(res) != 1 {
+		return newHttpError(http.StatusNotFound, errors.New("project not found"))
+	} else if res[0].Name != args.ConfirmName {
+		return newHttpError(http.StatusBadRequest, errors.New("confirmName does not match the project name"))
+	} else {
+		deleteAfter := opts.clock().Add(opts.projectDeleteGracePeriod).UTC()
+		if err := coreApi.Project().ScheduleDelete(forUser, args.Id, deleteAfter); err != nil {
+			return err
+		}
+		writeJson(w, &struct {
+			DeleteAfter string `json:"deleteAfter"`
+		}{
+			DeleteAfter: deleteAfter.Format(time.RFC3339),
+		}, log)
+		return nil
+	}
+}
+
+func projectCancelDelete(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Project().Search(forUser, args.Search, args.Offset, args.Limit, project.SortBy(args.SortBy)); err != nil {
+	} else if err := coreApi.Project().CancelDelete(forUser, args.Id); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
 		return nil
 	}
 }
@@ -464,6 +1317,7 @@ func treeNodeCreateFolder(coreApi core.CoreApi, forUser string, session session.
 	} else if res, err := coreApi.TreeNode().CreateFolder(forUser, args.Parent, args.Name); err != nil {
 		return err
 	} else {
+		publishEvent(optionsFrom(r), nodeCreated, res.Project, nil, res)
 		writeJson(w, res, log)
 		return nil
 	}
@@ -493,6 +1347,8 @@ func treeNodeCreateDocument(coreApi core.CoreApi, forUser string, session sessio
 	if res, err := coreApi.TreeNode().CreateDocument(forUser, r.FormValue("parent"), r.FormValue("name"), r.FormValue("uploadComment"), r.FormValue("fileType"), fileName, file, r.FormValue("thumbnailType"), thumbnail); err != nil {
 		return err
 	} else {
+		publishEvent(optionsFrom(r), nodeCreated, res.Project, nil, res)
+		publishFirstVersion(forUser, res.Id, r)
 		writeJson(w, res, log)
 		return nil
 	}
@@ -512,9 +1368,1126 @@ func treeNodeCreateProjectSpace(coreApi core.CoreApi, forUser string, session se
 	sheetTransforms := make([]*sheettransform.SheetTransform, 0, 100)
 	if err := json.Unmarshal([]byte(r.FormValue("sheetTransforms")), &sheetTransforms); err != nil {
 		return err
-	}
-
-	if res, err := coreApi.TreeNode().CreateProjectSpace(forUser, r.FormValue("parent"), r.FormValue("name"), r.FormValue("createComment"), sheetTransforms, camera, r.FormValue("thumbnailType"), thumbnail); err != nil {
+	}
+
+	if res, err := coreApi.TreeNode().CreateProjectSpace(forUser, r.FormValue("parent"), r.FormValue("name"), r.FormValue("createComment"), sheetTransforms, camera, r.FormValue("thumbnailType"), thumbnail); err != nil {
+		return err
+	} else {
+		publishEvent(optionsFrom(r), nodeCreated, res.Project, nil, res)
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func treeNodeSetName(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.TreeNode().SetName(forUser, args.Id, args.Name); err != nil {
+		return err
+	} else {
+		publishNodes(coreApi, forUser, nodeRenamed, []string{args.Id}, r, log)
+		return nil
+	}
+}
+
+func treeNodeMove(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Parent string   `json:"parent"`
+		Ids    []string `json:"ids"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.TreeNode().Move(forUser, args.Parent, args.Ids); err != nil {
+		return err
+	} else {
+		publishNodes(coreApi, forUser, nodeMoved, args.Ids, r, log)
+		return nil
+	}
+}
+
+func treeNodeSetMetadata(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids    []string               `json:"ids"`
+		Values map[string]interface{} `json:"values"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if project, err := nodesProject(coreApi, forUser, args.Ids); err != nil {
+		return err
+	} else if schema, err := coreApi.Project().GetMetadataSchema(forUser, project); err != nil {
+		return err
+	} else if err := validateMetadataValues(schema, args.Values); err != nil {
+		return newHttpError(http.StatusBadRequest, err)
+	} else if err := coreApi.TreeNode().SetMetadata(forUser, args.Ids, args.Values); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func treeNodeLock(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id       string `json:"id"`
+		Reason   string `json:"reason"`
+		Duration int    `json:"duration"`
+	}{}
+	now := optionsFrom(r).clock().UTC()
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if duration, err := lockDuration(args.Duration); err != nil {
+		return err
+	} else if node, _, err := getDocumentLock(coreApi, forUser, args.Id, now); err != nil {
+		return err
+	} else if node.NodeType != treenode.NodeType("document") {
+		return newHttpError(http.StatusBadRequest, errors.New("only documents can be locked"))
+	} else if res, acquired, err := coreApi.TreeNode().TryLock(forUser, args.Id, args.Reason, now, now.Add(duration)); err != nil {
+		return err
+	} else if !acquired {
+		return lockConflict(res)
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func treeNodeUnlock(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id    string `json:"id"`
+		Force bool   `json:"force"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	}
+	var overrideRoles []project.Role
+	if args.Force {
+		overrideRoles = lockOverrideRoles
+	}
+	if lock, released, err := coreApi.TreeNode().TryUnlock(forUser, args.Id, overrideRoles, optionsFrom(r).clock().UTC()); err != nil {
+		return err
+	} else if released {
+		return nil
+	} else if !args.Force {
+		return newHttpError(http.StatusConflict, fmt.Errorf("document is locked by %s, set force to release another user's lock", lock.Owner))
+	} else {
+		return newHttpError(http.StatusForbidden, errors.New("only project owners and admins can release another user's lock"))
+	}
+}
+
+func treeNodeGetLocks(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Project string `json:"project"`
+		SortBy  string `json:"sortBy"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.TreeNode().GetLocks(forUser, args.Project, optionsFrom(r).clock(), offset, limit, treenode.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func treeNodeGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := getTreeNodesAt(coreApi, forUser, args.Ids, optionsFrom(r).clock()); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "treeNode", res); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func treeNodeGetChildren(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id       string   `json:"id"`
+		NodeType string   `json:"nodeType"`
+		Metadata []string `json:"metadata"`
+		SortBy   string   `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if filter, err := parseNodeMetadataFilter(coreApi, forUser, args.Id, args.Metadata); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "treeNode"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			res, info, err := coreApi.TreeNode().GetChildrenPage(forUser, args.Id, treenode.NodeType(args.NodeType), filter, query, treenode.SortBy(args.SortBy))
+			clearExpiredLocks(res, optionsFrom(r).clock())
+			return res, info, err
+		}, log)
+	}
+}
+
+func treeNodeGetParents(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := getParentsAt(coreApi, forUser, args.Id, optionsFrom(r).clock()); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "treeNode", res); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func treeNodeGlobalSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Search   string `json:"search"`
+		NodeType string `json:"nodeType"`
+		SortBy   string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "treeNode"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			res, info, err := coreApi.TreeNode().GlobalSearchPage(forUser, args.Search, treenode.NodeType(args.NodeType), query, treenode.SortBy(args.SortBy))
+			clearExpiredLocks(res, optionsFrom(r).clock())
+			return res, info, err
+		}, log)
+	}
+}
+
+func treeNodeProjectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Project  string   `json:"project"`
+		Search   string   `json:"search"`
+		NodeType string   `json:"nodeType"`
+		Metadata []string `json:"metadata"`
+		SortBy   string   `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if filter, err := parseMetadataFilter(coreApi, forUser, args.Project, args.Metadata); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "treeNode"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			res, info, err := coreApi.TreeNode().ProjectSearchPage(forUser, args.Project, args.Search, treenode.NodeType(args.NodeType), filter, query, treenode.SortBy(args.SortBy))
+			clearExpiredLocks(res, optionsFrom(r).clock())
+			return res, info, err
+		}, log)
+	}
+}
+
+func treeNodeTrash(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.TreeNode().Trash(forUser, args.Ids); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func treeNodeGetTrash(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Project string `json:"project"`
+		SortBy  string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "treeNode"), func(offset int, limit int) (interface{}, int, error) {
+			res, total, err := coreApi.TreeNode().GetTrash(forUser, args.Project, offset, limit, treenode.SortBy(args.SortBy))
+			clearExpiredTrashedLocks(res, optionsFrom(r).clock())
+			return res, total, err
+		}, log)
+	}
+}
+
+func treeNodeRestore(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids    []string `json:"ids"`
+		Parent string   `json:"parent"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.TreeNode().Restore(forUser, args.Ids, args.Parent); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func treeNodePurge(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.TreeNode().Purge(forUser, args.Ids); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func documentVersionCreate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	// a document given in the query string is checked before the upload is read
+	// so a locked document fails fast, core checks the lock again as it creates
+	now := optionsFrom(r).clock().UTC()
+	if document := r.URL.Query().Get("document"); document != "" {
+		if err := checkDocumentLock(coreApi, forUser, document, now); err != nil {
+			return err
+		}
+	}
+
+	file, header, err := r.FormFile("file")
+	if file != nil {
+		defer file.Close()
+	}
+	fileName := ""
+	if header != nil {
+		fileName = header.Filename
+	}
+	if err != nil {
+		return err
+	}
+
+	thumbnail, _, err := r.FormFile("thumbnail")
+	if thumbnail != nil {
+		defer thumbnail.Close()
+	}
+	if err != nil && err != http.ErrMissingFile {
+		return err
+	}
+
+	if res, lock, err := coreApi.DocumentVersion().CreateIfUnlocked(forUser, r.FormValue("document"), r.FormValue("uploadComment"), r.FormValue("fileType"), fileName, file, r.FormValue("thumbnailType"), thumbnail, now); err != nil {
+		return err
+	} else if lock != nil {
+		return lockConflict(lock)
+	} else {
+		publishVersion(forUser, versionUploaded, res, r)
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func documentVersionGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.DocumentVersion().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "documentVersion", res); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func documentVersionGetForDocument(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Document string   `json:"document"`
+		Labels   []string `json:"labels"`
+		SortBy   string   `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if labels, err := parseLabels(args.Labels); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "documentVersion"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			res, info, err := coreApi.DocumentVersion().GetForDocumentPage(forUser, args.Document, labels, query, documentversion.SortBy(args.SortBy))
+			if err == nil && query.Offset == 0 && query.After == nil && query.Before == nil {
+				recordAccess(coreApi, forUser, user.Document, args.Document, r, log)
+			}
+			return res, info, err
+		}, log)
+	}
+}
+
+func documentVersionGetForProject(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Project  string   `json:"project"`
+		Statuses []string `json:"statuses"`
+		SortBy   string   `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if statuses, err := parseDocumentVersionStatuses(args.Statuses); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "documentVersion"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.DocumentVersion().GetForProject(forUser, args.Project, statuses, offset, limit, documentversion.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func documentVersionRestore(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id            string `json:"id"`
+		UploadComment string `json:"uploadComment"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if dvs, err := coreApi.DocumentVersion().Get(forUser, []string{args.Id}); err != nil {
+		return err
+	} else if len(dvs) == 0 {
+		return newHttpError(http.StatusNotFound, errors.New("document version not found"))
+	} else {
+		if args.UploadComment == "" {
+			args.UploadComment = fmt.Sprintf("Restored version %d", dvs[0].Version)
+		}
+		if res, lock, err := coreApi.DocumentVersion().RestoreIfUnlocked(forUser, args.Id, args.UploadComment, optionsFrom(r).clock().UTC()); err != nil {
+			return err
+		} else if lock != nil {
+			return lockConflict(lock)
+		} else {
+			publishVersion(forUser, versionUploaded, res, r)
+			writeJson(w, res, log)
+			return nil
+		}
+	}
+}
+
+func documentVersionAddLabels(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id     string   `json:"id"`
+		Labels []string `json:"labels"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if labels, err := parseLabels(args.Labels); err != nil {
+		return err
+	} else if err := coreApi.DocumentVersion().AddLabels(forUser, args.Id, labels); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func documentVersionRemoveLabels(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id     string   `json:"id"`
+		Labels []string `json:"labels"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if labels, err := parseLabels(args.Labels); err != nil {
+		return err
+	} else if err := coreApi.DocumentVersion().RemoveLabels(forUser, args.Id, labels); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func documentVersionGetTranslationProgress(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.DocumentVersion().GetTranslationProgress(forUser, args.Id); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func documentVersionRetryTranslation(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id string `json:"id"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if dvs, err := coreApi.DocumentVersion().Get(forUser, []string{args.Id}); err != nil {
+		return err
+	} else if len(dvs) == 0 {
+		return newHttpError(http.StatusNotFound, errors.New("document version not found"))
+	} else if status := dvs[0].Status; status != documentversion.Failed && status != documentversion.FailedToRegister {
+		return newHttpError(http.StatusConflict, fmt.Errorf("only failed translations can be retried, status is %q", status))
+	} else if res, err := coreApi.DocumentVersion().RetryTranslation(forUser, args.Id); err != nil {
+		return err
+	} else {
+		publishVersion(forUser, translationStatusChanged, res, r)
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func documentVersionDiff(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if fromDv, toDv, err := getDocumentVersionPair(coreApi, forUser, args.From, args.To); err != nil {
+		return err
+	} else if fromSheets, err := getAllSheets(coreApi, forUser, args.From); err != nil {
+		return err
+	} else if toSheets, err := getAllSheets(coreApi, forUser, args.To); err != nil {
+		return err
+	} else if metadata, err := diffProperties(fromDv, toDv, documentVersionDiffIgnored); err != nil {
+		return err
+	} else if elements, err := coreApi.DocumentVersion().GetElementDiffSummary(forUser, args.From, args.To); err != nil {
+		return err
+	} else {
+		writeJson(w, &documentVersionChanges{
+			From:     args.From,
+			To:       args.To,
+			Sheets:   diffSheets(fromSheets, toSheets),
+			Metadata: metadata,
+			Elements: elements,
+		}, log)
+		return nil
+	}
+}
+
+func documentVersionDiffElements(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Change string `json:"change"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if _, _, err := getDocumentVersionPair(coreApi, forUser, args.From, args.To); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			res, total, available, err := coreApi.DocumentVersion().DiffElements(forUser, args.From, args.To, documentversion.ElementChangeKind(args.Change), offset, limit)
+			if err == nil && !available {
+				err = newHttpError(http.StatusConflict, errors.New("property data is not available for both document versions"))
+			}
+			return res, total, err
+		}, log)
+	}
+}
+
+func documentVersionGetSeedFile(basePath string) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		pathSegments := strings.Split(r.URL.Path[len(basePath):], "/")
+		id := pathSegments[0]
+		if strings.Contains(id, ".") {
+			id = strings.Split(id, ".")[0]
+		}
+		res, err := coreApi.DocumentVersion().GetSeedFile(forUser, id)
+		if res != nil && res.Body != nil {
+			defer res.Body.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if len(pathSegments) == 3 {
+			w.Header().Set("Content-Type", pathSegments[1]+"/"+pathSegments[2])
+		} else {
+			w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		if res.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+		}
+		if _, err := io.Copy(w, res.Body); err != nil {
+			return err
+		} else {
+			return nil
+		}
+	}
+}
+
+func projectSpaceVersionCreate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	thumbnail, _, err := r.FormFile("thumbnail")
+	if thumbnail != nil {
+		defer thumbnail.Close()
+	}
+	if err != nil && err != http.ErrMissingFile {
+		return err
+	}
+
+	camera, _ := sj.FromString(r.FormValue("camera"))
+
+	sheetTransforms := make([]*sheettransform.SheetTransform, 0, 100)
+	if err := json.Unmarshal([]byte(r.FormValue("sheetTransforms")), &sheetTransforms); err != nil {
+		return err
+	}
+
+	if res, err := coreApi.ProjectSpaceVersion().Create(forUser, r.FormValue("projectSpace"), r.FormValue("createComment"), sheetTransforms, camera, r.FormValue("thumbnailType"), thumbnail); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func projectSpaceVersionPreviewBcf(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	file, header, err := r.FormFile("file")
+	if file != nil {
+		defer file.Close()
+	}
+	if err != nil {
+		return newHttpError(http.StatusBadRequest, err)
+	}
+
+	if topics, err := readBcf(file, header.Size); err != nil {
+		return err
+	} else if sheetTransforms, err := coreApi.SheetTransform().GetForElements(forUser, r.FormValue("projectSpaceVersion"), bcfComponents(topics)); err != nil {
+		return err
+	} else {
+		setBcfSheetTransforms(topics, sheetTransforms)
+		writeJson(w, topics, log)
+		return nil
+	}
+}
+
+func projectSpaceVersionDiff(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if args.From == args.To {
+		return newHttpError(http.StatusBadRequest, errors.New("from and to must be different versions"))
+	} else if psvs, err := coreApi.ProjectSpaceVersion().Get(forUser, []string{args.From, args.To}); err != nil {
+		return err
+	} else if len(psvs) != 2 {
+		return newHttpError(http.StatusNotFound, errors.New("project space version not found"))
+	} else if fromPsv, toPsv := projectSpaceVersionPair(psvs, args.From); fromPsv.ProjectSpace != toPsv.ProjectSpace {
+		return newHttpError(http.StatusBadRequest, errors.New("project space versions must be of the same project space"))
+	} else if fromSheetTransforms, err := getAllSheetTransforms(coreApi, forUser, args.From); err != nil {
+		return err
+	} else if toSheetTransforms, err := getAllSheetTransforms(coreApi, forUser, args.To); err != nil {
+		return err
+	} else if sheetTransforms, err := diffSheetTransforms(fromSheetTransforms, toSheetTransforms); err != nil {
+		return err
+	} else if camera, err := diffProperties(fromPsv.Camera, toPsv.Camera, nil); err != nil {
+		return err
+	} else {
+		writeJson(w, &projectSpaceVersionChanges{
+			From:            args.From,
+			To:              args.To,
+			SheetTransforms: sheetTransforms,
+			Camera:          camera,
+		}, log)
+		return nil
+	}
+}
+
+func projectSpaceVersionGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.ProjectSpaceVersion().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "projectSpaceVersion", res); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func projectSpaceVersionGetForProjectSpace(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		ProjectSpace string `json:"projectSpace"`
+		SortBy       string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "projectSpaceVersion"), func(offset int, limit int) (interface{}, int, error) {
+			res, total, err := coreApi.ProjectSpaceVersion().GetForProjectSpace(forUser, args.ProjectSpace, offset, limit, projectspaceversion.SortBy(args.SortBy))
+			if err == nil && offset == 0 {
+				recordAccess(coreApi, forUser, user.ProjectSpace, args.ProjectSpace, r, log)
+			}
+			return res, total, err
+		}, log)
+	}
+}
+
+func sheetSetName(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.Sheet().SetName(forUser, args.Id, args.Name); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func sheetGetItem(vada vada.VadaClient, basePath string) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		id := r.URL.Path[len(basePath):]
+		path := ""
+		if slashIdx := strings.Index(id, "/"); slashIdx == -1 {
+			return errors.New("can't find item path in sheetGetItem call")
+		} else {
+			path = id[slashIdx:]
+			id = id[:slashIdx]
+		}
+		baseUrn := ""
+		var res *http.Response
+		var err error
+		if baseUrn, err = session.GetSheetBaseUrn(id); err != nil {
+			if res, baseUrn, err = coreApi.Sheet().GetItem(forUser, id, path); err == nil {
+				session.SetAccessedSheet(id, baseUrn)
+			}
+		} else {
+			res, err = vada.GetSheetItem(baseUrn + path)
+		}
+		if err == nil {
+			recordAccess(coreApi, forUser, user.Sheet, id, r, log)
+		}
+		if res != nil && res.Body != nil {
+			defer res.Body.Close()
+			if res.Header.Get("Content-Type") != "" {
+				w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+			}
+			if res.Header.Get("Content-Encoding") != "" {
+				w.Header().Set("Content-Encoding", res.Header.Get("Content-Encoding"))
+			} else if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".bin") || strings.HasSuffix(path, ".pack") {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			if res.ContentLength >= 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+			}
+			_, err = io.Copy(w, res.Body)
+		}
+		return err
+	}
+}
+
+func sheetGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.Sheet().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "sheet", res); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func sheetGetForDocumentVersion(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		DocumentVersion string `json:"documentVersion"`
+		SortBy          string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "sheet"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Sheet().GetForDocumentVersion(forUser, args.DocumentVersion, offset, limit, sheet.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func sheetGlobalSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Search string `json:"search"`
+		SortBy string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeKeysetJson(w, &args.pageArgs, args.SortBy, args.shaper(coreApi, forUser, "sheet"), func(query *paging.Query) (interface{}, *paging.Info, error) {
+			return coreApi.Sheet().GlobalSearchPage(forUser, args.Search, query, sheet.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func sheetProjectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Project string `json:"project"`
+		Search  string `json:"search"`
+		SortBy  string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "sheet"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Sheet().ProjectSearch(forUser, args.Project, args.Search, offset, limit, sheet.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func sheetGetProperties(propertyDbs *propertyDbCache) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		args := &struct {
+			Id          string   `json:"id"`
+			DbIds       []int    `json:"dbIds"`
+			ExternalIds []string `json:"externalIds"`
+		}{}
+		if err := readJson(r, args); err != nil {
+			return err
+		} else if db, err := propertyDbs.get(coreApi, forUser, session, args.Id); err != nil {
+			return err
+		} else {
+			for _, externalId := range args.ExternalIds {
+				if dbId, exists := db.dbIdForExternalId(externalId); exists {
+					args.DbIds = append(args.DbIds, dbId)
+				}
+			}
+			res := make([]*propertyDbElement, 0, len(args.DbIds))
+			for _, dbId := range args.DbIds {
+				if dbId > 0 && dbId < len(db.ids) {
+					res = append(res, db.element(dbId, true))
+				}
+			}
+			writeJson(w, res, log)
+			return nil
+		}
+	}
+}
+
+func sheetSearchProperties(propertyDbs *propertyDbCache) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		args := &struct {
+			Id    string `json:"id"`
+			Name  string `json:"name"`
+			Value string `json:"value"`
+			pageArgs
+		}{}
+		if err := readJson(r, args); err != nil {
+			return err
+		} else if args.Name == "" && args.Value == "" {
+			return newHttpError(http.StatusBadRequest, errors.New("name or value is required"))
+		} else if db, err := propertyDbs.get(coreApi, forUser, session, args.Id); err != nil {
+			return err
+		} else {
+			dbIds := db.search(args.Name, args.Value)
+			return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+				res := []*propertyDbElement{}
+				for i := offset; i < len(dbIds) && (limit <= 0 || i < offset+limit); i++ {
+					res = append(res, db.element(dbIds[i], false))
+				}
+				return res, len(dbIds), nil
+			}, log)
+		}
+	}
+}
+
+func sheetGetCategories(propertyDbs *propertyDbCache) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		args := &struct {
+			Id string `json:"id"`
+		}{}
+		if err := readJson(r, args); err != nil {
+			return err
+		} else if db, err := propertyDbs.get(coreApi, forUser, session, args.Id); err != nil {
+			return err
+		} else {
+			writeJson(w, db.categories(), log)
+			return nil
+		}
+	}
+}
+
+func sheetTransformGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids []string `json:"ids"`
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := coreApi.SheetTransform().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "sheetTransform", res); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func sheetTransformGetForProjectSpaceVersion(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		DocumentVersion string `json:"projectSpaceVersion"`
+		SortBy          string `json:"sortBy"`
+		pageArgs
+		shapeArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "sheetTransform"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.SheetTransform().GetForProjectSpaceVersion(forUser, args.DocumentVersion, offset, limit, sheettransform.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func clashTestStart(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		ProjectSpaceVersion string   `json:"projectSpaceVersion"`
+		SheetTransforms     []string `json:"sheetTransforms"`
+		Tolerance           float64  `json:"tolerance"`
+		Mode                string   `json:"mode"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if len(args.SheetTransforms) < 2 {
+		return newHttpError(http.StatusBadRequest, errors.New("at least two sheet transforms are required"))
+	} else if args.Tolerance < 0 {
+		return newHttpError(http.StatusBadRequest, errors.New("tolerance may not be negative"))
+	} else if args.Mode != "" && args.Mode != string(clashtest.Hard) && args.Mode != string(clashtest.Soft) {
+		return newHttpError(http.StatusBadRequest, errors.New("mode must be hard or soft"))
+	} else {
+		mode := clashtest.Mode(args.Mode)
+		if mode == "" {
+			mode = clashtest.Hard
+		}
+		if res, err := coreApi.ClashTest().Start(forUser, args.ProjectSpaceVersion, args.SheetTransforms, args.Tolerance, mode); err != nil {
+			return err
+		} else {
+			publishClashTests(forUser, args.ProjectSpaceVersion, res, r)
+			writeJson(w, res, log)
+			return nil
+		}
+	}
+}
+
+func clashTestGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids  []string `json:"ids"`
+		Wait int      `json:"wait"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, err := awaitClashTests(coreApi, forUser, args.Ids, time.Duration(args.Wait)*time.Second, r); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func clashTestGetForSheetTransforms(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		LeftSheetTransform  string `json:"leftSheetTransform"`
+		RightSheetTransform string `json:"rightSheetTransform"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if res, exists, err := coreApi.ClashTest().GetForSheetTransforms(forUser, args.LeftSheetTransform, args.RightSheetTransform); err != nil {
+		return err
+	} else if !exists {
+		return newHttpError(http.StatusNotFound, errors.New("No clash test exists for given sheet transforms, start one with clashTest/start"))
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func clashTestGetClashes(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		ClashTest string `json:"clashTest"`
+		SortBy    string `json:"sortBy"`
+		clashFilterArgs
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if filter, err := args.filter(); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.ClashTest().GetClashes(forUser, args.ClashTest, filter, offset, limit, clashtest.SortBy(args.SortBy))
+		}, log)
+	}
+}
+
+func clashTestGetClashGroups(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		ClashTest string `json:"clashTest"`
+		GroupBy   string `json:"groupBy"`
+		clashFilterArgs
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if args.GroupBy != string(clashtest.ByElement) && args.GroupBy != string(clashtest.ByLevel) {
+		return newHttpError(http.StatusBadRequest, errors.New("groupBy must be element or level"))
+	} else if filter, err := args.filter(); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.ClashTest().GetClashGroups(forUser, args.ClashTest, filter, clashtest.GroupBy(args.GroupBy), offset, limit)
+		}, log)
+	}
+}
+
+func clashTestSetClashStatus(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids    []string `json:"ids"`
+		Status string   `json:"status"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if status, err := parseClashStatus(args.Status); err != nil {
+		return err
+	} else if err := coreApi.ClashTest().SetClashStatus(forUser, args.Ids, status); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func clashTestSetClashAssignee(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Ids      []string `json:"ids"`
+		Assignee string   `json:"assignee"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if err := coreApi.ClashTest().SetClashAssignee(forUser, args.Ids, args.Assignee); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func clashTestAddClashComment(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Clash string `json:"clash"`
+		Body  string `json:"body"`
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if strings.TrimSpace(args.Body) == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("comment body may not be empty"))
+	} else if res, err := coreApi.ClashTest().AddClashComment(forUser, args.Clash, args.Body); err != nil {
+		return err
+	} else {
+		writeJson(w, res, log)
+		return nil
+	}
+}
+
+func clashTestGetClashComments(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Clash string `json:"clash"`
+		pageArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else {
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.ClashTest().GetClashComments(forUser, args.Clash, offset, limit)
+		}, log)
+	}
+}
+
+func clashTestExportBcf(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		ClashTest string `json:"clashTest"`
+		clashFilterArgs
+	}{}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if filter, err := args.filter(); err != nil {
+		return err
+	} else {
+		topics := []*bcfTopic{}
+		err := fetchAll(func(offset int, limit int) (int, int, error) {
+			clashes, total, err := coreApi.ClashTest().GetClashes(forUser, args.ClashTest, filter, offset, limit, "")
+			if err != nil {
+				return 0, 0, err
+			}
+			ids := make([]string, 0, len(clashes))
+			for _, clash := range clashes {
+				ids = append(ids, clash.Id)
+			}
+			comments, err := coreApi.ClashTest().GetCommentsForClashes(forUser, ids)
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, clash := range clashes {
+				topics = append(topics, clashTopic(clash, comments[clash.Id], forUser))
+			}
+			return len(clashes), total, nil
+		})
+		if err != nil {
+			return err
+		}
+		return writeBcfZip(w, topics, args.ClashTest)
+	}
+}
+
+func issueCreate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	args := &struct {
+		Sheet               string   `json:"sheet"`
+		ProjectSpaceVersion string   `json:"projectSpaceVersion"`
+		Title               string   `json:"title"`
+		Description         string   `json:"description"`
+		Status              string   `json:"status"`
+		Assignee            string   `json:"assignee"`
+		DueDate             string   `json:"dueDate"`
+		Camera              *sj.Json `json:"camera"`
+		Markup              *sj.Json `json:"markup"`
+	}{Status: string(issue.Open)}
+	if err := readJson(r, args); err != nil {
+		return err
+	} else if (args.Sheet == "") == (args.ProjectSpaceVersion == "") {
+		return newHttpError(http.StatusBadRequest, errors.New("exactly one of sheet or projectSpaceVersion is required"))
+	} else if strings.TrimSpace(args.Title) == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("title is required"))
+	} else if status, err := parseIssueStatus(args.Status); err != nil {
+		return err
+	} else if err := checkDueDate(args.DueDate); err != nil {
+		return err
+	} else if err := checkCamera(args.Camera); err != nil {
+		return err
+	} else if res, err := coreApi.Issue().Create(forUser, args.Sheet, args.ProjectSpaceVersion, args.Title, args.Description, status, args.Assignee, args.DueDate, args.Camera, args.Markup); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -522,41 +2495,76 @@ func treeNodeCreateProjectSpace(coreApi core.CoreApi, forUser string, session se
 	}
 }
 
-func treeNodeSetName(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueUpdate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id   string `json:"id"`
-		Name string `json:"name"`
+		Id          string   `json:"id"`
+		Title       *string  `json:"title"`
+		Description *string  `json:"description"`
+		Status      *string  `json:"status"`
+		Assignee    *string  `json:"assignee"`
+		DueDate     *string  `json:"dueDate"`
+		Camera      *sj.Json `json:"camera"`
+		Markup      *sj.Json `json:"markup"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if err := coreApi.TreeNode().SetName(forUser, args.Id, args.Name); err != nil {
+	} else if args.Title != nil && strings.TrimSpace(*args.Title) == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("title may not be empty"))
+	} else if err := checkCamera(args.Camera); err != nil {
 		return err
 	} else {
-		return nil
+		if args.DueDate != nil {
+			if err := checkDueDate(*args.DueDate); err != nil {
+				return err
+			}
+		}
+		update := &issue.Update{
+			Title:       args.Title,
+			Description: args.Description,
+			Assignee:    args.Assignee,
+			DueDate:     args.DueDate,
+			Camera:      args.Camera,
+			Markup:      args.Markup,
+		}
+		if args.Status != nil {
+			if status, err := parseIssueStatus(*args.Status); err != nil {
+				return err
+			} else {
+				update.Status = &status
+			}
+		}
+		if res, err := coreApi.Issue().Update(forUser, args.Id, update); err != nil {
+			return err
+		} else {
+			writeJson(w, res, log)
+			return nil
+		}
 	}
 }
 
-func treeNodeMove(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueDelete(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Parent string   `json:"parent"`
-		Ids    []string `json:"ids"`
+		Ids []string `json:"ids"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if err := coreApi.TreeNode().Move(forUser, args.Parent, args.Ids); err != nil {
+	} else if err := coreApi.Issue().Delete(forUser, args.Ids); err != nil {
 		return err
 	} else {
 		return nil
 	}
 }
 
-func treeNodeGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Ids []string `json:"ids"`
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.TreeNode().Get(forUser, args.Ids); err != nil {
+	} else if res, err := coreApi.Issue().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "issue", res); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -564,97 +2572,91 @@ func treeNodeGet(coreApi core.CoreApi, forUser string, session session.Session,
 	}
 }
 
-func treeNodeGetChildren(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueGetForProject(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id       string `json:"id"`
-		NodeType string `json:"nodeType"`
-		Offset   int    `json:"offset"`
-		Limit    int    `json:"limit"`
-		SortBy   string `json:"sortBy"`
+		Project string `json:"project"`
+		SortBy  string `json:"sortBy"`
+		issueFilterArgs
+		pageArgs
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.TreeNode().GetChildren(forUser, args.Id, treenode.NodeType(args.NodeType), args.Offset, args.Limit, treenode.SortBy(args.SortBy)); err != nil {
+	} else if filter, err := args.filter(); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "issue"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Issue().GetForProject(forUser, args.Project, filter, offset, limit, issue.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
-func treeNodeGetParents(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueProjectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id string `json:"id"`
+		Project string `json:"project"`
+		Search  string `json:"search"`
+		SortBy  string `json:"sortBy"`
+		issueFilterArgs
+		pageArgs
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.TreeNode().GetParents(forUser, args.Id); err != nil {
+	} else if filter, err := args.filter(); err != nil {
 		return err
 	} else {
-		writeJson(w, res, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "issue"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Issue().ProjectSearch(forUser, args.Project, args.Search, filter, offset, limit, issue.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
-func treeNodeGlobalSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueAddComment(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Search   string `json:"search"`
-		NodeType string `json:"nodeType"`
-		Offset   int    `json:"offset"`
-		Limit    int    `json:"limit"`
-		SortBy   string `json:"sortBy"`
+		Issue  string `json:"issue"`
+		Parent string `json:"parent"`
+		Body   string `json:"body"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.TreeNode().GlobalSearch(forUser, args.Search, treenode.NodeType(args.NodeType), args.Offset, args.Limit, treenode.SortBy(args.SortBy)); err != nil {
+	} else if strings.TrimSpace(args.Body) == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("comment body may not be empty"))
+	} else if res, err := coreApi.Issue().AddComment(forUser, args.Issue, args.Parent, args.Body); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
+		writeJson(w, res, log)
 		return nil
 	}
 }
 
-func treeNodeProjectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueGetComments(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Project  string `json:"project"`
-		Search   string `json:"search"`
-		NodeType string `json:"nodeType"`
-		Offset   int    `json:"offset"`
-		Limit    int    `json:"limit"`
-		SortBy   string `json:"sortBy"`
+		Issue string `json:"issue"`
+		pageArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.TreeNode().ProjectSearch(forUser, args.Project, args.Search, treenode.NodeType(args.NodeType), args.Offset, args.Limit, treenode.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Issue().GetComments(forUser, args.Issue, offset, limit)
+		}, log)
 	}
 }
 
-func documentVersionCreate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueAddAttachment(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	file, header, err := r.FormFile("file")
 	if file != nil {
 		defer file.Close()
 	}
-	fileName := ""
-	if header != nil {
-		fileName = header.Filename
-	}
 	if err != nil {
-		return err
+		return newHttpError(http.StatusBadRequest, err)
 	}
 
-	thumbnail, _, err := r.FormFile("thumbnail")
-	if thumbnail != nil {
-		defer thumbnail.Close()
-	}
-	if err != nil && err != http.ErrMissingFile {
-		return err
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
-
-	if res, err := coreApi.DocumentVersion().Create(forUser, r.FormValue("document"), r.FormValue("uploadComment"), r.FormValue("fileType"), fileName, file, r.FormValue("thumbnailType"), thumbnail); err != nil {
+	if res, err := coreApi.Issue().AddAttachment(forUser, r.FormValue("issue"), header.Filename, contentType, file); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -662,13 +2664,50 @@ func documentVersionCreate(coreApi core.CoreApi, forUser string, session session
 	}
 }
 
-func documentVersionGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+// issueGetAttachment serves an attachment as a download with the content type
+// it was uploaded with, never inline, as attachments are user supplied content.
+// Any path segments after the id are ignored.
+func issueGetAttachment(basePath string) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		id := strings.Split(r.URL.Path[len(basePath):], "/")[0]
+		if id == "" {
+			return newHttpError(http.StatusBadRequest, errors.New("attachment id is required"))
+		} else if attachment, err := coreApi.Issue().GetAttachmentInfo(forUser, id); err != nil {
+			return err
+		} else if res, err := coreApi.Issue().GetAttachment(forUser, id); err != nil {
+			if res != nil && res.Body != nil {
+				res.Body.Close()
+			}
+			return err
+		} else {
+			defer res.Body.Close()
+			contentType := attachment.ContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", contentType)
+			disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})
+			if disposition == "" {
+				disposition = "attachment"
+			}
+			w.Header().Set("Content-Disposition", disposition)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			if res.ContentLength >= 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+			}
+			_, err := io.Copy(w, res.Body)
+			return err
+		}
+	}
+}
+
+func issueGetAttachments(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Ids []string `json:"ids"`
+		Issue string `json:"issue"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.DocumentVersion().Get(forUser, args.Ids); err != nil {
+	} else if res, err := coreApi.Issue().GetAttachments(forUser, args.Issue); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -676,55 +2715,76 @@ func documentVersionGet(coreApi core.CoreApi, forUser string, session session.Se
 	}
 }
 
-func documentVersionGetForDocument(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func issueExportBcf(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Document string `json:"document"`
-		Offset   int    `json:"offset"`
-		Limit    int    `json:"limit"`
-		SortBy   string `json:"sortBy"`
+		Project string `json:"project"`
+		issueFilterArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.DocumentVersion().GetForDocument(forUser, args.Document, args.Offset, args.Limit, documentversion.SortBy(args.SortBy)); err != nil {
+	} else if filter, err := args.filter(); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		topics := []*bcfTopic{}
+		err := fetchAll(func(offset int, limit int) (int, int, error) {
+			issues, total, err := coreApi.Issue().GetForProject(forUser, args.Project, filter, offset, limit, "")
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, iss := range issues {
+				if topic, err := issueTopic(coreApi, forUser, iss); err != nil {
+					return 0, 0, err
+				} else {
+					topics = append(topics, topic)
+				}
+			}
+			return len(issues), total, nil
+		})
+		if err != nil {
+			return err
+		}
+		return writeBcfZip(w, topics, args.Project)
 	}
 }
 
-func documentVersionGetSeedFile(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
-	pathSegments := strings.Split(r.URL.Path, "/")
-	id := pathSegments[5]
-	if strings.Contains(id, ".") {
-		id = strings.Split(id, ".")[0]
-	}
-	var res *http.Response
-	var err error
-	if res, err = coreApi.DocumentVersion().GetSeedFile(forUser, id); res != nil && res.Body != nil {
-		defer res.Body.Close()
-	}
-
-	if len(pathSegments) == 8 {
-		w.Header().Set("Content-Type", pathSegments[6]+"/"+pathSegments[7])
-	} else {
-		w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
-		w.Header().Set("Content-Disposition", "attachment")
+func issueImportBcf(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	file, header, err := r.FormFile("file")
+	if file != nil {
+		defer file.Close()
 	}
-	if res.ContentLength >= 0 {
-		w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	if err != nil {
+		return newHttpError(http.StatusBadRequest, err)
 	}
 
-	if err != nil {
+	projectSpaceVersion := r.FormValue("projectSpaceVersion")
+	if topics, err := readBcf(file, header.Size); err != nil {
 		return err
-	} else if _, err := io.Copy(w, res.Body); err != nil {
+	} else if err := validateBcfTopics(topics); err != nil {
+		return newHttpError(http.StatusBadRequest, err)
+	} else if existing, err := coreApi.Issue().GetForBcfGuids(forUser, projectSpaceVersion, bcfTopicGuids(topics)); err != nil {
 		return err
 	} else {
+		imported := make(map[string]*issue.Issue, len(existing))
+		for _, iss := range existing {
+			imported[iss.BcfGuid] = iss
+		}
+		res := make([]*bcfImportResult, 0, len(topics))
+		for _, topic := range topics {
+			result := &bcfImportResult{Guid: topic.Guid, Status: bcfImportCreated}
+			if iss, exists := imported[topic.Guid]; exists {
+				result.Status, result.Issue = bcfImportSkipped, iss
+			} else if result.Issue, err = createTopicIssue(coreApi, forUser, projectSpaceVersion, topic); err != nil {
+				result.Status = bcfImportFailed
+				result.Error = log.Error("RestApi failed to import BCF topic %s: %v", topic.Guid, err).LogId
+			}
+			res = append(res, result)
+		}
+		writeJson(w, res, log)
 		return nil
 	}
 }
 
-func projectSpaceVersionCreate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func viewpointCreate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	thumbnail, _, err := r.FormFile("thumbnail")
 	if thumbnail != nil {
 		defer thumbnail.Close()
@@ -733,14 +2793,42 @@ func projectSpaceVersionCreate(coreApi core.CoreApi, forUser string, session ses
 		return err
 	}
 
-	camera, _ := sj.FromString(r.FormValue("camera"))
+	sheet, projectSpaceVersion := r.FormValue("sheet"), r.FormValue("projectSpaceVersion")
+	if (sheet == "") == (projectSpaceVersion == "") {
+		return newHttpError(http.StatusBadRequest, errors.New("exactly one of sheet or projectSpaceVersion is required"))
+	} else if strings.TrimSpace(r.FormValue("name")) == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("name is required"))
+	} else if r.FormValue("camera") == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("camera is required"))
+	}
 
-	sheetTransforms := make([]*sheettransform.SheetTransform, 0, 100)
-	if err := json.Unmarshal([]byte(r.FormValue("sheetTransforms")), &sheetTransforms); err != nil {
+	camera, err := sj.FromString(r.FormValue("camera"))
+	if err != nil {
+		return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid camera: %v", err))
+	} else if err := checkCamera(camera); err != nil {
 		return err
 	}
+	var sectionPlanes *sj.Json
+	if v := r.FormValue("sectionPlanes"); v != "" {
+		if sectionPlanes, err = sj.FromString(v); err != nil {
+			return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid sectionPlanes: %v", err))
+		}
+	}
 
-	if res, err := coreApi.ProjectSpaceVersion().Create(forUser, r.FormValue("projectSpace"), r.FormValue("createComment"), sheetTransforms, camera, r.FormValue("thumbnailType"), thumbnail); err != nil {
+	hidden := make([]string, 0)
+	if v := r.FormValue("hidden"); v != "" {
+		if err := json.Unmarshal([]byte(v), &hidden); err != nil {
+			return newHttpError(http.StatusBadRequest, err)
+		}
+	}
+	isolated := make([]string, 0)
+	if v := r.FormValue("isolated"); v != "" {
+		if err := json.Unmarshal([]byte(v), &isolated); err != nil {
+			return newHttpError(http.StatusBadRequest, err)
+		}
+	}
+
+	if res, err := coreApi.Viewpoint().Create(forUser, sheet, projectSpaceVersion, r.FormValue("name"), camera, sectionPlanes, hidden, isolated, r.FormValue("thumbnailType"), thumbnail); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -748,13 +2836,26 @@ func projectSpaceVersionCreate(coreApi core.CoreApi, forUser string, session ses
 	}
 }
 
-func projectSpaceVersionGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func viewpointUpdate(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Ids []string `json:"ids"`
+		Id            string    `json:"id"`
+		Name          *string   `json:"name"`
+		Camera        *sj.Json  `json:"camera"`
+		SectionPlanes *sj.Json  `json:"sectionPlanes"`
+		Hidden        *[]string `json:"hidden"`
+		Isolated      *[]string `json:"isolated"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.ProjectSpaceVersion().Get(forUser, args.Ids); err != nil {
+	} else if args.Name != nil && strings.TrimSpace(*args.Name) == "" {
+		return newHttpError(http.StatusBadRequest, errors.New("name may not be empty"))
+	} else if res, err := coreApi.Viewpoint().Update(forUser, args.Id, &viewpoint.Update{
+		Name:          args.Name,
+		Camera:        args.Camera,
+		SectionPlanes: args.SectionPlanes,
+		Hidden:        args.Hidden,
+		Isolated:      args.Isolated,
+	}); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -762,83 +2863,44 @@ func projectSpaceVersionGet(coreApi core.CoreApi, forUser string, session sessio
 	}
 }
 
-func projectSpaceVersionGetForProjectSpace(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
-	args := &struct {
-		ProjectSpace string `json:"projectSpace"`
-		Offset       int    `json:"offset"`
-		Limit        int    `json:"limit"`
-		SortBy       string `json:"sortBy"`
-	}{}
-	if err := readJson(r, args); err != nil {
+func viewpointSetThumbnail(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+	thumbnail, _, err := r.FormFile("thumbnail")
+	if thumbnail != nil {
+		defer thumbnail.Close()
+	}
+	if err != nil && err != http.ErrMissingFile {
 		return err
-	} else if res, totalResults, err := coreApi.ProjectSpaceVersion().GetForProjectSpace(forUser, args.ProjectSpace, args.Offset, args.Limit, projectspaceversion.SortBy(args.SortBy)); err != nil {
+	}
+	if err := coreApi.Viewpoint().SetThumbnail(forUser, r.FormValue("id"), r.FormValue("thumbnailType"), thumbnail); err != nil {
 		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
 		return nil
 	}
 }
 
-func sheetSetName(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func viewpointDelete(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Id   string `json:"id"`
-		Name string `json:"name"`
+		Ids []string `json:"ids"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if err := coreApi.Sheet().SetName(forUser, args.Id, args.Name); err != nil {
+	} else if err := coreApi.Viewpoint().Delete(forUser, args.Ids); err != nil {
 		return err
 	} else {
 		return nil
 	}
 }
 
-func sheetGetItem(vada vada.VadaClient) handler {
-	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
-		id := r.URL.Path[len(sheetGetItemPath):]
-		path := ""
-		if slashIdx := strings.Index(id, "/"); slashIdx == -1 {
-			return errors.New("can't find item path in sheetGetItem call")
-		} else {
-			path = id[slashIdx:]
-			id = id[:slashIdx]
-		}
-		baseUrn := ""
-		var res *http.Response
-		var err error
-		if baseUrn, err = session.GetSheetBaseUrn(id); err != nil {
-			if res, baseUrn, err = coreApi.Sheet().GetItem(forUser, id, path); err == nil {
-				session.SetAccessedSheet(id, baseUrn)
-			}
-		} else {
-			res, err = vada.GetSheetItem(baseUrn + path)
-		}
-		if res != nil && res.Body != nil {
-			defer res.Body.Close()
-			if res.Header.Get("Content-Type") != "" {
-				w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
-			}
-			if res.Header.Get("Content-Encoding") != "" {
-				w.Header().Set("Content-Encoding", res.Header.Get("Content-Encoding"))
-			} else if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".bin") || strings.HasSuffix(path, ".pack") {
-				w.Header().Set("Content-Encoding", "gzip")
-			}
-			if res.ContentLength >= 0 {
-				w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
-			}
-			_, err = io.Copy(w, res.Body)
-		}
-		return err
-	}
-}
-
-func sheetGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func viewpointGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Ids []string `json:"ids"`
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.Sheet().Get(forUser, args.Ids); err != nil {
+	} else if res, err := coreApi.Viewpoint().Get(forUser, args.Ids); err != nil {
+		return err
+	} else if res, err := args.shape(coreApi, forUser, "viewpoint", res); err != nil {
 		return err
 	} else {
 		writeJson(w, res, log)
@@ -846,154 +2908,208 @@ func sheetGet(coreApi core.CoreApi, forUser string, session session.Session, w h
 	}
 }
 
-func sheetGetForDocumentVersion(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func viewpointGetForSheet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		DocumentVersion string `json:"documentVersion"`
-		Offset          int    `json:"offset"`
-		Limit           int    `json:"limit"`
-		SortBy          string `json:"sortBy"`
+		Sheet  string `json:"sheet"`
+		SortBy string `json:"sortBy"`
+		pageArgs
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Sheet().GetForDocumentVersion(forUser, args.DocumentVersion, args.Offset, args.Limit, sheet.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "viewpoint"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Viewpoint().GetForSheet(forUser, args.Sheet, offset, limit, viewpoint.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
-func sheetGlobalSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+func viewpointGetForProjectSpaceVersion(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Search string `json:"search"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
-		SortBy string `json:"sortBy"`
+		ProjectSpaceVersion string `json:"projectSpaceVersion"`
+		SortBy              string `json:"sortBy"`
+		pageArgs
+		shapeArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Sheet().GlobalSearch(forUser, args.Search, args.Offset, args.Limit, sheet.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, args.shaper(coreApi, forUser, "viewpoint"), func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Viewpoint().GetForProjectSpaceVersion(forUser, args.ProjectSpaceVersion, offset, limit, viewpoint.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
-func sheetProjectSearch(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
-	args := &struct {
-		Project string `json:"project"`
-		Search  string `json:"search"`
-		Offset  int    `json:"offset"`
-		Limit   int    `json:"limit"`
-		SortBy  string `json:"sortBy"`
-	}{}
-	if err := readJson(r, args); err != nil {
-		return err
-	} else if res, totalResults, err := coreApi.Sheet().ProjectSearch(forUser, args.Project, args.Search, args.Offset, args.Limit, sheet.SortBy(args.SortBy)); err != nil {
-		return err
-	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+// viewpointOpen serves viewpoint permalinks, {basePath}{id}, redirecting to the
+// viewer set with WithViewerUrl.
+func viewpointOpen(basePath string) handler {
+	return func(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+		id := strings.Split(r.URL.Path[len(basePath):], "/")[0]
+		viewerUrl := optionsFrom(r).viewerUrl
+		if viewerUrl == "" {
+			return newHttpError(http.StatusNotImplemented, errors.New("viewpoint permalinks are not configured"))
+		} else if res, err := coreApi.Viewpoint().Get(forUser, []string{id}); err != nil {
+			return err
+		} else if len(res) != 1 {
+			return newHttpError(http.StatusNotFound, errors.New("viewpoint not found"))
+		} else if u, err := url.Parse(viewerUrl); err != nil {
+			return err
+		} else {
+			q := u.Query()
+			q.Set("viewpoint", res[0].Id)
+			if res[0].Sheet != "" {
+				q.Set("sheet", res[0].Sheet)
+			} else {
+				q.Set("projectSpaceVersion", res[0].ProjectSpaceVersion)
+			}
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return nil
+		}
 	}
 }
 
-func sheetTransformGet(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+// eventStream sends a project's events, or with no project all the events of
+// the user's projects, as server-sent events until the client goes away.
+func eventStream(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		Ids []string `json:"ids"`
+		Project     string `json:"project"`
+		LastEventId string `json:"lastEventId"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, err := coreApi.SheetTransform().Get(forUser, args.Ids); err != nil {
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming is not supported")
+	}
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		args.LastEventId = lastEventId
+	}
+	filter := &eventFilter{user: forUser, project: args.Project}
+	if err := filter.refresh(coreApi); err != nil {
 		return err
-	} else {
-		writeJson(w, res, log)
-		return nil
 	}
-}
 
-func sheetTransformGetForProjectSpaceVersion(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
-	args := &struct {
-		DocumentVersion string `json:"projectSpaceVersion"`
-		Offset          int    `json:"offset"`
-		Limit           int    `json:"limit"`
-		SortBy          string `json:"sortBy"`
-	}{}
-	if err := readJson(r, args); err != nil {
-		return err
-	} else if res, totalResults, err := coreApi.SheetTransform().GetForProjectSpaceVersion(forUser, args.DocumentVersion, args.Offset, args.Limit, sheettransform.SortBy(args.SortBy)); err != nil {
-		return err
-	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+	events := optionsFrom(r).events
+	sub, replay, resetId := events.subscribe(args.LastEventId, filter.matches)
+	defer events.unsubscribe(sub)
+	w.Header().Set("Content-Type", eventStreamMediaType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if resetId != "" {
+		replay = []*event{{Id: resetId, Type: resetEvent, Time: optionsFrom(r).clock().UTC().Format(time.RFC3339)}}
+	}
+	for _, ev := range replay {
+		if err := writeEvent(w, ev); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case ev, open := <-sub.events:
+			// a closed subscription fell too far behind, the client resumes
+			// from the last event it got when it reconnects
+			if !open {
+				return nil
+			} else if err := writeEvent(w, ev); err != nil {
+				return nil
+			} else if ev.Type == membershipChanged && filter.concerns(ev) {
+				if err := filter.refresh(coreApi); err != nil {
+					log.Info("RestApi ending event stream for user %s: %v", forUser, err)
+					flusher.Flush()
+					return nil
+				}
+			}
+		}
+		flusher.Flush()
 	}
 }
 
-func clashTestGetForSheetTransforms(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
+// roomJoin upgrades to a websocket joining the viewing room of a sheet or
+// project space version, the connection stays open until the client leaves.
+func roomJoin(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
-		LeftSheetTransform  string `json:"leftSheetTransform"`
-		RightSheetTransform string `json:"rightSheetTransform"`
+		Sheet               string `json:"sheet"`
+		ProjectSpaceVersion string `json:"projectSpaceVersion"`
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, exists, err := coreApi.ClashTest().GetForSheetTransforms(forUser, args.LeftSheetTransform, args.RightSheetTransform); err != nil {
+	} else if (args.Sheet == "") == (args.ProjectSpaceVersion == "") {
+		return newHttpError(http.StatusBadRequest, errors.New("exactly one of sheet or projectSpaceVersion is required"))
+	}
+	key, err := roomKey(coreApi, forUser, args.Sheet, args.ProjectSpaceVersion)
+	if err != nil {
 		return err
-	} else if !exists {
-		return errors.New("No clash test exists for given sheet transforms")
-	} else {
-		writeJson(w, res, log)
+	}
+	conn, err := roomUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied with an error status
+		log.Info("RestApi room upgrade failed for user %s: %v", forUser, err)
 		return nil
 	}
+
+	rooms := optionsFrom(r).rooms
+	member := rooms.join(key, forUser, optionsFrom(r).clock())
+	go writeRoomMessages(conn, member)
+	readRoomMessages(conn, rooms, key, member, log)
+	rooms.leave(key, member)
+	return nil
 }
 
 func helperGetChildrenDocumentsWithLatestVersionAndFirstSheetInfo(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Folder string `json:"folder"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
 		SortBy string `json:"sortBy"`
+		pageArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Helper().GetChildrenDocumentsWithLatestVersionAndFirstSheetInfo(forUser, args.Folder, args.Offset, args.Limit, helper.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Helper().GetChildrenDocumentsWithLatestVersionAndFirstSheetInfo(forUser, args.Folder, offset, limit, helper.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
 func helperGetDocumentVersionsWithFirstSheetInfo(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Document string `json:"document"`
-		Offset   int    `json:"offset"`
-		Limit    int    `json:"limit"`
 		SortBy   string `json:"sortBy"`
+		pageArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Helper().GetDocumentVersionsWithFirstSheetInfo(forUser, args.Document, args.Offset, args.Limit, helper.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Helper().GetDocumentVersionsWithFirstSheetInfo(forUser, args.Document, offset, limit, helper.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
 func helperGetChildrenProjectSpacesWithLatestVersion(coreApi core.CoreApi, forUser string, session session.Session, w http.ResponseWriter, r *http.Request, log golog.Log) error {
 	args := &struct {
 		Folder string `json:"folder"`
-		Offset int    `json:"offset"`
-		Limit  int    `json:"limit"`
 		SortBy string `json:"sortBy"`
+		pageArgs
 	}{}
 	if err := readJson(r, args); err != nil {
 		return err
-	} else if res, totalResults, err := coreApi.Helper().GetChildrenProjectSpacesWithLatestVersion(forUser, args.Folder, args.Offset, args.Limit, helper.SortBy(args.SortBy)); err != nil {
-		return err
 	} else {
-		writeOffsetJson(w, res, totalResults, log)
-		return nil
+		return writeOffsetJson(w, &args.pageArgs, nil, func(offset int, limit int) (interface{}, int, error) {
+			return coreApi.Helper().GetChildrenProjectSpacesWithLatestVersion(forUser, args.Folder, offset, limit, helper.SortBy(args.SortBy))
+		}, log)
 	}
 }
 
@@ -0,0 +1,783 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/clashtest"
+	"github.com/modelhub/core/documentversion"
+	"github.com/modelhub/core/issue"
+	"github.com/modelhub/core/project"
+	"github.com/modelhub/core/treenode"
+	sj "github.com/robsix/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJsonRequest is a json POST of body with opts attached, or the default
+// options if opts is nil, for calling handlers directly.
+func testJsonRequest(opts *options, body string) *http.Request {
+	if opts == nil {
+		opts = newOptions(nil)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", jsonMediaType)
+	return withOptions(r, opts)
+}
+
+func TestIsBodyTooLarge(t *testing.T) {
+	body := `{"name":"` + strings.Repeat("x", 100) + `"}`
+	opts := newOptions(nil)
+	for mediaType, codec := range defaultCodecs() {
+		r := withOptions(httptest.NewRequest(http.MethodPost, "/", nil), opts)
+		if mediaType == jsonMediaType {
+			r.Body = ioutil.NopCloser(strings.NewReader(body))
+		} else {
+			buf := &bytes.Buffer{}
+			if err := codec.Encode(buf, map[string]string{"name": strings.Repeat("x", 100)}); err != nil {
+				t.Fatal(err)
+			}
+			r.Body = ioutil.NopCloser(buf)
+		}
+		r.Header.Set("Content-Type", mediaType)
+		r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, 10)
+		dst := &struct {
+			Name string `json:"name"`
+		}{}
+		if err := readJson(r, dst); err == nil || !isBodyTooLarge(err) {
+			t.Errorf("%s: got %v, want a body too large error", mediaType, err)
+		}
+	}
+	if isBodyTooLarge(json.Unmarshal([]byte("{"), &struct{}{})) {
+		t.Error("a syntax error isn't a body too large error")
+	}
+}
+
+func TestAccessThrottle(t *testing.T) {
+	throttle := newAccessThrottle()
+	now := time.Unix(0, 0)
+	if !throttle.due("a", now) || throttle.due("a", now.Add(accessThrottleInterval-1)) {
+		t.Fatal("a repeat within the interval should not be due")
+	} else if !throttle.due("b", now) {
+		t.Fatal("keys are throttled independently")
+	} else if !throttle.due("a", now.Add(accessThrottleInterval)) {
+		t.Fatal("a repeat after the interval should be due")
+	}
+	for i := 0; i < maxAccessThrottleKeys+10; i++ {
+		throttle.due(strconv.Itoa(i), now)
+	}
+	if len(throttle.last) > maxAccessThrottleKeys {
+		t.Fatalf("throttle holds %d keys", len(throttle.last))
+	}
+}
+
+// testProjectCore has one owner, "owner", who core refuses to demote or let
+// leave. It records the roles set.
+type testProjectCore struct {
+	core.CoreApi
+	projects *testProjects
+}
+
+type testProjects struct {
+	project.ProjectApi
+	roles map[string]project.Role
+}
+
+func newTestProjectCore() *testProjectCore {
+	return &testProjectCore{projects: &testProjects{roles: map[string]project.Role{"owner": project.Owner, "member": project.Contributor}}}
+}
+
+func (c *testProjectCore) Project() project.ProjectApi { return c.projects }
+
+var errLastOwner = errors.New("project must have an owner")
+
+func (p *testProjects) SetUserRoles(forUser, id string, role project.Role, users []string) error {
+	for _, user := range users {
+		if p.roles[user] == project.Owner && role != project.Owner {
+			return errLastOwner
+		}
+	}
+	for _, user := range users {
+		p.roles[user] = role
+	}
+	return nil
+}
+
+func (p *testProjects) TransferOwnership(forUser, id, newOwner string) error {
+	p.roles[forUser], p.roles[newOwner] = project.Admin, project.Owner
+	return nil
+}
+
+func (p *testProjects) Leave(forUser, id string) error {
+	if p.roles[forUser] == project.Owner {
+		return errLastOwner
+	}
+	delete(p.roles, forUser)
+	return nil
+}
+
+// callProjectHandler calls h as forUser with body and returns the membership
+// changes it published and its error.
+func callProjectHandler(c *testProjectCore, h handler, forUser string, body string) ([]*event, error) {
+	opts := newOptions(nil)
+	sub, _, _ := opts.events.subscribe("", allEvents)
+	err := h(c, forUser, nil, httptest.NewRecorder(), testJsonRequest(opts, body), nil)
+	return receivedEvents(sub), err
+}
+
+func TestProjectSetUserRoles(t *testing.T) {
+	c := newTestProjectCore()
+	for _, role := range []string{"", "any", "Owner", "superuser"} {
+		events, err := callProjectHandler(c, projectSetUserRoles, "owner", `{"id": "p", "role": "`+role+`", "users": ["member"]}`)
+		if assertStatus(t, err, http.StatusBadRequest); len(events) != 0 {
+			t.Fatalf("%s published %d events", role, len(events))
+		}
+	}
+	if events, err := callProjectHandler(c, projectSetUserRoles, "owner", `{"id": "p", "role": "admin", "users": ["member"]}`); err != nil {
+		t.Fatal(err)
+	} else if change := events[0].Data.(*membershipChange); c.projects.roles["member"] != project.Admin || change.Change != "roleChanged" || change.Role != "admin" {
+		t.Fatalf("roles %v, change %+v", c.projects.roles, change)
+	}
+	if events, err := callProjectHandler(c, projectSetUserRoles, "owner", `{"id": "p", "role": "admin", "users": ["owner"]}`); err != errLastOwner || len(events) != 0 {
+		t.Fatalf("demoting the last owner: %v, %d events", err, len(events))
+	}
+}
+
+func TestProjectTransferOwnership(t *testing.T) {
+	c := newTestProjectCore()
+	for _, user := range []string{"", "owner"} {
+		_, err := callProjectHandler(c, projectTransferOwnership, "owner", `{"id": "p", "user": "`+user+`"}`)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+	if c.projects.roles["owner"] != project.Owner {
+		t.Fatal("ownership changed by a rejected transfer")
+	}
+	if events, err := callProjectHandler(c, projectTransferOwnership, "owner", `{"id": "p", "user": "member"}`); err != nil {
+		t.Fatal(err)
+	} else if change := events[0].Data.(*membershipChange); c.projects.roles["member"] != project.Owner || change.Change != "ownershipTransferred" {
+		t.Fatalf("roles %v, change %+v", c.projects.roles, change)
+	}
+}
+
+func TestProjectLeave(t *testing.T) {
+	c := newTestProjectCore()
+	if events, err := callProjectHandler(c, projectLeave, "owner", `{"id": "p"}`); err != errLastOwner || len(events) != 0 {
+		t.Fatalf("the last owner leaving: %v, %d events", err, len(events))
+	}
+	if events, err := callProjectHandler(c, projectLeave, "member", `{"id": "p"}`); err != nil {
+		t.Fatal(err)
+	} else if _, exists := c.projects.roles["member"]; exists || events[0].Data.(*membershipChange).Change != "left" {
+		t.Fatalf("roles %v, events %v", c.projects.roles, events)
+	}
+}
+
+// testClashTestCore reports the clash test "a" running until it has been
+// polled finishAfter times, moving the clock on by step on each poll.
+type testClashTestCore struct {
+	core.CoreApi
+	tests *testClashTests
+}
+
+type testClashTests struct {
+	clashtest.ClashTestApi
+	now         time.Time
+	step        time.Duration
+	polls       int
+	finishAfter int
+}
+
+func (c *testClashTestCore) ClashTest() clashtest.ClashTestApi { return c.tests }
+
+func (c *testClashTests) Get(forUser string, ids []string) ([]*clashtest.ClashTest, error) {
+	c.polls++
+	c.now = c.now.Add(c.step)
+	status := clashtest.Running
+	if c.polls >= c.finishAfter {
+		status = clashtest.Succeeded
+	}
+	return []*clashtest.ClashTest{{Id: "a", Status: status}}, nil
+}
+
+func TestAwaitClashTestsUsesTheClock(t *testing.T) {
+	tests := &testClashTests{now: time.Unix(0, 0), step: maxClashTestWait, finishAfter: 10}
+	opts := newOptions([]Option{WithClock(func() time.Time { return tests.now })})
+	r := testJsonRequest(opts, "")
+	start := time.Now()
+	res, err := awaitClashTests(&testClashTestCore{tests: tests}, "u", []string{"a"}, time.Hour, r)
+	if err != nil || res[0].Status != clashtest.Running || tests.polls != 1 {
+		t.Fatalf("got %v %v after %d polls", res, err, tests.polls)
+	} else if time.Since(start) >= clashTestPollInterval {
+		t.Fatal("waited for real time to pass")
+	}
+
+	tests = &testClashTests{now: time.Unix(0, 0), finishAfter: 1}
+	if res, err := awaitClashTests(&testClashTestCore{tests: tests}, "u", []string{"a"}, time.Minute, r); err != nil || res[0].Status != clashtest.Succeeded {
+		t.Fatalf("got %v %v", res, err)
+	}
+}
+
+func TestAwaitClashTestsStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := &testClashTests{finishAfter: 10}
+	r := testJsonRequest(newOptions([]Option{WithContext(ctx)}), "")
+	if res, err := awaitClashTests(&testClashTestCore{tests: tests}, "u", []string{"a"}, time.Minute, r); err != nil || res[0].Status != clashtest.Running || tests.polls != 1 {
+		t.Fatalf("got %v %v after %d polls", res, err, tests.polls)
+	}
+}
+
+// testIssueCore stores what it's given, it has one attachment, "a", a png.
+type testIssueCore struct {
+	core.CoreApi
+	issues *testIssues
+}
+
+type testIssues struct {
+	issue.IssueApi
+	created *issue.Issue
+	updated *issue.Update
+}
+
+func (c *testIssueCore) Issue() issue.IssueApi { return c.issues }
+
+func (i *testIssues) Create(forUser, sheet, projectSpaceVersion, title, description string, status issue.Status, assignee, dueDate string, camera, markup *sj.Json) (*issue.Issue, error) {
+	i.created = &issue.Issue{Id: "i", Sheet: sheet, Title: title, Status: status, DueDate: dueDate, Camera: camera}
+	return i.created, nil
+}
+
+func (i *testIssues) Update(forUser, id string, update *issue.Update) (*issue.Issue, error) {
+	i.updated = update
+	return &issue.Issue{Id: id}, nil
+}
+
+func (i *testIssues) GetAttachmentInfo(forUser, id string) (*issue.Attachment, error) {
+	if id != "a" {
+		return nil, newHttpError(http.StatusNotFound, errors.New("attachment not found"))
+	}
+	return &issue.Attachment{Id: id, Name: "shot.png", ContentType: "image/png"}, nil
+}
+
+func (i *testIssues) GetAttachment(forUser, id string) (*http.Response, error) {
+	return &http.Response{Body: ioutil.NopCloser(strings.NewReader("png")), ContentLength: 3}, nil
+}
+
+func TestIssueCreateValidates(t *testing.T) {
+	for _, body := range []string{
+		`{"sheet": "s", "title": "t", "dueDate": "next week"}`,
+		`{"sheet": "s", "title": "t", "dueDate": "2016-13-01"}`,
+		`{"sheet": "s", "title": "t", "camera": [1, 2, 3]}`,
+		`{"sheet": "s", "title": "t", "camera": "eye"}`,
+		`{"sheet": "s", "title": "t", "camera": {"eye": "here"}}`,
+	} {
+		c := &testIssueCore{issues: &testIssues{}}
+		err := issueCreate(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, body), nil)
+		if assertStatus(t, err, http.StatusBadRequest); c.issues.created != nil {
+			t.Fatalf("%s: created %+v", body, c.issues.created)
+		}
+	}
+	c := &testIssueCore{issues: &testIssues{}}
+	body := `{"sheet": "s", "title": "t", "dueDate": "2016-01-02", "camera": {"eye": [1, 2, 3], "target": [0, 0, 0], "up": [0, 0, 1]}}`
+	if err := issueCreate(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, body), nil); err != nil {
+		t.Fatal(err)
+	} else if c.issues.created.DueDate != "2016-01-02" || c.issues.created.Camera == nil {
+		t.Fatalf("created %+v", c.issues.created)
+	}
+}
+
+func TestIssueUpdateValidates(t *testing.T) {
+	for _, body := range []string{
+		`{"id": "i", "dueDate": "tomorrow"}`,
+		`{"id": "i", "camera": 1}`,
+	} {
+		c := &testIssueCore{issues: &testIssues{}}
+		err := issueUpdate(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, body), nil)
+		if assertStatus(t, err, http.StatusBadRequest); c.issues.updated != nil {
+			t.Fatalf("%s: updated %+v", body, c.issues.updated)
+		}
+	}
+	// an empty due date clears it
+	c := &testIssueCore{issues: &testIssues{}}
+	if err := issueUpdate(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"id": "i", "dueDate": ""}`), nil); err != nil {
+		t.Fatal(err)
+	} else if c.issues.updated.DueDate == nil || *c.issues.updated.DueDate != "" {
+		t.Fatalf("updated %+v", c.issues.updated)
+	}
+}
+
+func TestIssueGetAttachment(t *testing.T) {
+	h := issueGetAttachment("/api/v1/issue/getAttachment/")
+	c := &testIssueCore{issues: &testIssues{}}
+	w := httptest.NewRecorder()
+	if err := h(c, "u", nil, w, httptest.NewRequest(http.MethodGet, "/api/v1/issue/getAttachment/a/shot.png", nil), nil); err != nil {
+		t.Fatal(err)
+	} else if w.Body.String() != "png" || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Content-Disposition") != `attachment; filename=shot.png` {
+		t.Fatalf("got %q with headers %v", w.Body.String(), w.Header())
+	}
+	err := h(c, "u", nil, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/issue/getAttachment/", nil), nil)
+	assertStatus(t, err, http.StatusBadRequest)
+	err = h(c, "u", nil, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/issue/getAttachment/b", nil), nil)
+	assertStatus(t, err, http.StatusNotFound)
+}
+
+// testSeedFileCore serves the seed file of document version "dv" and fails for
+// any other without a response, as core does when it can't reach storage.
+type testSeedFileCore struct {
+	core.CoreApi
+}
+
+type testSeedFiles struct {
+	documentversion.DocumentVersionApi
+}
+
+func (testSeedFileCore) DocumentVersion() documentversion.DocumentVersionApi { return testSeedFiles{} }
+
+func (testSeedFiles) GetSeedFile(forUser, id string) (*http.Response, error) {
+	if id != "dv" {
+		return nil, errors.New("storage unavailable")
+	}
+	return &http.Response{Header: http.Header{"Content-Type": {"application/octet-stream"}}, Body: ioutil.NopCloser(strings.NewReader("rvt")), ContentLength: 3}, nil
+}
+
+func TestDocumentVersionGetSeedFile(t *testing.T) {
+	h := documentVersionGetSeedFile("/api/v1/documentVersion/getSeedFile/")
+	w := httptest.NewRecorder()
+	if err := h(testSeedFileCore{}, "u", nil, w, httptest.NewRequest(http.MethodGet, "/api/v1/documentVersion/getSeedFile/dv.rvt", nil), nil); err != nil {
+		t.Fatal(err)
+	} else if w.Body.String() != "rvt" || w.Header().Get("Content-Disposition") != "attachment" || w.Header().Get("Content-Length") != "3" {
+		t.Fatalf("got %q with headers %v", w.Body.String(), w.Header())
+	}
+	w = httptest.NewRecorder()
+	if err := h(testSeedFileCore{}, "u", nil, w, httptest.NewRequest(http.MethodGet, "/api/v1/documentVersion/getSeedFile/missing/model/vnd.rvt", nil), nil); err == nil || len(w.Header()) != 0 {
+		t.Fatalf("got %v with headers %v", err, w.Header())
+	}
+}
+
+var errTrashed = errors.New("node already trashed")
+
+// testTrashCore keeps the trash of project "p" and refuses to trash "t"
+// twice.
+type testTrashCore struct {
+	core.CoreApi
+	nodes *testTrashNodes
+}
+
+type testTrashNodes struct {
+	treenode.TreeNodeApi
+	trash    []*treenode.TrashedNode
+	restored map[string]string
+	purged   []string
+}
+
+func (c *testTrashCore) TreeNode() treenode.TreeNodeApi { return c.nodes }
+
+func (n *testTrashNodes) Trash(forUser string, ids []string) error {
+	for _, id := range ids {
+		if id == "t" {
+			return errTrashed
+		}
+	}
+	for _, id := range ids {
+		n.trash = append(n.trash, &treenode.TrashedNode{TreeNode: treenode.TreeNode{Id: id, Project: "p"}, TrashedBy: forUser})
+	}
+	return nil
+}
+
+func (n *testTrashNodes) GetTrash(forUser, project string, offset, limit int, sortBy treenode.SortBy) ([]*treenode.TrashedNode, int, error) {
+	if project != "p" {
+		return nil, 0, errors.New("project not found")
+	}
+	res := n.trash[offset:]
+	if limit > 0 && limit < len(res) {
+		res = res[:limit]
+	}
+	return res, len(n.trash), nil
+}
+
+func (n *testTrashNodes) Restore(forUser string, ids []string, fallbackParent string) error {
+	for _, id := range ids {
+		n.restored[id] = fallbackParent
+	}
+	return nil
+}
+
+func (n *testTrashNodes) Purge(forUser string, ids []string) error {
+	n.purged = append(n.purged, ids...)
+	return nil
+}
+
+func TestTreeNodeTrash(t *testing.T) {
+	c := &testTrashCore{nodes: &testTrashNodes{restored: map[string]string{}}}
+	if err := treeNodeTrash(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["a","b"]}`), nil); err != nil {
+		t.Fatal(err)
+	} else if len(c.nodes.trash) != 2 || c.nodes.trash[0].TrashedBy != "u" {
+		t.Fatalf("trash %v", c.nodes.trash)
+	}
+	if err := treeNodeTrash(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["t"]}`), nil); err != errTrashed {
+		t.Fatalf("got %v, want the core error", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := treeNodeGetTrash(c, "u", nil, w, testJsonRequest(nil, `{"project":"p","offset":1,"limit":5}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	page := &struct {
+		TotalResults int                     `json:"totalResults"`
+		Results      []*treenode.TrashedNode `json:"results"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), page); err != nil || page.TotalResults != 2 || len(page.Results) != 1 || page.Results[0].Id != "b" {
+		t.Fatalf("got %s %v", w.Body.String(), err)
+	}
+	err := treeNodeGetTrash(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"project":"p","after":"x"}`), nil)
+	assertStatus(t, err, http.StatusBadRequest)
+	if err := treeNodeGetTrash(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"project":"q"}`), nil); err == nil {
+		t.Fatal("listed the trash of an unknown project")
+	}
+
+	if err := treeNodeRestore(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["a"],"parent":"f"}`), nil); err != nil || c.nodes.restored["a"] != "f" {
+		t.Fatalf("restored %v %v", c.nodes.restored, err)
+	}
+	if err := treeNodePurge(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["b"]}`), nil); err != nil || len(c.nodes.purged) != 1 {
+		t.Fatalf("purged %v %v", c.nodes.purged, err)
+	}
+	if err := treeNodePurge(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":`), nil); err == nil {
+		t.Fatal("accepted malformed json")
+	}
+}
+
+// testStartClashTests starts a pending clash test per pair of sheet transforms
+// and only has one for the pair "l", "r".
+type testStartClashTests struct {
+	clashtest.ClashTestApi
+	started []*clashtest.ClashTest
+}
+
+func (c *testStartClashTests) Start(forUser, projectSpaceVersion string, sheetTransforms []string, tolerance float64, mode clashtest.Mode) ([]*clashtest.ClashTest, error) {
+	if projectSpaceVersion != "psv" {
+		return nil, errors.New("project space version not found")
+	}
+	for i, left := range sheetTransforms {
+		for _, right := range sheetTransforms[i+1:] {
+			c.started = append(c.started, &clashtest.ClashTest{Id: left + right, ProjectSpaceVersion: projectSpaceVersion, LeftSheetTransform: left, RightSheetTransform: right, Tolerance: tolerance, Mode: mode, Status: clashtest.Pending})
+		}
+	}
+	return c.started, nil
+}
+
+func (c *testStartClashTests) GetForSheetTransforms(forUser, leftSheetTransform, rightSheetTransform string) (*clashtest.ClashTest, bool, error) {
+	if leftSheetTransform == "l" && rightSheetTransform == "r" {
+		return &clashtest.ClashTest{Id: "lr", Status: clashtest.Succeeded}, true, nil
+	}
+	return nil, false, nil
+}
+
+type testStartClashTestCore struct {
+	core.CoreApi
+	tests *testStartClashTests
+}
+
+func (c *testStartClashTestCore) ClashTest() clashtest.ClashTestApi { return c.tests }
+
+func TestClashTestStart(t *testing.T) {
+	c := &testStartClashTestCore{tests: &testStartClashTests{}}
+	opts := newOptions(nil)
+	opts.watcher = newStatusWatcher(c, opts, nil)
+	// marked running so the test doesn't start polling the fake core
+	opts.watcher.running = true
+	w := httptest.NewRecorder()
+	if err := clashTestStart(c, "u", nil, w, testJsonRequest(opts, `{"projectSpaceVersion":"psv","sheetTransforms":["a","b","c"],"tolerance":0.01}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	res := []*clashtest.ClashTest{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res) != 3 || res[0].Mode != clashtest.Hard || res[0].Tolerance != 0.01 {
+		t.Fatalf("got %s %v", w.Body.String(), err)
+	} else if len(opts.watcher.clashTests) != 3 || opts.watcher.clashTests["ab"].forUser != "u" {
+		t.Fatalf("watching %v", opts.watcher.clashTests)
+	}
+
+	for _, body := range []string{
+		`{"projectSpaceVersion":"psv","sheetTransforms":["a"]}`,
+		`{"projectSpaceVersion":"psv","sheetTransforms":["a","b"],"tolerance":-1}`,
+		`{"projectSpaceVersion":"psv","sheetTransforms":["a","b"],"mode":"medium"}`,
+	} {
+		err := clashTestStart(c, "u", nil, httptest.NewRecorder(), testJsonRequest(opts, body), nil)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+	if err := clashTestStart(c, "u", nil, httptest.NewRecorder(), testJsonRequest(opts, `{"projectSpaceVersion":"x","sheetTransforms":["a","b"]}`), nil); err == nil {
+		t.Fatal("started a clash test in an unknown project space version")
+	}
+}
+
+func TestClashTestGet(t *testing.T) {
+	tests := &testClashTests{now: time.Unix(0, 0), finishAfter: 1}
+	opts := newOptions([]Option{WithClock(func() time.Time { return tests.now })})
+	w := httptest.NewRecorder()
+	if err := clashTestGet(&testClashTestCore{tests: tests}, "u", nil, w, testJsonRequest(opts, `{"ids":["a"],"wait":30}`), nil); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(w.Body.String(), `"status":"succeeded"`) {
+		t.Fatalf("got %s", w.Body.String())
+	}
+	// without a wait the tests are returned as they are
+	tests = &testClashTests{now: time.Unix(0, 0), finishAfter: 2}
+	w = httptest.NewRecorder()
+	if err := clashTestGet(&testClashTestCore{tests: tests}, "u", nil, w, testJsonRequest(opts, `{"ids":["a"]}`), nil); err != nil || tests.polls != 1 || !strings.Contains(w.Body.String(), `"status":"running"`) {
+		t.Fatalf("got %s %v after %d polls", w.Body.String(), err, tests.polls)
+	}
+}
+
+func TestClashTestGetForSheetTransforms(t *testing.T) {
+	c := &testStartClashTestCore{tests: &testStartClashTests{}}
+	w := httptest.NewRecorder()
+	if err := clashTestGetForSheetTransforms(c, "u", nil, w, testJsonRequest(nil, `{"leftSheetTransform":"l","rightSheetTransform":"r"}`), nil); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(w.Body.String(), `"id":"lr"`) {
+		t.Fatalf("got %s", w.Body.String())
+	}
+	err := clashTestGetForSheetTransforms(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"leftSheetTransform":"r","rightSheetTransform":"l"}`), nil)
+	assertStatus(t, err, http.StatusNotFound)
+}
+
+// testClashes has clashes "a" and "b" in clash test "ct" and records the
+// filters and changes it's given.
+type testClashes struct {
+	clashtest.ClashTestApi
+	filter   *clashtest.ClashFilter
+	statuses map[string]clashtest.ClashStatus
+	assignee map[string]string
+	comments []*clashtest.ClashComment
+}
+
+type testClashCore struct {
+	core.CoreApi
+	clashes *testClashes
+}
+
+func newTestClashCore() *testClashCore {
+	return &testClashCore{clashes: &testClashes{statuses: map[string]clashtest.ClashStatus{}, assignee: map[string]string{}}}
+}
+
+func (c *testClashCore) ClashTest() clashtest.ClashTestApi { return c.clashes }
+
+func (c *testClashes) GetClashes(forUser, clashTest string, filter *clashtest.ClashFilter, offset, limit int, sortBy clashtest.SortBy) ([]*clashtest.Clash, int, error) {
+	if clashTest != "ct" {
+		return nil, 0, errors.New("clash test not found")
+	}
+	c.filter = filter
+	res := []*clashtest.Clash{{Id: "a", ClashTest: clashTest}, {Id: "b", ClashTest: clashTest}}
+	return res[offset:], len(res), nil
+}
+
+func (c *testClashes) GetClashGroups(forUser, clashTest string, filter *clashtest.ClashFilter, groupBy clashtest.GroupBy, offset, limit int) ([]*clashtest.ClashGroup, int, error) {
+	c.filter = filter
+	return []*clashtest.ClashGroup{{Id: string(groupBy), Count: 2}}, 1, nil
+}
+
+func (c *testClashes) SetClashStatus(forUser string, ids []string, status clashtest.ClashStatus) error {
+	for _, id := range ids {
+		c.statuses[id] = status
+	}
+	return nil
+}
+
+func (c *testClashes) SetClashAssignee(forUser string, ids []string, assignee string) error {
+	for _, id := range ids {
+		if id != "a" && id != "b" {
+			return errors.New("clash not found")
+		}
+		c.assignee[id] = assignee
+	}
+	return nil
+}
+
+func (c *testClashes) AddClashComment(forUser, clash, body string) (*clashtest.ClashComment, error) {
+	comment := &clashtest.ClashComment{Id: strconv.Itoa(len(c.comments)), Clash: clash, User: forUser, Body: body}
+	c.comments = append(c.comments, comment)
+	return comment, nil
+}
+
+func (c *testClashes) GetClashComments(forUser, clash string, offset, limit int) ([]*clashtest.ClashComment, int, error) {
+	return c.comments[offset:], len(c.comments), nil
+}
+
+func TestClashTestGetClashes(t *testing.T) {
+	c := newTestClashCore()
+	w := httptest.NewRecorder()
+	if err := clashTestGetClashes(c, "u", nil, w, testJsonRequest(nil, `{"clashTest":"ct","offset":1,"minDistance":0.5,"statuses":["new","active"]}`), nil); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(w.Body.String(), `"totalResults":2`) || !strings.Contains(w.Body.String(), `"id":"b"`) || strings.Contains(w.Body.String(), `"id":"a"`) {
+		t.Fatalf("got %s", w.Body.String())
+	} else if f := c.clashes.filter; f.MinDistance == nil || *f.MinDistance != 0.5 || f.MaxDistance != nil || len(f.Statuses) != 2 {
+		t.Fatalf("filter %+v", f)
+	}
+	for _, body := range []string{`{"clashTest":"ct","statuses":["done"]}`, `{"clashTest":"ct","after":"x"}`} {
+		err := clashTestGetClashes(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, body), nil)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+	if err := clashTestGetClashes(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"clashTest":"x"}`), nil); err == nil {
+		t.Fatal("listed the clashes of an unknown clash test")
+	}
+}
+
+func TestClashTestGetClashGroups(t *testing.T) {
+	c := newTestClashCore()
+	w := httptest.NewRecorder()
+	if err := clashTestGetClashGroups(c, "u", nil, w, testJsonRequest(nil, `{"clashTest":"ct","groupBy":"level","categories":["Walls"]}`), nil); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(w.Body.String(), `"id":"level"`) || len(c.clashes.filter.Categories) != 1 {
+		t.Fatalf("got %s, filter %+v", w.Body.String(), c.clashes.filter)
+	}
+	for _, body := range []string{`{"clashTest":"ct"}`, `{"clashTest":"ct","groupBy":"category"}`, `{"clashTest":"ct","groupBy":"element","statuses":["done"]}`} {
+		err := clashTestGetClashGroups(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, body), nil)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+}
+
+func TestClashTestClashWorkflow(t *testing.T) {
+	c := newTestClashCore()
+	if err := clashTestSetClashStatus(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["a","b"],"status":"reviewed"}`), nil); err != nil || c.clashes.statuses["b"] != clashtest.Reviewed {
+		t.Fatalf("statuses %v %v", c.clashes.statuses, err)
+	}
+	err := clashTestSetClashStatus(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["a"],"status":"closed"}`), nil)
+	assertStatus(t, err, http.StatusBadRequest)
+
+	if err := clashTestSetClashAssignee(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["a"],"assignee":"v"}`), nil); err != nil || c.clashes.assignee["a"] != "v" {
+		t.Fatalf("assignees %v %v", c.clashes.assignee, err)
+	} else if err := clashTestSetClashAssignee(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"ids":["x"],"assignee":"v"}`), nil); err == nil {
+		t.Fatal("assigned an unknown clash")
+	}
+
+	w := httptest.NewRecorder()
+	if err := clashTestAddClashComment(c, "u", nil, w, testJsonRequest(nil, `{"clash":"a","body":"moved the duct"}`), nil); err != nil || !strings.Contains(w.Body.String(), `"user":"u"`) {
+		t.Fatalf("got %s %v", w.Body.String(), err)
+	}
+	err = clashTestAddClashComment(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"clash":"a","body":" \n"}`), nil)
+	assertStatus(t, err, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	if err := clashTestGetClashComments(c, "u", nil, w, testJsonRequest(nil, `{"clash":"a"}`), nil); err != nil || !strings.Contains(w.Body.String(), `"body":"moved the duct"`) {
+		t.Fatalf("got %s %v", w.Body.String(), err)
+	}
+	err = clashTestGetClashComments(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"clash":"a","skipTotal":true}`), nil)
+	assertStatus(t, err, http.StatusBadRequest)
+}
+
+// testTranslationCore has document versions "ok", a success, "failed" and
+// "unregistered", which failed to register, in project "p".
+type testTranslationCore struct {
+	core.CoreApi
+	versions *testTranslationVersions
+}
+
+type testTranslationVersions struct {
+	documentversion.DocumentVersionApi
+	byId     map[string]*documentversion.DocumentVersion
+	statuses []documentversion.Status
+}
+
+func newTestTranslationCore() *testTranslationCore {
+	return &testTranslationCore{versions: &testTranslationVersions{byId: map[string]*documentversion.DocumentVersion{
+		"ok":           {Id: "ok", Project: "p", Status: documentversion.Success},
+		"failed":       {Id: "failed", Project: "p", Status: documentversion.Failed},
+		"unregistered": {Id: "unregistered", Project: "p", Status: documentversion.FailedToRegister},
+	}}}
+}
+
+func (c *testTranslationCore) DocumentVersion() documentversion.DocumentVersionApi { return c.versions }
+
+func (v *testTranslationVersions) Get(forUser string, ids []string) ([]*documentversion.DocumentVersion, error) {
+	res := []*documentversion.DocumentVersion{}
+	for _, id := range ids {
+		if dv, exists := v.byId[id]; exists {
+			res = append(res, dv)
+		}
+	}
+	return res, nil
+}
+
+func (v *testTranslationVersions) GetTranslationProgress(forUser, id string) (*documentversion.TranslationProgress, error) {
+	if dv, exists := v.byId[id]; !exists {
+		return nil, errors.New("document version not found")
+	} else {
+		return &documentversion.TranslationProgress{Status: dv.Status, Progress: 100, Messages: []*documentversion.TranslationMessage{{Type: "warning", Message: "missing xrefs"}}}, nil
+	}
+}
+
+func (v *testTranslationVersions) RetryTranslation(forUser, id string) (*documentversion.DocumentVersion, error) {
+	v.byId[id].Status = documentversion.Pending
+	return v.byId[id], nil
+}
+
+func (v *testTranslationVersions) GetForProject(forUser, project string, statuses []documentversion.Status, offset, limit int, sortBy documentversion.SortBy) ([]*documentversion.DocumentVersion, int, error) {
+	v.statuses = statuses
+	res := []*documentversion.DocumentVersion{}
+	for _, id := range []string{"failed", "ok", "unregistered"} {
+		for _, status := range statuses {
+			if v.byId[id].Status == status {
+				res = append(res, v.byId[id])
+			}
+		}
+	}
+	return res, len(res), nil
+}
+
+func TestDocumentVersionGetTranslationProgress(t *testing.T) {
+	c := newTestTranslationCore()
+	w := httptest.NewRecorder()
+	if err := documentVersionGetTranslationProgress(c, "u", nil, w, testJsonRequest(nil, `{"id":"ok"}`), nil); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(w.Body.String(), `"progress":100`) || !strings.Contains(w.Body.String(), `"message":"missing xrefs"`) {
+		t.Fatalf("got %s", w.Body.String())
+	}
+	if err := documentVersionGetTranslationProgress(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, `{"id":"x"}`), nil); err == nil {
+		t.Fatal("got the progress of an unknown version")
+	}
+}
+
+func TestDocumentVersionRetryTranslation(t *testing.T) {
+	c := newTestTranslationCore()
+	opts := newOptions(nil)
+	opts.watcher = newStatusWatcher(c, opts, nil)
+	// marked running so the test doesn't start polling the fake core
+	opts.watcher.running = true
+	sub, _, _ := opts.events.subscribe("", allEvents)
+	for _, id := range []string{"failed", "unregistered"} {
+		w := httptest.NewRecorder()
+		if err := documentVersionRetryTranslation(c, "u", nil, w, testJsonRequest(opts, `{"id":"`+id+`"}`), nil); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(w.Body.String(), `"status":"pending"`) || opts.watcher.translations[id] == nil {
+			t.Fatalf("%s: got %s, watching %v", id, w.Body.String(), opts.watcher.translations)
+		}
+	}
+	assertEvents(t, sub, translationStatusChanged, translationStatusChanged)
+
+	err := documentVersionRetryTranslation(c, "u", nil, httptest.NewRecorder(), testJsonRequest(opts, `{"id":"ok"}`), nil)
+	assertStatus(t, err, http.StatusConflict)
+	// a retried translation can't be retried again until it fails
+	err = documentVersionRetryTranslation(c, "u", nil, httptest.NewRecorder(), testJsonRequest(opts, `{"id":"failed"}`), nil)
+	assertStatus(t, err, http.StatusConflict)
+	err = documentVersionRetryTranslation(c, "u", nil, httptest.NewRecorder(), testJsonRequest(opts, `{"id":"x"}`), nil)
+	assertStatus(t, err, http.StatusNotFound)
+	assertEvents(t, sub)
+}
+
+func TestDocumentVersionGetForProject(t *testing.T) {
+	c := newTestTranslationCore()
+	w := httptest.NewRecorder()
+	if err := documentVersionGetForProject(c, "u", nil, w, testJsonRequest(nil, `{"project":"p","statuses":["failed","failed_to_register"]}`), nil); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(w.Body.String(), `"totalResults":2`) || strings.Contains(w.Body.String(), `"id":"ok"`) {
+		t.Fatalf("got %s", w.Body.String())
+	} else if len(c.versions.statuses) != 2 || c.versions.statuses[1] != documentversion.FailedToRegister {
+		t.Fatalf("statuses %v", c.versions.statuses)
+	}
+	for _, body := range []string{`{"project":"p","statuses":["broken"]}`, `{"project":"p","before":"x"}`} {
+		err := documentVersionGetForProject(c, "u", nil, httptest.NewRecorder(), testJsonRequest(nil, body), nil)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/project"
+	"github.com/modelhub/core/treenode"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultLockDuration = 8 * time.Hour
+	maxLockDuration     = 7 * 24 * time.Hour
+)
+
+// lockOverrideRoles may release locks held by other project members.
+var lockOverrideRoles = []project.Role{project.Owner, project.Admin}
+
+// lockActive reports whether lock is held at now, core keeps expired locks
+// until they're replaced so expiry is always checked against the clock. An
+// unparseable expiry is treated as held.
+func lockActive(lock *treenode.Lock, now time.Time) bool {
+	if lock == nil {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, lock.Expires)
+	return err != nil || now.Before(expires)
+}
+
+// clearExpiredLocks drops expired locks from nodes so responses only show
+// locks that are still held.
+func clearExpiredLocks(nodes []*treenode.TreeNode, now time.Time) {
+	for _, node := range nodes {
+		if !lockActive(node.Lock, now) {
+			node.Lock = nil
+		}
+	}
+}
+
+// clearExpiredTrashedLocks is clearExpiredLocks for trashed nodes.
+func clearExpiredTrashedLocks(nodes []*treenode.TrashedNode, now time.Time) {
+	for _, node := range nodes {
+		if !lockActive(node.Lock, now) {
+			node.Lock = nil
+		}
+	}
+}
+
+// getTreeNodesAt is TreeNode().Get with locks expired at now cleared.
+func getTreeNodesAt(coreApi core.CoreApi, forUser string, ids []string, now time.Time) ([]*treenode.TreeNode, error) {
+	nodes, err := coreApi.TreeNode().Get(forUser, ids)
+	clearExpiredLocks(nodes, now)
+	return nodes, err
+}
+
+// getParentsAt is TreeNode().GetParents with locks expired at now cleared.
+func getParentsAt(coreApi core.CoreApi, forUser string, id string, now time.Time) ([]*treenode.TreeNode, error) {
+	nodes, err := coreApi.TreeNode().GetParents(forUser, id)
+	clearExpiredLocks(nodes, now)
+	return nodes, err
+}
+
+// getDocumentLock returns the document node and its active lock, which is nil
+// if it isn't locked.
+func getDocumentLock(coreApi core.CoreApi, forUser string, document string, now time.Time) (*treenode.TreeNode, *treenode.Lock, error) {
+	if nodes, err := getTreeNodesAt(coreApi, forUser, []string{document}, now); err != nil {
+		return nil, nil, err
+	} else if len(nodes) == 0 {
+		return nil, nil, newHttpError(http.StatusNotFound, errors.New("document not found"))
+	} else {
+		return nodes[0], nodes[0].Lock, nil
+	}
+}
+
+// checkDocumentLock returns a conflict error if document is locked by anyone
+// other than forUser. It only lets a request fail early, writes guarded by a
+// lock must use a core call that checks it atomically.
+func checkDocumentLock(coreApi core.CoreApi, forUser string, document string, now time.Time) error {
+	if _, lock, err := getDocumentLock(coreApi, forUser, document, now); err != nil {
+		return err
+	} else if lock != nil && lock.Owner != forUser {
+		return lockConflict(lock)
+	}
+	return nil
+}
+
+func lockConflict(lock *treenode.Lock) error {
+	return newHttpError(http.StatusConflict, fmt.Errorf("document is locked by %s until %s", lock.Owner, lock.Expires))
+}
+
+// lockDuration checks seconds against the maximum before converting it, large
+// values would overflow time.Duration.
+func lockDuration(seconds int) (time.Duration, error) {
+	if maxSeconds := int(maxLockDuration / time.Second); seconds == 0 {
+		return defaultLockDuration, nil
+	} else if seconds < 0 || seconds > maxSeconds {
+		return 0, newHttpError(http.StatusBadRequest, fmt.Errorf("lock duration must be between 1 and %d seconds", maxSeconds))
+	} else {
+		return time.Duration(seconds) * time.Second, nil
+	}
+}
@@ -0,0 +1,98 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/project"
+	"github.com/modelhub/core/treenode"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockDuration(t *testing.T) {
+	if d, err := lockDuration(0); err != nil || d != defaultLockDuration {
+		t.Fatalf("got %v %v", d, err)
+	} else if d, err := lockDuration(int(maxLockDuration / time.Second)); err != nil || d != maxLockDuration {
+		t.Fatalf("got %v %v", d, err)
+	}
+	// math.MaxInt64/1e9+1 seconds wraps to a negative time.Duration
+	for _, seconds := range []int{-1, int(maxLockDuration/time.Second) + 1, math.MaxInt64/int(time.Second) + 1, math.MaxInt64} {
+		_, err := lockDuration(seconds)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+}
+
+// testLockCore holds one lock on document "d" by "owner".
+type testLockCore struct {
+	core.CoreApi
+	nodes *testLockNodes
+}
+
+type testLockNodes struct {
+	treenode.TreeNodeApi
+	roles map[string]project.Role
+	lock  *treenode.Lock
+}
+
+func (c *testLockCore) TreeNode() treenode.TreeNodeApi { return c.nodes }
+
+func (n *testLockNodes) TryUnlock(forUser, id string, overrideRoles []project.Role, at time.Time) (*treenode.Lock, bool, error) {
+	if n.lock == nil || n.lock.Owner == forUser {
+		n.lock = nil
+		return nil, true, nil
+	}
+	for _, role := range overrideRoles {
+		if n.roles[forUser] == role {
+			n.lock = nil
+			return nil, true, nil
+		}
+	}
+	return n.lock, false, nil
+}
+
+func TestTreeNodeUnlock(t *testing.T) {
+	for _, c := range []struct {
+		user   string
+		force  bool
+		status int
+	}{
+		{"owner", false, http.StatusOK},
+		{"other", false, http.StatusConflict},
+		{"other", true, http.StatusForbidden},
+		{"admin", false, http.StatusConflict},
+		{"admin", true, http.StatusOK},
+	} {
+		nodes := &testLockNodes{
+			roles: map[string]project.Role{"owner": project.Contributor, "other": project.Organiser, "admin": project.Admin},
+			lock:  &treenode.Lock{Document: "d", Owner: "owner"},
+		}
+		r := testJsonRequest(nil, fmt.Sprintf(`{"id": "d", "force": %v}`, c.force))
+		err := treeNodeUnlock(&testLockCore{nodes: nodes}, c.user, nil, httptest.NewRecorder(), r, nil)
+		if c.status == http.StatusOK {
+			if err != nil || nodes.lock != nil {
+				t.Errorf("%s force %v: got %v, lock %v", c.user, c.force, err, nodes.lock)
+			}
+		} else if assertStatus(t, err, c.status); nodes.lock == nil {
+			t.Errorf("%s force %v released the lock", c.user, c.force)
+		}
+	}
+}
+
+func TestClearExpiredLocks(t *testing.T) {
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	held := &treenode.Lock{Expires: now.Add(time.Minute).Format(time.RFC3339)}
+	expired := &treenode.Lock{Expires: now.Format(time.RFC3339)}
+	nodes := []*treenode.TreeNode{{Lock: held}, {Lock: expired}, {}}
+	clearExpiredLocks(nodes, now)
+	if nodes[0].Lock != held || nodes[1].Lock != nil || nodes[2].Lock != nil {
+		t.Fatalf("locks %v %v %v", nodes[0].Lock, nodes[1].Lock, nodes[2].Lock)
+	}
+	trashed := []*treenode.TrashedNode{{TreeNode: treenode.TreeNode{Lock: held}}, {TreeNode: treenode.TreeNode{Lock: expired}}}
+	clearExpiredTrashedLocks(trashed, now)
+	if trashed[0].Lock != held || trashed[1].Lock != nil {
+		t.Fatalf("locks %v %v", trashed[0].Lock, trashed[1].Lock)
+	}
+}
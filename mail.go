@@ -0,0 +1,234 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/modelhub/core/project"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender delivers plain text mails, used to send project email invites.
+type MailSender interface {
+	Send(mail *Mail) error
+}
+
+type smtpMailSender struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSmtpMailSender sends mails through the SMTP server at addr (host:port),
+// auth may be nil if the server doesn't require it.
+func NewSmtpMailSender(addr string, auth smtp.Auth, from string) MailSender {
+	return &smtpMailSender{
+		addr: addr,
+		auth: auth,
+		from: from,
+	}
+}
+
+func (s *smtpMailSender) Send(mail *Mail) error {
+	if strings.ContainsAny(mail.To+mail.Subject, "\r\n") {
+		return errors.New("mail headers may not contain line breaks")
+	}
+	msg := &bytes.Buffer{}
+	msg.WriteString("From: " + s.from + "\r\n")
+	msg.WriteString("To: " + mail.To + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", mail.Subject) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(mail.Body, "\n", "\r\n", -1))
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{mail.To}, msg.Bytes())
+}
+
+// MemoryMailSender keeps sent mails in memory instead of delivering them, for
+// use in tests and local development.
+type MemoryMailSender struct {
+	mtx  sync.Mutex
+	sent []*Mail
+}
+
+func NewMemoryMailSender() *MemoryMailSender {
+	return &MemoryMailSender{}
+}
+
+func (s *MemoryMailSender) Send(mail *Mail) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sent = append(s.sent, mail)
+	return nil
+}
+
+// Sent returns the mails sent so far, oldest first.
+func (s *MemoryMailSender) Sent() []*Mail {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*Mail(nil), s.sent...)
+}
+
+// emailInvite is an invite as returned to project admins, the token is left out
+// as whoever holds it can accept the invite.
+type emailInvite struct {
+	Project   string       `json:"project"`
+	Email     string       `json:"email"`
+	Role      project.Role `json:"role"`
+	Message   string       `json:"message"`
+	InvitedBy string       `json:"invitedBy"`
+	Expires   string       `json:"expires"`
+}
+
+func toEmailInvites(invites []*project.EmailInvite) []*emailInvite {
+	res := make([]*emailInvite, 0, len(invites))
+	for _, invite := range invites {
+		res = append(res, &emailInvite{
+			Project:   invite.Project,
+			Email:     invite.Email,
+			Role:      invite.Role,
+			Message:   invite.Message,
+			InvitedBy: invite.InvitedBy,
+			Expires:   invite.Expires,
+		})
+	}
+	return res
+}
+
+// emailInviteResult reports whether an address was sent its invite, Error is
+// the log id of the failure if not.
+type emailInviteResult struct {
+	Email  string       `json:"email"`
+	Sent   bool         `json:"sent"`
+	Invite *emailInvite `json:"invite,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+func parseEmails(emails []string) ([]string, error) {
+	parsed := make([]string, 0, len(emails))
+	for _, email := range emails {
+		if addr, err := mail.ParseAddress(email); err != nil {
+			return nil, fmt.Errorf("invalid email %q", email)
+		} else {
+			parsed = append(parsed, strings.ToLower(addr.Address))
+		}
+	}
+	return parsed, nil
+}
+
+const maxInviteMessageLength = 2000
+
+// checkInviteMessage rejects personal messages over maxInviteMessageLength.
+func checkInviteMessage(message string) error {
+	if utf8.RuneCountInString(message) > maxInviteMessageLength {
+		return newHttpError(http.StatusBadRequest, fmt.Errorf("message is longer than %d characters", maxInviteMessageLength))
+	}
+	return nil
+}
+
+// signInviteToken binds core's invite token to the invite's expiry with key, so
+// links are checked and expired before reaching core.
+func signInviteToken(key []byte, token string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(token)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(inviteTokenMac(key, payload))
+}
+
+// verifyInviteToken returns core's invite token from a token signed with key,
+// 400 if it wasn't signed with key and 410 if it expired before now.
+func verifyInviteToken(key []byte, signed string, now time.Time) (string, error) {
+	invalid := newHttpError(http.StatusBadRequest, errors.New("invalid invite token"))
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", invalid
+	}
+	payload := signed[:i]
+	if mac, err := base64.RawURLEncoding.DecodeString(signed[i+1:]); err != nil || !hmac.Equal(mac, inviteTokenMac(key, payload)) {
+		return "", invalid
+	}
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return "", invalid
+	} else if token, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return "", invalid
+	} else if expires, err := strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return "", invalid
+	} else if !now.Before(time.Unix(expires, 0)) {
+		return "", newHttpError(http.StatusGone, errors.New("invite has expired"))
+	} else {
+		return string(token), nil
+	}
+}
+
+func inviteTokenMac(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// mailLine makes s safe to use in a header or a line of its own, user supplied
+// names may contain line breaks and other control characters.
+func mailLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// mailText drops the control characters other than line breaks from s and
+// normalizes its line breaks to \n.
+func mailText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		} else if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.Replace(s, "\r\n", "\n", -1))
+}
+
+// newInviteMail is the mail inviting invite.Email, token is the signed token
+// to link to acceptUrl with.
+func newInviteMail(acceptUrl string, token string, invite *project.EmailInvite, projectName string, inviterName string) *Mail {
+	link := acceptUrl
+	if u, err := url.Parse(acceptUrl); err == nil {
+		q := u.Query()
+		q.Set("token", token)
+		u.RawQuery = q.Encode()
+		link = u.String()
+	}
+	projectName, inviterName = mailLine(projectName), mailLine(inviterName)
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "%s has invited you to join the project \"%s\" on modelhub as %s.\n\n", inviterName, projectName, mailLine(string(invite.Role)))
+	if message := mailText(invite.Message); message != "" {
+		fmt.Fprintf(body, "%s\n\n", message)
+	}
+	fmt.Fprintf(body, "To accept, sign in or create an account through this link:\n%s\n\n", link)
+	fmt.Fprintf(body, "The link can only be used once and expires on %s.\n", mailLine(invite.Expires))
+	return &Mail{
+		To:      invite.Email,
+		Subject: fmt.Sprintf("%s invited you to %s on modelhub", inviterName, projectName),
+		Body:    body.String(),
+	}
+}
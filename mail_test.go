@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/project"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testInviteKey = []byte("test key")
+
+func TestInviteToken(t *testing.T) {
+	now := time.Unix(1000, 0)
+	signed := signInviteToken(testInviteKey, "core.token", now.Add(time.Hour))
+	if token, err := verifyInviteToken(testInviteKey, signed, now); err != nil || token != "core.token" {
+		t.Fatalf("got %q %v", token, err)
+	}
+	_, err := verifyInviteToken(testInviteKey, signed, now.Add(time.Hour))
+	assertStatus(t, err, http.StatusGone)
+	for _, invalid := range []string{
+		"",
+		"core.token",
+		signInviteToken([]byte("other key"), "core.token", now.Add(time.Hour)),
+		strings.Replace(signed, ".", ".9", 1),
+		signed + "x",
+	} {
+		_, err := verifyInviteToken(testInviteKey, invalid, now)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+}
+
+func TestNewInviteMail(t *testing.T) {
+	invite := &project.EmailInvite{Email: "a@example.com", Role: project.Contributor, Message: "Hi,\r\nwelcome\x00\x1b[31m", Expires: "2016-01-02"}
+	m := newInviteMail("https://modelhub.example.com/accept?x=1", "signed", invite, "Tower\r\nBcc: b@example.com", "Ann")
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		t.Fatalf("subject %q has line breaks", m.Subject)
+	} else if !strings.Contains(m.Body, "Hi,\nwelcome[31m\n") || strings.ContainsAny(m.Body, "\r\x00\x1b") {
+		t.Fatalf("body %q", m.Body)
+	} else if !strings.Contains(m.Body, "https://modelhub.example.com/accept?token=signed&x=1") {
+		t.Fatalf("body %q has no link", m.Body)
+	}
+}
+
+func TestProjectInviteByEmailLimitsMessage(t *testing.T) {
+	opts := newOptions([]Option{WithEmailInvites(NewMemoryMailSender(), "https://modelhub.example.com/accept", testInviteKey, 0)})
+	r := testJsonRequest(opts, `{"id": "p", "role": "observer", "emails": ["a@example.com"], "message": "`+strings.Repeat("x", maxInviteMessageLength+1)+`"}`)
+	err := projectInviteByEmail(nil, "u", nil, httptest.NewRecorder(), r, nil)
+	assertStatus(t, err, http.StatusBadRequest)
+}
+
+// testInviteCore accepts the core token "core.token" into project "p".
+type testInviteCore struct {
+	core.CoreApi
+	projects testInviteProjects
+}
+
+type testInviteProjects struct {
+	project.ProjectApi
+}
+
+func (c *testInviteCore) Project() project.ProjectApi { return c.projects }
+
+func (testInviteProjects) AcceptEmailInvite(forUser, token string) (*project.Project, error) {
+	if token != "core.token" {
+		return nil, newHttpError(http.StatusNotFound, nil)
+	}
+	return &project.Project{Id: "p"}, nil
+}
+
+func TestProjectAcceptEmailInvite(t *testing.T) {
+	now := time.Unix(1000, 0)
+	opts := newOptions([]Option{
+		WithEmailInvites(NewMemoryMailSender(), "https://modelhub.example.com/accept", testInviteKey, 0),
+		WithClock(func() time.Time { return now }),
+	})
+	accept := func(token string) error {
+		r := testJsonRequest(opts, `{"token": "`+token+`"}`)
+		return projectAcceptEmailInvite(&testInviteCore{}, "u", nil, httptest.NewRecorder(), r, nil)
+	}
+	if err := accept(signInviteToken(testInviteKey, "core.token", now.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, accept("core.token"), http.StatusBadRequest)
+	assertStatus(t, accept(signInviteToken(testInviteKey, "core.token", now)), http.StatusGone)
+
+	r := testJsonRequest(nil, `{"token": "core.token"}`)
+	err := projectAcceptEmailInvite(&testInviteCore{}, "u", nil, httptest.NewRecorder(), r, nil)
+	assertStatus(t, err, http.StatusNotImplemented)
+}
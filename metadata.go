@@ -0,0 +1,246 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/metadata"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var metadataFieldName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,63}$`)
+
+const (
+	maxTags      = 50
+	maxTagLength = 64
+)
+
+func validateMetadataSchema(fields []*metadata.Field) error {
+	names := map[string]bool{}
+	for _, field := range fields {
+		if !metadataFieldName.MatchString(field.Name) {
+			return fmt.Errorf("invalid metadata field name %q, names must start with a letter and contain only letters, digits and underscores", field.Name)
+		} else if names[field.Name] {
+			return fmt.Errorf("duplicate metadata field %q", field.Name)
+		}
+		names[field.Name] = true
+		switch field.Type {
+		case metadata.String, metadata.Number, metadata.Bool, metadata.Date:
+			if len(field.Enum) > 0 {
+				return fmt.Errorf("metadata field %q has enum values but is not of type enum", field.Name)
+			}
+		case metadata.Enum:
+			if len(field.Enum) == 0 {
+				return fmt.Errorf("metadata field %q is of type enum but has no enum values", field.Name)
+			}
+		case metadata.Tags:
+			// enum values are optional and restrict the tags that may be used
+			for _, e := range field.Enum {
+				if _, err := tagValue(field, e); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("metadata field %q has invalid type %q", field.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// metadataValue checks v is valid for field, numbers may be given as strings
+// as they are when filtering with query params and a single tag as a string.
+// nil is always valid and clears the value.
+func metadataValue(field *metadata.Field, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	invalid := fmt.Errorf("invalid value %v for %s metadata field %q", v, field.Type, field.Name)
+	switch field.Type {
+	case metadata.Number:
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case string:
+			if f, err := strconv.ParseFloat(n, 64); err == nil {
+				return f, nil
+			}
+		}
+	case metadata.Bool:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if parsed, err := strconv.ParseBool(b); err == nil {
+				return parsed, nil
+			}
+		}
+	case metadata.Date:
+		if s, ok := v.(string); ok {
+			if _, err := time.Parse(time.RFC3339, s); err == nil {
+				return s, nil
+			}
+		}
+	case metadata.Enum:
+		if s, ok := v.(string); ok {
+			for _, e := range field.Enum {
+				if s == e {
+					return s, nil
+				}
+			}
+		}
+	case metadata.Tags:
+		switch t := v.(type) {
+		case string:
+			return tagsValue(field, []interface{}{t})
+		case []interface{}:
+			return tagsValue(field, t)
+		}
+	default:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, invalid
+}
+
+// tagsValue trims and dedupes tags, keeping their order.
+func tagsValue(field *metadata.Field, tags []interface{}) ([]string, error) {
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("metadata field %q may have at most %d tags", field.Name, maxTags)
+	}
+	res := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, t := range tags {
+		s, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %v for metadata field %q", t, field.Name)
+		}
+		tag, err := tagValue(field, s)
+		if err != nil {
+			return nil, err
+		} else if !seen[tag] {
+			seen[tag] = true
+			res = append(res, tag)
+		}
+	}
+	return res, nil
+}
+
+func tagValue(field *metadata.Field, s string) (string, error) {
+	tag := strings.TrimSpace(s)
+	if tag == "" || len(tag) > maxTagLength {
+		return "", fmt.Errorf("tags of metadata field %q must be between 1 and %d characters", field.Name, maxTagLength)
+	} else if len(field.Enum) == 0 {
+		return tag, nil
+	}
+	for _, e := range field.Enum {
+		if tag == e {
+			return tag, nil
+		}
+	}
+	return "", fmt.Errorf("invalid tag %q for metadata field %q", tag, field.Name)
+}
+
+func metadataField(schema []*metadata.Field, name string) *metadata.Field {
+	for _, field := range schema {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+func validateMetadataValues(schema []*metadata.Field, values map[string]interface{}) error {
+	for name, v := range values {
+		if field := metadataField(schema, name); field == nil {
+			return fmt.Errorf("unknown metadata field %q", name)
+		} else if parsed, err := metadataValue(field, v); err != nil {
+			return err
+		} else {
+			values[name] = parsed
+		}
+	}
+	return nil
+}
+
+// parseMetadataFilter parses "field=value" filters, all of which must match.
+func parseMetadataFilter(coreApi core.CoreApi, forUser string, project string, filters []string) (metadata.Filter, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	schema, err := coreApi.Project().GetMetadataSchema(forUser, project)
+	if err != nil {
+		return nil, err
+	}
+	filter := metadata.Filter{}
+	for _, f := range filters {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("invalid metadata filter %q, expected field=value", f))
+		} else if field := metadataField(schema, parts[0]); field == nil {
+			return nil, newHttpError(http.StatusBadRequest, fmt.Errorf("unknown metadata field %q", parts[0]))
+		} else if v, err := metadataValue(field, parts[1]); err != nil {
+			return nil, newHttpError(http.StatusBadRequest, err)
+		} else {
+			filter[field.Name] = v
+		}
+	}
+	return filter, nil
+}
+
+// nodesProject returns the project all the given nodes belong to, metadata is
+// validated against a single project's schema so bulk edits may not span
+// projects. Repeated ids are only looked up once.
+func nodesProject(coreApi core.CoreApi, forUser string, ids []string) (string, error) {
+	ids, err := uniqueNodeIds(ids)
+	if err != nil {
+		return "", err
+	}
+	nodes, err := coreApi.TreeNode().Get(forUser, ids)
+	if err != nil {
+		return "", err
+	} else if len(nodes) != len(ids) {
+		return "", newHttpError(http.StatusNotFound, errors.New("tree node not found"))
+	}
+	project := ""
+	for _, node := range nodes {
+		if project != "" && node.Project != project {
+			return "", newHttpError(http.StatusBadRequest, errors.New("tree nodes must all be in the same project"))
+		}
+		project = node.Project
+	}
+	return project, nil
+}
+
+func uniqueNodeIds(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, newHttpError(http.StatusBadRequest, errors.New("no tree node ids given"))
+	}
+	res := make([]string, 0, len(ids))
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" {
+			return nil, newHttpError(http.StatusBadRequest, errors.New("tree node ids must not be empty"))
+		} else if !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+	return res, nil
+}
+
+// parseNodeMetadataFilter is parseMetadataFilter for the project of the given
+// node.
+func parseNodeMetadataFilter(coreApi core.CoreApi, forUser string, node string, filters []string) (metadata.Filter, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	} else if project, err := nodesProject(coreApi, forUser, []string{node}); err != nil {
+		return nil, err
+	} else {
+		return parseMetadataFilter(coreApi, forUser, project, filters)
+	}
+}
@@ -0,0 +1,97 @@
+package rest
+
+import (
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/metadata"
+	"github.com/modelhub/core/treenode"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagsMetadataValue(t *testing.T) {
+	free := &metadata.Field{Name: "tags", Type: metadata.Tags}
+	limited := &metadata.Field{Name: "tags", Type: metadata.Tags, Enum: []string{"a", "b"}}
+	for _, c := range []struct {
+		field *metadata.Field
+		v     interface{}
+		want  []string
+	}{
+		{free, []interface{}{" b ", "a", "b"}, []string{"b", "a"}},
+		{free, []interface{}{}, []string{}},
+		{free, "a", []string{"a"}},
+		{limited, []interface{}{"b"}, []string{"b"}},
+	} {
+		if got, err := metadataValue(c.field, c.v); err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v %v, want %v", c.v, got, err, c.want)
+		}
+	}
+	tooMany := make([]interface{}, maxTags+1)
+	for i := range tooMany {
+		tooMany[i] = "a"
+	}
+	for _, c := range []struct {
+		field *metadata.Field
+		v     interface{}
+	}{
+		{free, []interface{}{" "}},
+		{free, []interface{}{1.0}},
+		{free, []interface{}{strings.Repeat("a", maxTagLength+1)}},
+		{free, tooMany},
+		{free, true},
+		{limited, []interface{}{"c"}},
+	} {
+		if got, err := metadataValue(c.field, c.v); err == nil {
+			t.Errorf("%v: got %v", c.v, got)
+		}
+	}
+}
+
+func TestValidateTagsMetadataSchema(t *testing.T) {
+	if err := validateMetadataSchema([]*metadata.Field{{Name: "a", Type: metadata.Tags}, {Name: "b", Type: metadata.Tags, Enum: []string{"x"}}}); err != nil {
+		t.Fatal(err)
+	} else if err := validateMetadataSchema([]*metadata.Field{{Name: "a", Type: metadata.Tags, Enum: []string{""}}}); err == nil {
+		t.Fatal("accepted an empty tag")
+	}
+}
+
+// testMetadataCore has nodes "a" and "b" in project "p" and "c" in "q".
+type testMetadataCore struct {
+	core.CoreApi
+	nodes *testMetadataNodes
+}
+
+type testMetadataNodes struct {
+	treenode.TreeNodeApi
+	gets [][]string
+}
+
+func (c *testMetadataCore) TreeNode() treenode.TreeNodeApi { return c.nodes }
+
+func (n *testMetadataNodes) Get(forUser string, ids []string) ([]*treenode.TreeNode, error) {
+	n.gets = append(n.gets, ids)
+	projects := map[string]string{"a": "p", "b": "p", "c": "q"}
+	res := []*treenode.TreeNode{}
+	for _, id := range ids {
+		if project, exists := projects[id]; exists {
+			res = append(res, &treenode.TreeNode{Id: id, Project: project})
+		}
+	}
+	return res, nil
+}
+
+func TestNodesProject(t *testing.T) {
+	c := &testMetadataCore{nodes: &testMetadataNodes{}}
+	if project, err := nodesProject(c, "u", []string{"a", "b", "a"}); err != nil || project != "p" {
+		t.Fatalf("got %q %v", project, err)
+	} else if !reflect.DeepEqual(c.nodes.gets, [][]string{{"a", "b"}}) {
+		t.Fatalf("looked up %v", c.nodes.gets)
+	}
+	for _, ids := range [][]string{nil, {"a", ""}, {"a", "c"}} {
+		_, err := nodesProject(c, "u", ids)
+		assertStatus(t, err, http.StatusBadRequest)
+	}
+	_, err := nodesProject(c, "u", []string{"a", "x"})
+	assertStatus(t, err, http.StatusNotFound)
+}
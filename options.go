@@ -0,0 +1,249 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPrefix                   = "/api/v1"
+	defaultProjectDeleteGracePeriod = 30 * 24 * time.Hour
+	defaultEmailInviteTtl           = 14 * 24 * time.Hour
+)
+
+// Group identifies a set of endpoints that can be toggled or given their own
+// middleware as a unit.
+type Group string
+
+const (
+	UserGroup                Group = "user"
+	ProjectGroup             Group = "project"
+	TreeNodeGroup            Group = "treeNode"
+	DocumentVersionGroup     Group = "documentVersion"
+	ProjectSpaceVersionGroup Group = "projectSpaceVersion"
+	SheetGroup               Group = "sheet"
+	SheetTransformGroup      Group = "sheetTransform"
+	ClashTestGroup           Group = "clashTest"
+	IssueGroup               Group = "issue"
+	ViewpointGroup           Group = "viewpoint"
+	EventGroup               Group = "event"
+	RoomGroup                Group = "room"
+	HelperGroup              Group = "helper"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// Limits are applied to every request, zero values mean no limit.
+type Limits struct {
+	// MaxBodyBytes caps the size of request bodies, including uploads.
+	MaxBodyBytes int64
+	// MaxPageLimit caps the limit argument of list endpoints, it does not apply
+	// to streamed responses.
+	MaxPageLimit int
+	// MaxStreamResults is the most results a streamed list response may ask
+	// for, larger limits and a limit of zero are rejected with a 400. Defaults
+	// to 100 times MaxPageLimit.
+	MaxStreamResults int
+	// StreamChunkSize is the number of results fetched from core at a time when
+	// streaming a list response, defaults to 100.
+	StreamChunkSize int
+}
+
+func (l *Limits) maxStreamResults() int {
+	if l.MaxStreamResults > 0 {
+		return l.MaxStreamResults
+	}
+	return l.MaxPageLimit * defaultStreamPages
+}
+
+type Option func(*options)
+
+type options struct {
+	prefix          string
+	middleware      []Middleware
+	groupMiddleware map[Group][]Middleware
+	disabled        map[Group]bool
+	clock           func() time.Time
+	limits          Limits
+	codecs          map[string]Codec
+	cacheMaxAge     time.Duration
+
+	projectDeleteGracePeriod time.Duration
+	mailSender               MailSender
+	emailInviteUrl           string
+	emailInviteKey           []byte
+	emailInviteTtl           time.Duration
+	viewerUrl                string
+	propertyDbCacheSize      int
+	eventHistorySize         int
+	events                   *eventBus
+	rooms                    *roomHub
+	recentAccess             *accessThrottle
+	ctx                      context.Context
+	watcher                  *statusWatcher
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		prefix:          defaultPrefix,
+		groupMiddleware: map[Group][]Middleware{},
+		disabled:        map[Group]bool{},
+		clock:           time.Now,
+		codecs:          defaultCodecs(),
+		ctx:             context.Background(),
+
+		projectDeleteGracePeriod: defaultProjectDeleteGracePeriod,
+		emailInviteTtl:           defaultEmailInviteTtl,
+		propertyDbCacheSize:      defaultPropertyDbCacheSize,
+		eventHistorySize:         defaultEventHistorySize,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.events = newEventBus(o.eventHistorySize, o.clock())
+	o.rooms = newRoomHub()
+	o.recentAccess = newAccessThrottle()
+	return o
+}
+
+// WithPrefix sets the path all endpoints are mounted under, defaults to "/api/v1".
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithMiddleware wraps every endpoint, the first middleware given is the outermost.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+// WithGroupMiddleware wraps every endpoint in group, inside any WithMiddleware middleware.
+func WithGroupMiddleware(group Group, mw ...Middleware) Option {
+	return func(o *options) {
+		o.groupMiddleware[group] = append(o.groupMiddleware[group], mw...)
+	}
+}
+
+// WithoutGroups disables the endpoints of the given groups, they will 404.
+func WithoutGroups(groups ...Group) Option {
+	return func(o *options) {
+		for _, group := range groups {
+			o.disabled[group] = true
+		}
+	}
+}
+
+// WithContext bounds the api's background work, polling core for translation
+// and clash test progress stops when ctx is done. Defaults to
+// context.Background().
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithClock replaces time.Now as the source of the current time.
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithLimits sets the request limits, by default there are none. Requests with
+// bodies over MaxBodyBytes are rejected with a 413.
+func WithLimits(limits Limits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+// WithCacheMaxAge sets how long GET responses may be cached for without being
+// revalidated, by default they are always revalidated against their ETag.
+// Responses are per session user so they are only ever cached privately, never
+// by shared caches (CDNs/proxies).
+func WithCacheMaxAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.cacheMaxAge = maxAge
+	}
+}
+
+// WithProjectDeleteGracePeriod sets how long after project/scheduleDelete is
+// called the project is permanently deleted, defaults to 30 days.
+func WithProjectDeleteGracePeriod(gracePeriod time.Duration) Option {
+	return func(o *options) {
+		o.projectDeleteGracePeriod = gracePeriod
+	}
+}
+
+// WithEmailInvites enables project/inviteByEmail, invites are sent with sender
+// and link to acceptUrl with the invite token added as a "token" query param,
+// the page there should have the user log in and then call
+// project/acceptEmailInvite with it. Tokens are signed with key, which must be
+// kept secret and be the same for every instance serving the api. Invites
+// expire after ttl, 14 days if ttl is zero.
+func WithEmailInvites(sender MailSender, acceptUrl string, key []byte, ttl time.Duration) Option {
+	return func(o *options) {
+		o.mailSender = sender
+		o.emailInviteUrl = acceptUrl
+		o.emailInviteKey = key
+		if ttl > 0 {
+			o.emailInviteTtl = ttl
+		}
+	}
+}
+
+// WithViewerUrl enables viewpoint permalinks, viewpoint/open/{id} redirects to
+// viewerUrl with viewpoint and sheet or projectSpaceVersion query params added.
+func WithViewerUrl(viewerUrl string) Option {
+	return func(o *options) {
+		o.viewerUrl = viewerUrl
+	}
+}
+
+// WithPropertyDbCacheSize sets how many parsed sheet property databases are
+// kept in memory for the sheet property endpoints, defaults to 8. Zero disables
+// caching.
+func WithPropertyDbCacheSize(size int) Option {
+	return func(o *options) {
+		o.propertyDbCacheSize = size
+	}
+}
+
+// WithEventHistorySize sets how many of the most recent events are kept for
+// event/stream clients resuming with Last-Event-ID, defaults to 1000. Clients
+// that have missed more are sent a reset event.
+func WithEventHistorySize(size int) Option {
+	return func(o *options) {
+		o.eventHistorySize = size
+	}
+}
+
+func chain(h http.Handler, mw []Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+type optionsKey struct{}
+
+func withOptions(r *http.Request, o *options) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), optionsKey{}, o))
+}
+
+// optionsFrom gives handlers and utils access to the options the api was
+// created with. Every request the api serves carries them, a request without
+// them is a bug as anything it published would be lost.
+func optionsFrom(r *http.Request) *options {
+	if r != nil {
+		if o, ok := r.Context().Value(optionsKey{}).(*options); ok {
+			return o
+		}
+	}
+	panic("rest: request has no api options")
+}
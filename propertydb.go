@@ -0,0 +1,466 @@
+package rest
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/session"
+	"github.com/modelhub/vada"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultPropertyDbCacheSize = 8
+	svfManifestName            = "manifest.json"
+	f2dManifestName            = "manifest.json.gz"
+	propertyDbFilePrefix       = "objects_"
+	propertyDbFileSuffix       = ".json.gz"
+	propertyDbHiddenFlag       = 1
+)
+
+// propertyDbFiles are the objects_*.json.gz files making up a property
+// database, all are required.
+var propertyDbFiles = []string{"attrs", "vals", "ids", "offs", "avs"}
+
+// propertyDb is a sheet's LMV property database. Every element (dbId) has a
+// range of avs, starting at 2*offs[dbId], holding pairs of indexes into attrs
+// and vals. Index 0 of every array is unused, dbIds start at 1.
+type propertyDb struct {
+	attrs []*propertyAttr
+	vals  []interface{}
+	ids   []interface{}
+	offs  []int
+	avs   []int
+
+	externalIdsOnce sync.Once
+	externalIds     map[string]int
+}
+
+type propertyAttr struct {
+	name        string
+	category    string
+	dataType    int
+	units       string
+	displayName string
+	hidden      bool
+}
+
+// internal attributes hold the element's name, category and references to
+// other elements rather than properties.
+func (a *propertyAttr) internal() bool {
+	return strings.HasPrefix(a.category, "__")
+}
+
+type propertyDbElement struct {
+	DbId       int                `json:"dbId"`
+	ExternalId string             `json:"externalId"`
+	Name       string             `json:"name"`
+	Category   string             `json:"category,omitempty"`
+	Properties []*elementProperty `json:"properties,omitempty"`
+}
+
+// elementProperty matches the property form the viewer's getProperties gives
+// so client code can be shared.
+type elementProperty struct {
+	DisplayName     string      `json:"displayName"`
+	DisplayCategory string      `json:"displayCategory"`
+	DisplayValue    interface{} `json:"displayValue"`
+	AttributeName   string      `json:"attributeName"`
+	Type            int         `json:"type"`
+	Units           string      `json:"units,omitempty"`
+	Hidden          bool        `json:"hidden,omitempty"`
+}
+
+type propertyDbCategory struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// eachValue calls fn with the attribute and value pairs set directly on dbId.
+func (db *propertyDb) eachValue(dbId int, fn func(attr *propertyAttr, val interface{})) {
+	if dbId <= 0 || dbId >= len(db.offs) {
+		return
+	}
+	start, end := 2*db.offs[dbId], len(db.avs)
+	if dbId+1 < len(db.offs) {
+		end = 2 * db.offs[dbId+1]
+	}
+	for i := start; i+1 < end && i+1 < len(db.avs); i += 2 {
+		attrIdx, valIdx := db.avs[i], db.avs[i+1]
+		if attrIdx > 0 && attrIdx < len(db.attrs) && db.attrs[attrIdx] != nil && valIdx >= 0 && valIdx < len(db.vals) {
+			fn(db.attrs[attrIdx], db.vals[valIdx])
+		}
+	}
+}
+
+// internalValue returns the value of an internal attribute, e.g. "__name__".
+func (db *propertyDb) internalValue(dbId int, category string) interface{} {
+	var res interface{}
+	db.eachValue(dbId, func(attr *propertyAttr, val interface{}) {
+		if res == nil && attr.category == category {
+			res = val
+		}
+	})
+	return res
+}
+
+// typeOf returns the dbId of the type dbId is an instance of, or 0.
+func (db *propertyDb) typeOf(dbId int) int {
+	if typeId, ok := db.internalValue(dbId, "__instanceof__").(float64); ok && int(typeId) != dbId {
+		return int(typeId)
+	}
+	return 0
+}
+
+// eachProperty calls fn with the properties of dbId. Like the viewer,
+// properties of the type an element is an instance of are merged in where the
+// element doesn't set them itself.
+func (db *propertyDb) eachProperty(dbId int, fn func(attr *propertyAttr, val interface{})) {
+	seen := map[*propertyAttr]bool{}
+	each := func(attr *propertyAttr, val interface{}) {
+		if !attr.internal() && !seen[attr] {
+			seen[attr] = true
+			fn(attr, val)
+		}
+	}
+	db.eachValue(dbId, each)
+	if typeId := db.typeOf(dbId); typeId != 0 {
+		db.eachValue(typeId, each)
+	}
+}
+
+// element returns dbId with its properties when withProperties is set.
+func (db *propertyDb) element(dbId int, withProperties bool) *propertyDbElement {
+	el := &propertyDbElement{
+		DbId:       dbId,
+		ExternalId: valueString(db.ids[dbId]),
+		Name:       valueString(db.internalValue(dbId, "__name__")),
+		Category:   valueString(db.internalValue(dbId, "__category__")),
+	}
+	if typeId := db.typeOf(dbId); el.Category == "" && typeId != 0 {
+		el.Category = valueString(db.internalValue(typeId, "__category__"))
+	}
+	if withProperties {
+		el.Properties = []*elementProperty{}
+		db.eachProperty(dbId, func(attr *propertyAttr, val interface{}) {
+			el.Properties = append(el.Properties, &elementProperty{
+				DisplayName:     attr.displayName,
+				DisplayCategory: attr.category,
+				DisplayValue:    val,
+				AttributeName:   attr.name,
+				Type:            attr.dataType,
+				Units:           attr.units,
+				Hidden:          attr.hidden,
+			})
+		})
+	}
+	return el
+}
+
+func (db *propertyDb) dbIdForExternalId(externalId string) (int, bool) {
+	db.externalIdsOnce.Do(func() {
+		db.externalIds = make(map[string]int, len(db.ids))
+		for dbId := 1; dbId < len(db.ids); dbId++ {
+			db.externalIds[valueString(db.ids[dbId])] = dbId
+		}
+	})
+	dbId, exists := db.externalIds[externalId]
+	return dbId, exists
+}
+
+// search returns the dbIds of elements with a property whose attribute or
+// display name is name and whose value is value, both case insensitive. An
+// empty name matches any property and an empty value any value.
+func (db *propertyDb) search(name string, value string) []int {
+	dbIds := []int{}
+	for dbId := 1; dbId < len(db.ids); dbId++ {
+		found := false
+		db.eachProperty(dbId, func(attr *propertyAttr, val interface{}) {
+			if !found &&
+				(name == "" || strings.EqualFold(attr.name, name) || strings.EqualFold(attr.displayName, name)) &&
+				(value == "" || strings.EqualFold(valueString(val), value)) {
+				found = true
+			}
+		})
+		if found {
+			dbIds = append(dbIds, dbId)
+		}
+	}
+	return dbIds
+}
+
+// categories counts the elements of each category in name order.
+func (db *propertyDb) categories() []*propertyDbCategory {
+	counts := map[string]int{}
+	for dbId := 1; dbId < len(db.ids); dbId++ {
+		if category := valueString(db.internalValue(dbId, "__category__")); category != "" {
+			counts[category]++
+		}
+	}
+	res := make([]*propertyDbCategory, 0, len(counts))
+	for name, count := range counts {
+		res = append(res, &propertyDbCategory{Name: name, Count: count})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func valueString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	default:
+		return fmt.Sprint(s)
+	}
+}
+
+// parsePropertyAttrs parses objects_attrs, each attribute is an array of
+// [name, category, dataType, dataTypeContext, description, displayName, flags,
+// displayPrecision], anything else (the version header at index 0) is nil.
+func parsePropertyAttrs(data []byte) ([]*propertyAttr, error) {
+	raw := []json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	attrs := make([]*propertyAttr, len(raw))
+	for i, r := range raw {
+		fields := []interface{}{}
+		if err := json.Unmarshal(r, &fields); err != nil || len(fields) == 0 {
+			continue
+		}
+		field := func(idx int) interface{} {
+			if idx < len(fields) {
+				return fields[idx]
+			}
+			return nil
+		}
+		attr := &propertyAttr{
+			name:        valueString(field(0)),
+			category:    valueString(field(1)),
+			units:       valueString(field(3)),
+			displayName: valueString(field(5)),
+		}
+		if dataType, ok := field(2).(float64); ok {
+			attr.dataType = int(dataType)
+		}
+		if flags, ok := field(6).(float64); ok {
+			attr.hidden = int(flags)&propertyDbHiddenFlag != 0
+		}
+		if attr.displayName == "" {
+			attr.displayName = attr.name
+		}
+		attrs[i] = attr
+	}
+	return attrs, nil
+}
+
+// propertyDbCache holds the most recently used parsed property databases by
+// sheet id, sheets never change once translated so entries don't expire.
+type propertyDbCache struct {
+	vada    vada.VadaClient
+	size    int
+	mtx     sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type propertyDbEntry struct {
+	sheet string
+	ready chan struct{}
+	db    *propertyDb
+	err   error
+}
+
+func newPropertyDbCache(vada vada.VadaClient, size int) *propertyDbCache {
+	return &propertyDbCache{
+		vada:    vada,
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns the property database of sheet, access is checked with core on
+// every call, cached or not. Concurrent misses for the same sheet share one
+// load and failed loads aren't cached.
+func (c *propertyDbCache) get(coreApi core.CoreApi, forUser string, session session.Session, sheet string) (*propertyDb, error) {
+	sheets, err := coreApi.Sheet().Get(forUser, []string{sheet})
+	if err != nil {
+		return nil, err
+	} else if len(sheets) == 0 {
+		return nil, newHttpError(http.StatusNotFound, errors.New("sheet not found"))
+	}
+
+	c.mtx.Lock()
+	if el, exists := c.entries[sheet]; exists {
+		c.lru.MoveToFront(el)
+		c.mtx.Unlock()
+		entry := el.Value.(*propertyDbEntry)
+		<-entry.ready
+		return entry.db, entry.err
+	}
+	entry := &propertyDbEntry{sheet: sheet, ready: make(chan struct{})}
+	c.entries[sheet] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	c.mtx.Unlock()
+
+	entry.db, entry.err = c.load(coreApi, forUser, session, sheet, sheets[0].Manifest)
+	close(entry.ready)
+	if entry.err != nil {
+		c.mtx.Lock()
+		if el, exists := c.entries[sheet]; exists && el.Value == entry {
+			c.remove(el)
+		}
+		c.mtx.Unlock()
+	}
+	return entry.db, entry.err
+}
+
+func (c *propertyDbCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*propertyDbEntry).sheet)
+}
+
+// load finds the property database files in the assets of the sheet's
+// manifest, svf files are zips containing a manifest.json, f2d sheets have a
+// manifest.json.gz beside them.
+func (c *propertyDbCache) load(coreApi core.CoreApi, forUser string, session session.Session, sheet string, manifest string) (*propertyDb, error) {
+	items := &sheetItems{vada: c.vada, coreApi: coreApi, forUser: forUser, session: session, sheet: sheet}
+	manifest = "/" + strings.TrimPrefix(manifest, "/")
+	dir := path.Dir(manifest)
+	var manifestJson []byte
+	if strings.HasSuffix(manifest, ".svf") {
+		if svf, err := items.get(manifest); err != nil {
+			return nil, err
+		} else if manifestJson, err = readZipFile(svf, svfManifestName); err != nil {
+			return nil, err
+		}
+	} else if data, err := items.get(path.Join(dir, f2dManifestName)); err != nil {
+		return nil, err
+	} else {
+		manifestJson = data
+	}
+
+	assets := &struct {
+		Assets []struct {
+			URI string `json:"URI"`
+		} `json:"assets"`
+	}{}
+	if err := json.Unmarshal(manifestJson, assets); err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, asset := range assets.Assets {
+		if name := path.Base(asset.URI); strings.HasPrefix(name, propertyDbFilePrefix) && strings.HasSuffix(name, propertyDbFileSuffix) && !strings.HasPrefix(asset.URI, "embed:") {
+			files[strings.TrimSuffix(strings.TrimPrefix(name, propertyDbFilePrefix), propertyDbFileSuffix)] = path.Join(dir, asset.URI)
+		}
+	}
+
+	data := map[string][]byte{}
+	for _, file := range propertyDbFiles {
+		if filePath, exists := files[file]; !exists {
+			return nil, newHttpError(http.StatusNotFound, errors.New("sheet has no property database"))
+		} else if d, err := items.get(filePath); err != nil {
+			return nil, err
+		} else {
+			data[file] = d
+		}
+	}
+	db := &propertyDb{}
+	var err error
+	if db.attrs, err = parsePropertyAttrs(data["attrs"]); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data["vals"], &db.vals); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data["ids"], &db.ids); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data["offs"], &db.offs); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data["avs"], &db.avs); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// sheetItems fetches a sheet's derivative files the way sheet/getItem does,
+// the first through core, which checks access and gives the base urn, and the
+// rest straight from vada.
+type sheetItems struct {
+	vada    vada.VadaClient
+	coreApi core.CoreApi
+	forUser string
+	session session.Session
+	sheet   string
+	baseUrn string
+}
+
+func (s *sheetItems) get(itemPath string) ([]byte, error) {
+	var res *http.Response
+	var err error
+	if s.baseUrn == "" {
+		s.baseUrn, _ = s.session.GetSheetBaseUrn(s.sheet)
+	}
+	if s.baseUrn != "" {
+		res, err = s.vada.GetSheetItem(s.baseUrn + itemPath)
+	} else {
+		res, s.baseUrn, err = s.coreApi.Sheet().GetItem(s.forUser, s.sheet, itemPath)
+	}
+	if res != nil && res.Body != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("failed to get sheet item %s: %s", itemPath, res.Status)
+	}
+	return readMaybeGzipped(res.Body)
+}
+
+// readMaybeGzipped reads body, decompressing it if it's gzipped, .gz items are
+// stored compressed but may have been decompressed in transit.
+func readMaybeGzipped(body io.Reader) ([]byte, error) {
+	br := bufio.NewReader(body)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	}
+	return ioutil.ReadAll(br)
+}
+
+func readZipFile(data []byte, name string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name == name {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
@@ -0,0 +1,292 @@
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/sheet"
+	"github.com/modelhub/session"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testPropertyDbManifest = "/output/1/model.svf"
+
+// testPropertyDb has a wall type (1), two walls (2, 3) that are instances of it
+// and a door (4). Attribute 4 is hidden.
+func testPropertyDb() *propertyDb {
+	attrs, err := parsePropertyAttrs([]byte(`[
+		[0, "version"],
+		["name", "__name__", 20, null, "", ""],
+		["category", "__category__", 20, null, "", ""],
+		["instanceof_objid", "__instanceof__", 11, null, "", ""],
+		["Mark", "Identity Data", 20, null, "", "Mark", 1],
+		["Width", "Dimensions", 3, "mm", "", ""],
+		["Fire Rating", "Identity Data", 20, null, "", "Fire Rating"]
+	]`))
+	if err != nil {
+		panic(err)
+	}
+	return &propertyDb{
+		attrs: attrs,
+		vals:  []interface{}{nil, "Basic Wall", "Walls", float64(1), "W1", "W2", float64(200), float64(300), "Door", "Doors", "EI60", "D1"},
+		ids:   []interface{}{nil, "type-1", "wall-1", "wall-2", "door-1"},
+		offs:  []int{0, 0, 3, 6, 9},
+		avs: []int{
+			1, 1, 2, 2, 5, 6,
+			1, 1, 3, 3, 4, 4,
+			1, 1, 3, 3, 5, 7,
+			1, 8, 2, 9, 6, 10,
+			4, 11,
+		},
+	}
+}
+
+func TestParsePropertyAttrs(t *testing.T) {
+	attrs, err := parsePropertyAttrs([]byte(`[[0], ["a"], [], ["b", "Cat", 3, "m", "desc", "B", 1, 2], "junk"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*propertyAttr{
+		{name: "0", displayName: "0"},
+		{name: "a", displayName: "a"},
+		nil,
+		{name: "b", category: "Cat", dataType: 3, units: "m", displayName: "B", hidden: true},
+		nil,
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("got %+v, want %+v", attrs, want)
+	}
+	if _, err := parsePropertyAttrs([]byte(`{}`)); err == nil {
+		t.Fatal("expected an error for a non array")
+	}
+}
+
+func TestPropertyDbElement(t *testing.T) {
+	db := testPropertyDb()
+	el := db.element(2, true)
+	if el.ExternalId != "wall-1" || el.Name != "Basic Wall" || el.Category != "Walls" {
+		t.Fatalf("element %+v", el)
+	}
+	// the instance's own width wins over the type's, internal attributes are
+	// left out
+	got := map[string]interface{}{}
+	for _, p := range el.Properties {
+		got[p.AttributeName] = p.DisplayValue
+	}
+	if want := map[string]interface{}{"Mark": "W1", "Width": float64(200)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("properties %v, want %v", got, want)
+	}
+	if p := el.Properties[0]; p.DisplayName != "Mark" || !p.Hidden || p.DisplayCategory != "Identity Data" {
+		t.Fatalf("property %+v", p)
+	}
+	if el := db.element(4, false); el.Category != "Doors" || el.Properties != nil {
+		t.Fatalf("element %+v", el)
+	}
+}
+
+func TestPropertyDbOutOfRange(t *testing.T) {
+	db := testPropertyDb()
+	db.avs = append(db.avs, 99, 99)
+	for _, dbId := range []int{-1, 0, 5} {
+		db.eachValue(dbId, func(attr *propertyAttr, val interface{}) {
+			t.Fatalf("dbId %d has value %v", dbId, val)
+		})
+	}
+	count := 0
+	db.eachValue(4, func(attr *propertyAttr, val interface{}) { count++ })
+	if count != 4 {
+		t.Fatalf("got %d values, want the 4 with valid indexes", count)
+	}
+}
+
+func TestPropertyDbSearch(t *testing.T) {
+	db := testPropertyDb()
+	for _, c := range []struct {
+		name, value string
+		want        []int
+	}{
+		{"width", "300", []int{3}},
+		{"Width", "", []int{1, 2, 3}},
+		{"fire rating", "ei60", []int{4}},
+		{"", "W1", []int{2}},
+		{"category", "Walls", []int{}},
+	} {
+		if got := db.search(c.name, c.value); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("search(%q, %q) = %v, want %v", c.name, c.value, got, c.want)
+		}
+	}
+	if dbId, exists := db.dbIdForExternalId("door-1"); !exists || dbId != 4 {
+		t.Fatalf("got %d %v", dbId, exists)
+	} else if _, exists := db.dbIdForExternalId("nope"); exists {
+		t.Fatal("unknown external id found")
+	}
+}
+
+func TestPropertyDbCategories(t *testing.T) {
+	got := testPropertyDb().categories()
+	if want := []*propertyDbCategory{{Name: "Doors", Count: 1}, {Name: "Walls", Count: 1}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadMaybeGzipped(t *testing.T) {
+	if b, err := readMaybeGzipped(bytes.NewReader(gzipped("[1]"))); err != nil || string(b) != "[1]" {
+		t.Fatalf("gzipped: %q %v", b, err)
+	} else if b, err := readMaybeGzipped(strings.NewReader("[2]")); err != nil || string(b) != "[2]" {
+		t.Fatalf("plain: %q %v", b, err)
+	}
+}
+
+func gzipped(s string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+// testSheetItems serves a sheet's property database files, counting manifest
+// fetches as loads. The files of a sheet named "broken" fail to fetch.
+type testSheetItems struct {
+	core.CoreApi
+	sheet.SheetApi
+
+	mtx   sync.Mutex
+	loads map[string]int
+	files map[string][]byte
+	block chan struct{}
+}
+
+func newTestSheetItems() *testSheetItems {
+	manifest := &bytes.Buffer{}
+	z := zip.NewWriter(manifest)
+	f, _ := z.Create(svfManifestName)
+	f.Write([]byte(`{"assets": [{"URI": "objects_attrs.json.gz"}, {"URI": "objects_vals.json.gz"}, {"URI": "objects_ids.json.gz"}, {"URI": "objects_offs.json.gz"}, {"URI": "objects_avs.json.gz"}, {"URI": "embed:/objects_ids.json.gz"}]}`))
+	z.Close()
+	return &testSheetItems{
+		loads: map[string]int{},
+		files: map[string][]byte{
+			"model.svf":             manifest.Bytes(),
+			"objects_attrs.json.gz": gzipped(`[[0], ["name", "__name__"]]`),
+			"objects_vals.json.gz":  gzipped(`[null, "Wall"]`),
+			"objects_ids.json.gz":   []byte(`[null, "wall-1"]`),
+			"objects_offs.json.gz":  gzipped(`[0, 0]`),
+			"objects_avs.json.gz":   gzipped(`[1, 1]`),
+		},
+	}
+}
+
+func (s *testSheetItems) Sheet() sheet.SheetApi { return s }
+
+func (s *testSheetItems) Get(forUser string, ids []string) ([]*sheet.Sheet, error) {
+	if ids[0] == "missing" {
+		return nil, nil
+	}
+	return []*sheet.Sheet{{Id: ids[0], Manifest: testPropertyDbManifest}}, nil
+}
+
+func (s *testSheetItems) GetItem(forUser, id, path string) (*http.Response, string, error) {
+	res, err := s.GetSheetItem(id + path)
+	return res, id, err
+}
+
+func (s *testSheetItems) GetSheetItem(item string) (*http.Response, error) {
+	parts := strings.SplitN(item, "/", 2)
+	name := parts[1][strings.LastIndex(parts[1], "/")+1:]
+	if name == "model.svf" {
+		s.mtx.Lock()
+		s.loads[parts[0]]++
+		s.mtx.Unlock()
+		if s.block != nil {
+			<-s.block
+		}
+	}
+	if parts[0] == "broken" && name != "model.svf" {
+		return nil, errors.New("unavailable")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(s.files[name])), ContentLength: -1}, nil
+}
+
+// testSheetSession has never accessed a sheet so every first item goes through
+// core.
+type testSheetSession struct {
+	session.Session
+}
+
+func (testSheetSession) GetSheetBaseUrn(sheet string) (string, error) {
+	return "", errors.New("not accessed")
+}
+
+func TestPropertyDbCacheLoad(t *testing.T) {
+	items := newTestSheetItems()
+	cache := newPropertyDbCache(items, 2)
+	db, err := cache.get(items, "u", testSheetSession{}, "a")
+	if err != nil {
+		t.Fatal(err)
+	} else if el := db.element(1, false); el.ExternalId != "wall-1" || el.Name != "Wall" {
+		t.Fatalf("element %+v", el)
+	}
+	_, err = cache.get(items, "u", testSheetSession{}, "missing")
+	assertStatus(t, err, http.StatusNotFound)
+}
+
+func TestPropertyDbCacheLru(t *testing.T) {
+	items := newTestSheetItems()
+	cache := newPropertyDbCache(items, 2)
+	for _, sheet := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := cache.get(items, "u", testSheetSession{}, sheet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// c evicted b as a was used more recently
+	if want := map[string]int{"a": 1, "b": 2, "c": 1}; !reflect.DeepEqual(items.loads, want) {
+		t.Fatalf("loads %v, want %v", items.loads, want)
+	} else if cache.lru.Len() != 2 || len(cache.entries) != 2 {
+		t.Fatalf("cache holds %d entries", cache.lru.Len())
+	}
+}
+
+func TestPropertyDbCacheDoesNotKeepFailures(t *testing.T) {
+	items := newTestSheetItems()
+	cache := newPropertyDbCache(items, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.get(items, "u", testSheetSession{}, "broken"); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if items.loads["broken"] != 2 || len(cache.entries) != 0 {
+		t.Fatalf("loads %v, entries %d", items.loads, len(cache.entries))
+	}
+}
+
+func TestPropertyDbCacheSharesLoads(t *testing.T) {
+	items := newTestSheetItems()
+	items.block = make(chan struct{})
+	cache := newPropertyDbCache(items, 2)
+	dbs := make([]*propertyDb, 4)
+	wg := sync.WaitGroup{}
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dbs[i], _ = cache.get(items, "u", testSheetSession{}, "a")
+		}(i)
+	}
+	close(items.block)
+	wg.Wait()
+	for _, db := range dbs {
+		if db == nil || db != dbs[0] {
+			t.Fatal("concurrent gets should share one database")
+		}
+	}
+	if items.loads["a"] != 1 {
+		t.Fatalf("loaded %d times", items.loads["a"])
+	}
+}
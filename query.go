@@ -0,0 +1,118 @@
+package rest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decodeQuery fills the json tagged fields of the struct dst points to from the
+// query string values, so GET requests can use the same args structs as POST
+// requests. Embedded structs (pageArgs, shapeArgs) are decoded too, repeated
+// values (ids=a&ids=b) fill []string fields and pointer fields are only set when
+// present.
+func decodeQuery(values url.Values, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("can't decode query into %T", dst)
+	}
+	return decodeQueryStruct(values, v.Elem())
+}
+
+func decodeQueryStruct(values url.Values, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := decodeQueryStruct(values, v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		vals, exists := values[name]
+		if !exists || len(vals) == 0 {
+			continue
+		}
+		if err := setQueryValue(v.Field(i), vals); err != nil {
+			return newHttpError(http.StatusBadRequest, fmt.Errorf("invalid query value for %s: %v", name, err))
+		}
+	}
+	return nil
+}
+
+func setQueryValue(f reflect.Value, vals []string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(vals[0])
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(vals[0]); err != nil {
+			return err
+		} else {
+			f.SetBool(b)
+		}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		if i, err := strconv.ParseInt(vals[0], 10, 64); err != nil {
+			return err
+		} else {
+			f.SetInt(i)
+		}
+	case reflect.Float64, reflect.Float32:
+		if fl, err := strconv.ParseFloat(vals[0], 64); err != nil {
+			return err
+		} else {
+			f.SetFloat(fl)
+		}
+	case reflect.Ptr:
+		elem := reflect.New(f.Type().Elem())
+		if err := setQueryValue(elem.Elem(), vals); err != nil {
+			return err
+		}
+		f.Set(elem)
+	case reflect.Slice:
+		slice := reflect.MakeSlice(f.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			if elem := slice.Index(i); elem.Kind() == reflect.Slice {
+				return fmt.Errorf("unsupported type %s", f.Type())
+			} else if err := setQueryValue(elem, []string{val}); err != nil {
+				return err
+			}
+		}
+		f.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// setCacheHeaders marks responses to GET requests as privately cacheable and
+// reports whether the client's cached copy, identified by If-None-Match,
+// is still current.
+func setCacheHeaders(w http.ResponseWriter, body []byte) bool {
+	rw, ok := w.(*responseWriter)
+	if !ok || (rw.req.Method != http.MethodGet && rw.req.Method != http.MethodHead) {
+		return false
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(rw.opts.cacheMaxAge/time.Second)))
+	w.Header().Add("Vary", "Cookie")
+	w.Header().Add("Vary", "Authorization")
+	sum := sha1.Sum(append([]byte(w.Header().Get("Content-Type")), body...))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	for _, match := range strings.Split(rw.req.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type queryTestArgs struct {
+	Ids     []string `json:"ids"`
+	DbIds   []int    `json:"dbIds"`
+	Name    *string  `json:"name"`
+	Unset   *string  `json:"unset"`
+	Force   bool     `json:"force"`
+	Ratio   float64  `json:"ratio"`
+	Ignored string   `json:"-"`
+	pageArgs
+	shapeArgs
+}
+
+func TestDecodeQuery(t *testing.T) {
+	values, _ := url.ParseQuery("ids=a&ids=b&dbIds=1&dbIds=2&name=n&force=true&ratio=0.5&offset=10&limit=5&fields=id&-=x")
+	args := &queryTestArgs{}
+	if err := decodeQuery(values, args); err != nil {
+		t.Fatal(err)
+	}
+	name := "n"
+	want := &queryTestArgs{
+		Ids:       []string{"a", "b"},
+		DbIds:     []int{1, 2},
+		Name:      &name,
+		Force:     true,
+		Ratio:     0.5,
+		pageArgs:  pageArgs{Offset: 10, Limit: 5},
+		shapeArgs: shapeArgs{Fields: "id"},
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("got %+v, want %+v", args, want)
+	}
+}
+
+func TestDecodeQueryRejectsInvalidValues(t *testing.T) {
+	for _, query := range []string{"limit=abc", "force=maybe", "dbIds=1&dbIds=x", "ratio=half"} {
+		values, _ := url.ParseQuery(query)
+		err := decodeQuery(values, &queryTestArgs{})
+		if he, ok := err.(*httpError); !ok || he.status != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400", query, err)
+		}
+	}
+}
+
+func TestSetCacheHeaders(t *testing.T) {
+	opts := newOptions([]Option{WithCacheMaxAge(time.Minute)})
+	get := func(ifNoneMatch string) (http.Header, bool) {
+		r := withOptions(httptest.NewRequest(http.MethodGet, "/", nil), opts)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := &responseWriter{ResponseWriter: httptest.NewRecorder(), req: r, opts: opts}
+		notModified := setCacheHeaders(w, []byte("body"))
+		return w.Header(), notModified
+	}
+	header, notModified := get("")
+	if notModified || header.Get("Cache-Control") != "private, max-age=60" || strings.Contains(header.Get("Cache-Control"), "s-maxage") {
+		t.Fatalf("got %v %v", header, notModified)
+	}
+	if _, notModified := get(`"other", W/` + header.Get("ETag")); !notModified {
+		t.Fatal("a matching If-None-Match should be not modified")
+	}
+
+	r := withOptions(httptest.NewRequest(http.MethodPost, "/", nil), opts)
+	w := &responseWriter{ResponseWriter: httptest.NewRecorder(), req: r, opts: opts}
+	if setCacheHeaders(w, []byte("body")) || w.Header().Get("Cache-Control") != "" {
+		t.Fatal("POST responses aren't cacheable")
+	}
+}
@@ -0,0 +1,334 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/modelhub/core"
+	"github.com/robsix/golog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxRoomMessageBytes = 1 << 20
+	roomSendBufferSize  = 64
+	roomWriteWait       = 10 * time.Second
+	roomPongWait        = 60 * time.Second
+	roomPingInterval    = roomPongWait * 9 / 10
+)
+
+// Room message types, camera, selection and markup are relayed from one member
+// to the others, the rest are sent by the server.
+const (
+	roomWelcome   = "welcome"
+	roomJoined    = "joined"
+	roomLeft      = "left"
+	roomPresenter = "presenter"
+	roomCamera    = "camera"
+	roomSelection = "selection"
+	roomMarkup    = "markup"
+	roomHandoff   = "handoff"
+	roomError     = "error"
+)
+
+type roomMessage struct {
+	Type string          `json:"type"`
+	From string          `json:"from,omitempty"`
+	User string          `json:"user,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// roomMember is one connection, a user may be in a room more than once from
+// different tabs or devices.
+type roomMember struct {
+	Id     string `json:"id"`
+	User   string `json:"user"`
+	Joined string `json:"joined"`
+	send   chan *roomMessage
+	closed bool
+}
+
+type roomState struct {
+	Member    string          `json:"member"`
+	Presenter string          `json:"presenter"`
+	Members   []*roomMember   `json:"members"`
+	Camera    json.RawMessage `json:"camera,omitempty"`
+}
+
+// room is a collaborative viewing session on a sheet or project space version.
+// Only the presenter drives the camera, the last camera sent is kept to bring
+// members who join later to the same view.
+type room struct {
+	members   []*roomMember
+	presenter *roomMember
+	camera    json.RawMessage
+}
+
+// roomHub holds the open rooms, a room exists while it has members.
+type roomHub struct {
+	mtx        sync.Mutex
+	rooms      map[string]*room
+	nextMember uint64
+}
+
+func newRoomHub() *roomHub {
+	return &roomHub{rooms: map[string]*room{}}
+}
+
+// join adds a member for user to the room, making them presenter if the room
+// was empty.
+func (h *roomHub) join(key string, user string, now time.Time) *roomMember {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.nextMember++
+	m := &roomMember{
+		Id:     strconv.FormatUint(h.nextMember, 10),
+		User:   user,
+		Joined: now.UTC().Format(time.RFC3339),
+		send:   make(chan *roomMessage, roomSendBufferSize),
+	}
+	rm, exists := h.rooms[key]
+	if !exists {
+		rm = &room{}
+		h.rooms[key] = rm
+	}
+	h.broadcast(rm, m, &roomMessage{Type: roomJoined, From: m.Id, User: user, Data: mustMarshal(m)})
+	rm.members = append(rm.members, m)
+	if rm.presenter == nil {
+		rm.presenter = m
+	}
+	h.send(m, &roomMessage{Type: roomWelcome, Data: mustMarshal(&roomState{
+		Member:    m.Id,
+		Presenter: rm.presenter.Id,
+		Members:   rm.members,
+		Camera:    rm.camera,
+	})})
+	return m
+}
+
+// leave removes m from the room, the presenter role passes to the member who
+// has been in the room longest.
+func (h *roomHub) leave(key string, m *roomMember) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.close(m)
+	rm, exists := h.rooms[key]
+	if !exists {
+		return
+	}
+	for i, member := range rm.members {
+		if member == m {
+			rm.members = append(rm.members[:i], rm.members[i+1:]...)
+			break
+		}
+	}
+	if len(rm.members) == 0 {
+		delete(h.rooms, key)
+		return
+	}
+	h.broadcast(rm, nil, &roomMessage{Type: roomLeft, From: m.Id, User: m.User})
+	if rm.presenter == m {
+		rm.presenter = rm.members[0]
+		h.broadcast(rm, nil, &roomMessage{Type: roomPresenter, From: rm.presenter.Id, User: rm.presenter.User})
+	}
+}
+
+// handle relays a message from m, problems are reported back to m alone.
+func (h *roomHub) handle(key string, m *roomMember, msg *roomMessage) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	rm, exists := h.rooms[key]
+	if !exists {
+		return
+	}
+	msg.From, msg.User = m.Id, m.User
+	switch msg.Type {
+	case roomCamera:
+		if rm.presenter != m {
+			h.sendError(m, errors.New("only the presenter can move the camera"))
+		} else if !isJsonObject(msg.Data) {
+			h.sendError(m, errors.New("camera must be a json object"))
+		} else {
+			rm.camera = msg.Data
+			h.broadcast(rm, m, msg)
+		}
+	case roomSelection, roomMarkup:
+		h.broadcast(rm, m, msg)
+	case roomHandoff:
+		args := &struct {
+			Member string `json:"member"`
+		}{}
+		if rm.presenter != m {
+			h.sendError(m, errors.New("only the presenter can hand off"))
+		} else if err := json.Unmarshal(msg.Data, args); err != nil {
+			h.sendError(m, err)
+		} else if to := rm.member(args.Member); to == nil {
+			h.sendError(m, errors.New("member not found"))
+		} else {
+			rm.presenter = to
+			h.broadcast(rm, nil, &roomMessage{Type: roomPresenter, From: to.Id, User: to.User})
+		}
+	default:
+		h.sendError(m, errors.New("unknown message type "+strconv.Quote(msg.Type)))
+	}
+}
+
+func (rm *room) member(id string) *roomMember {
+	for _, m := range rm.members {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (h *roomHub) broadcast(rm *room, except *roomMember, msg *roomMessage) {
+	for _, m := range rm.members {
+		if m != except {
+			h.send(m, msg)
+		}
+	}
+}
+
+// send never blocks, a member whose connection can't keep up is disconnected.
+func (h *roomHub) send(m *roomMember, msg *roomMessage) {
+	if m.closed {
+		return
+	}
+	select {
+	case m.send <- msg:
+	default:
+		h.close(m)
+	}
+}
+
+func (h *roomHub) sendError(m *roomMember, err error) {
+	h.send(m, &roomMessage{Type: roomError, Data: mustMarshal(err.Error())})
+}
+
+func (h *roomHub) close(m *roomMember) {
+	if !m.closed {
+		m.closed = true
+		close(m.send)
+	}
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// isJsonObject reports whether data is a json object, null unmarshals into a
+// map without error so the first byte is checked too.
+func isJsonObject(data json.RawMessage) bool {
+	obj := map[string]interface{}{}
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Unmarshal(trimmed, &obj) == nil
+}
+
+// roomKey identifies the room for a sheet or project space version, checking
+// forUser can see it.
+func roomKey(coreApi core.CoreApi, forUser string, sheet string, projectSpaceVersion string) (string, error) {
+	if sheet != "" {
+		if res, err := coreApi.Sheet().Get(forUser, []string{sheet}); err != nil {
+			return "", err
+		} else if len(res) == 0 {
+			return "", newHttpError(http.StatusNotFound, errors.New("sheet not found"))
+		}
+		return "sheet:" + sheet, nil
+	}
+	if res, err := coreApi.ProjectSpaceVersion().Get(forUser, []string{projectSpaceVersion}); err != nil {
+		return "", err
+	} else if len(res) == 0 {
+		return "", newHttpError(http.StatusNotFound, errors.New("project space version not found"))
+	}
+	return "projectSpaceVersion:" + projectSpaceVersion, nil
+}
+
+// checkRoomOrigin allows browsers to connect from the api's own origin and
+// from the viewer's, sessions are cookie based so any other origin could act
+// as the user.
+func checkRoomOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	} else if u.Host == r.Host {
+		return true
+	}
+	viewer, err := url.Parse(optionsFrom(r).viewerUrl)
+	return err == nil && viewer.Host != "" && u.Host == viewer.Host
+}
+
+var roomUpgrader = &websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkRoomOrigin,
+}
+
+// roomConn is the part of a websocket connection readRoomMessages uses.
+type roomConn interface {
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	ReadMessage() (messageType int, p []byte, err error)
+}
+
+// readRoomMessages relays messages from conn until it closes, malformed
+// messages are reported back rather than closing the connection.
+func readRoomMessages(conn roomConn, rooms *roomHub, key string, m *roomMember, log golog.Log) {
+	conn.SetReadLimit(maxRoomMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(roomPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(roomPongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+				log.Info("RestApi room connection for user %s closed: %v", m.User, err)
+			}
+			return
+		}
+		msg := &roomMessage{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			rooms.mtx.Lock()
+			rooms.sendError(m, err)
+			rooms.mtx.Unlock()
+			continue
+		}
+		rooms.handle(key, m, msg)
+	}
+}
+
+// writeRoomMessages sends m's messages and keep alive pings until m leaves or
+// the connection fails, closing the connection to stop the reader.
+func writeRoomMessages(conn *websocket.Conn, m *roomMember) {
+	ping := time.NewTicker(roomPingInterval)
+	defer ping.Stop()
+	defer conn.Close()
+	for {
+		select {
+		case msg, open := <-m.send:
+			conn.SetWriteDeadline(time.Now().Add(roomWriteWait))
+			if !open {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			} else if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(roomWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roomMessages returns the messages waiting for m and whether its channel has
+// been closed.
+func roomMessages(m *roomMember) ([]*roomMessage, bool) {
+	res := []*roomMessage{}
+	for {
+		select {
+		case msg, open := <-m.send:
+			if !open {
+				return res, true
+			}
+			res = append(res, msg)
+		default:
+			return res, false
+		}
+	}
+}
+
+func assertRoomMessages(t *testing.T, m *roomMember, types ...string) []*roomMessage {
+	t.Helper()
+	msgs, _ := roomMessages(m)
+	got := []string{}
+	for _, msg := range msgs {
+		got = append(got, msg.Type)
+	}
+	if !reflect.DeepEqual(got, append([]string{}, types...)) {
+		t.Fatalf("member %s got %v, want %v", m.Id, got, types)
+	}
+	return msgs
+}
+
+func welcomeState(t *testing.T, msg *roomMessage) *roomState {
+	t.Helper()
+	state := &roomState{}
+	if err := json.Unmarshal(msg.Data, state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestRoomJoinAndLeave(t *testing.T) {
+	h := newRoomHub()
+	now := time.Unix(0, 0)
+	a := h.join("k", "ua", now)
+	if state := welcomeState(t, assertRoomMessages(t, a, roomWelcome)[0]); state.Member != a.Id || state.Presenter != a.Id || len(state.Members) != 1 {
+		t.Fatalf("state %+v", state)
+	}
+	b := h.join("k", "ub", now)
+	if joined := assertRoomMessages(t, a, roomJoined)[0]; joined.From != b.Id || joined.User != "ub" {
+		t.Fatalf("joined %+v", joined)
+	}
+	if state := welcomeState(t, assertRoomMessages(t, b, roomWelcome)[0]); state.Presenter != a.Id || len(state.Members) != 2 {
+		t.Fatalf("state %+v", state)
+	}
+	// other rooms are separate
+	other := h.join("other", "uc", now)
+	assertRoomMessages(t, other, roomWelcome)
+	assertRoomMessages(t, a)
+
+	h.leave("k", a)
+	if _, closed := roomMessages(a); !closed {
+		t.Fatal("a left but its channel is open")
+	}
+	if msgs := assertRoomMessages(t, b, roomLeft, roomPresenter); msgs[0].From != a.Id || msgs[1].From != b.Id {
+		t.Fatalf("messages %+v %+v", msgs[0], msgs[1])
+	}
+	h.leave("k", b)
+	if _, exists := h.rooms["k"]; exists || len(h.rooms) != 1 {
+		t.Fatalf("rooms %v", h.rooms)
+	}
+	// leaving twice does nothing
+	h.leave("k", b)
+}
+
+func TestRoomFanOut(t *testing.T) {
+	h := newRoomHub()
+	now := time.Unix(0, 0)
+	a, b, c := h.join("k", "ua", now), h.join("k", "ub", now), h.join("k", "uc", now)
+	roomMessages(a)
+	roomMessages(b)
+	roomMessages(c)
+
+	camera := json.RawMessage(`{"eye": [1, 2, 3]}`)
+	h.handle("k", a, &roomMessage{Type: roomCamera, Data: camera})
+	assertRoomMessages(t, a)
+	for _, m := range []*roomMember{b, c} {
+		if msg := assertRoomMessages(t, m, roomCamera)[0]; msg.From != a.Id || msg.User != "ua" || string(msg.Data) != string(camera) {
+			t.Fatalf("camera %+v", msg)
+		}
+	}
+	d := h.join("k", "ud", now)
+	if state := welcomeState(t, assertRoomMessages(t, d, roomWelcome)[0]); string(state.Camera) != `{"eye":[1,2,3]}` {
+		t.Fatalf("camera %s", state.Camera)
+	}
+	roomMessages(a)
+	roomMessages(b)
+	roomMessages(c)
+
+	for _, msg := range []*roomMessage{
+		{Type: roomCamera, Data: json.RawMessage(`null`)},
+		{Type: roomCamera, Data: json.RawMessage(`[1]`)},
+		{Type: "shout"},
+		{Type: roomHandoff, Data: json.RawMessage(`{"member": "99"}`)},
+	} {
+		h.handle("k", a, msg)
+		assertRoomMessages(t, a, roomError)
+		assertRoomMessages(t, b)
+	}
+	h.handle("k", b, &roomMessage{Type: roomCamera, Data: camera})
+	assertRoomMessages(t, b, roomError)
+	assertRoomMessages(t, a)
+
+	h.handle("k", c, &roomMessage{Type: roomSelection, Data: json.RawMessage(`["e1"]`)})
+	assertRoomMessages(t, c)
+	for _, m := range []*roomMember{a, b, d} {
+		assertRoomMessages(t, m, roomSelection)
+	}
+
+	h.handle("k", a, &roomMessage{Type: roomHandoff, Data: json.RawMessage(`{"member": "` + b.Id + `"}`)})
+	for _, m := range []*roomMember{a, b, c, d} {
+		if msg := assertRoomMessages(t, m, roomPresenter)[0]; msg.From != b.Id {
+			t.Fatalf("presenter %+v", msg)
+		}
+	}
+	h.handle("k", a, &roomMessage{Type: roomCamera, Data: camera})
+	assertRoomMessages(t, a, roomError)
+}
+
+func TestRoomDropsSlowMembers(t *testing.T) {
+	h := newRoomHub()
+	now := time.Unix(0, 0)
+	a, slow := h.join("k", "ua", now), h.join("k", "ub", now)
+	roomMessages(a)
+	for i := 0; i <= roomSendBufferSize; i++ {
+		h.handle("k", a, &roomMessage{Type: roomSelection})
+	}
+	if msgs, closed := roomMessages(slow); !closed || len(msgs) != roomSendBufferSize {
+		t.Fatalf("slow member got %d messages, closed %v", len(msgs), closed)
+	}
+	// the member is gone once its connection ends and the rest carry on
+	h.leave("k", slow)
+	assertRoomMessages(t, a, roomLeft)
+	c := h.join("k", "uc", now)
+	h.handle("k", c, &roomMessage{Type: roomSelection})
+	assertRoomMessages(t, a, roomJoined, roomSelection)
+}
+
+func TestIsJsonObject(t *testing.T) {
+	for data, want := range map[string]bool{
+		`{}`:            true,
+		` {"a": 1} `:    true,
+		`null`:          false,
+		` null`:         false,
+		`[]`:            false,
+		`"{}"`:          false,
+		`{`:             false,
+		``:              false,
+		`{"a": 1} {}`:   false,
+		"\n\t{\"a\":1}": true,
+	} {
+		if got := isJsonObject(json.RawMessage(data)); got != want {
+			t.Errorf("%q: got %v, want %v", data, got, want)
+		}
+	}
+}
+
+func TestCheckRoomOrigin(t *testing.T) {
+	withViewer := newOptions([]Option{WithViewerUrl("https://viewer.example.com/view")})
+	for _, c := range []struct {
+		opts   *options
+		origin string
+		want   bool
+	}{
+		{nil, "", true},
+		{nil, "https://api.example.com", true},
+		{nil, "https://evil.example.com", false},
+		{nil, "https://viewer.example.com", false},
+		{withViewer, "https://viewer.example.com", true},
+		{withViewer, "https://evil.example.com", false},
+		{withViewer, "://bad", false},
+	} {
+		opts := c.opts
+		if opts == nil {
+			opts = newOptions(nil)
+		}
+		r := withOptions(httptest.NewRequest(http.MethodGet, "https://api.example.com/api/v1/room/join", nil), opts)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := checkRoomOrigin(r); got != c.want {
+			t.Errorf("origin %q with viewer %q: got %v, want %v", c.origin, opts.viewerUrl, got, c.want)
+		}
+	}
+}
+
+// testRoomConn returns its messages in order, then fails as a closed
+// connection does.
+type testRoomConn struct {
+	readLimit int64
+	messages  []string
+}
+
+func (c *testRoomConn) SetReadLimit(limit int64)                    { c.readLimit = limit }
+func (c *testRoomConn) SetReadDeadline(t time.Time) error           { return nil }
+func (c *testRoomConn) SetPongHandler(h func(appData string) error) {}
+
+func (c *testRoomConn) ReadMessage() (int, []byte, error) {
+	if len(c.messages) == 0 {
+		return 0, nil, errors.New("closed")
+	}
+	msg := c.messages[0]
+	c.messages = c.messages[1:]
+	return 1, []byte(msg), nil
+}
+
+func TestReadRoomMessages(t *testing.T) {
+	h := newRoomHub()
+	now := time.Unix(0, 0)
+	a, b := h.join("k", "ua", now), h.join("k", "ub", now)
+	roomMessages(a)
+	roomMessages(b)
+	conn := &testRoomConn{messages: []string{`{"type": "selection", "data": ["e1"]}`, `{"type":`, `{"type": "camera", "data": null}`}}
+	readRoomMessages(conn, h, "k", a, nil)
+	if conn.readLimit != maxRoomMessageBytes {
+		t.Fatalf("read limit %d", conn.readLimit)
+	}
+	assertRoomMessages(t, a, roomError, roomError)
+	assertRoomMessages(t, b, roomSelection)
+}
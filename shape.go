@@ -0,0 +1,418 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/documentversion"
+	"github.com/modelhub/core/issue"
+	"github.com/modelhub/core/project"
+	"github.com/modelhub/core/projectspaceversion"
+	"github.com/modelhub/core/sheet"
+	"github.com/modelhub/core/sheettransform"
+	"github.com/modelhub/core/treenode"
+	"github.com/modelhub/core/user"
+	"github.com/modelhub/core/viewpoint"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// shapeArgs is embedded in the args of read handlers. Fields is a comma
+// separated list of (dotted) properties to keep in each result, Expand a comma
+// separated list of (dotted) references to replace with the objects they refer
+// to, e.g. "latestVersion.firstSheet,uploadedBy".
+type shapeArgs struct {
+	Fields string `json:"fields"`
+	Expand string `json:"expand"`
+}
+
+type expansion struct {
+	// kind of the objects the expansion resolves to, used for nested expansions
+	kind string
+	// src is the property holding the id passed to fetch
+	src string
+	// matchOn is the property of the fetched objects that holds the src id
+	matchOn string
+	// when restricts the expansion to objects it applies to, nil means all
+	when  func(obj map[string]interface{}) bool
+	fetch func(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error)
+}
+
+var expansions = map[string]map[string][]*expansion{
+	"treeNode": {
+		"parent":  {ref("treeNode", "parent", getTreeNodes)},
+		"project": {ref("project", "project", getProjects)},
+		"latestVersion": {
+			{kind: "documentVersion", src: "id", matchOn: "document", when: isNodeType("document"), fetch: getLatestDocumentVersions},
+			{kind: "projectSpaceVersion", src: "id", matchOn: "projectSpace", when: isNodeType("projectSpace"), fetch: getLatestProjectSpaceVersions},
+		},
+	},
+	"documentVersion": {
+		"document":   {ref("treeNode", "document", getTreeNodes)},
+		"project":    {ref("project", "project", getProjects)},
+		"uploadedBy": {ref("user", "uploadedBy", getUsers)},
+		"firstSheet": {{kind: "sheet", src: "id", matchOn: "documentVersion", fetch: getFirstSheets}},
+	},
+	"projectSpaceVersion": {
+		"projectSpace": {ref("treeNode", "projectSpace", getTreeNodes)},
+		"project":      {ref("project", "project", getProjects)},
+		"createdBy":    {ref("user", "createdBy", getUsers)},
+	},
+	"sheet": {
+		"documentVersion": {ref("documentVersion", "documentVersion", getDocumentVersions)},
+		"project":         {ref("project", "project", getProjects)},
+	},
+	"sheetTransform": {
+		"sheet":           {ref("sheet", "sheet", getSheets)},
+		"documentVersion": {ref("documentVersion", "documentVersion", getDocumentVersions)},
+		"project":         {ref("project", "project", getProjects)},
+	},
+	"issue": {
+		"project":             {ref("project", "project", getProjects)},
+		"sheet":               {ref("sheet", "sheet", getSheets)},
+		"projectSpaceVersion": {ref("projectSpaceVersion", "projectSpaceVersion", getProjectSpaceVersions)},
+		"assignee":            {ref("user", "assignee", getUsers)},
+		"createdBy":           {ref("user", "createdBy", getUsers)},
+	},
+	"viewpoint": {
+		"project":             {ref("project", "project", getProjects)},
+		"sheet":               {ref("sheet", "sheet", getSheets)},
+		"projectSpaceVersion": {ref("projectSpaceVersion", "projectSpaceVersion", getProjectSpaceVersions)},
+		"createdBy":           {ref("user", "createdBy", getUsers)},
+	},
+	"project": {},
+	"user":    {},
+}
+
+func ref(kind string, src string, fetch func(core.CoreApi, string, []string) (interface{}, error)) *expansion {
+	return &expansion{kind: kind, src: src, matchOn: "id", fetch: fetch}
+}
+
+func isNodeType(nodeType string) func(map[string]interface{}) bool {
+	return func(obj map[string]interface{}) bool {
+		return obj["nodeType"] == nodeType
+	}
+}
+
+func getUsers(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.User().Get(ids)
+}
+
+func getProjects(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.Project().Get(forUser, ids)
+}
+
+func getTreeNodes(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.TreeNode().Get(forUser, ids)
+}
+
+func getDocumentVersions(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.DocumentVersion().Get(forUser, ids)
+}
+
+func getProjectSpaceVersions(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.ProjectSpaceVersion().Get(forUser, ids)
+}
+
+func getSheets(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.Sheet().Get(forUser, ids)
+}
+
+func getLatestDocumentVersions(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.DocumentVersion().GetLatestForDocuments(forUser, ids)
+}
+
+func getLatestProjectSpaceVersions(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.ProjectSpaceVersion().GetLatestForProjectSpaces(forUser, ids)
+}
+
+func getFirstSheets(coreApi core.CoreApi, forUser string, ids []string) (interface{}, error) {
+	return coreApi.Sheet().GetFirstForDocumentVersions(forUser, ids)
+}
+
+// kindTypes are the core types of each kind, fields are checked against their
+// json properties.
+var kindTypes = map[string]reflect.Type{
+	"treeNode":            reflect.TypeOf(treenode.TreeNode{}),
+	"documentVersion":     reflect.TypeOf(documentversion.DocumentVersion{}),
+	"projectSpaceVersion": reflect.TypeOf(projectspaceversion.ProjectSpaceVersion{}),
+	"sheet":               reflect.TypeOf(sheet.Sheet{}),
+	"sheetTransform":      reflect.TypeOf(sheettransform.SheetTransform{}),
+	"issue":               reflect.TypeOf(issue.Issue{}),
+	"viewpoint":           reflect.TypeOf(viewpoint.Viewpoint{}),
+	"project":             reflect.TypeOf(project.Project{}),
+	"user":                reflect.TypeOf(user.User{}),
+}
+
+// pathTree is a parsed set of dotted paths, "a.b,a.c,d" => {a: {b: {}, c: {}}, d: {}}
+type pathTree map[string]pathTree
+
+func parsePaths(s string) pathTree {
+	tree := pathTree{}
+	for _, path := range strings.Split(s, ",") {
+		node := tree
+		for _, seg := range strings.Split(strings.TrimSpace(path), ".") {
+			if seg == "" {
+				continue
+			}
+			if node[seg] == nil {
+				node[seg] = pathTree{}
+			}
+			node = node[seg]
+		}
+	}
+	return tree
+}
+
+type shaper func(res interface{}) (interface{}, error)
+
+func (s *shapeArgs) shaper(coreApi core.CoreApi, forUser string, kind string) shaper {
+	return func(res interface{}) (interface{}, error) {
+		return s.shape(coreApi, forUser, kind, res)
+	}
+}
+
+// shape applies the requested expansions and then the field selection to res,
+// which must be a single object or a slice of objects of the given kind.
+// Unknown expansions and fields are rejected before anything is fetched.
+func (s *shapeArgs) shape(coreApi core.CoreApi, forUser string, kind string, res interface{}) (interface{}, error) {
+	if s.Fields == "" && s.Expand == "" {
+		return res, nil
+	}
+	expandPaths, fieldPaths := parsePaths(s.Expand), parsePaths(s.Fields)
+	if err := checkExpansions(kind, expandPaths); err != nil {
+		return nil, err
+	}
+	if s.Fields != "" {
+		// handlers may return a richer type than the kind's, e.g. projects with
+		// the user's role, so prefer the type of res itself
+		typ := elemType(reflect.TypeOf(res))
+		if typ == nil || typ.Kind() != reflect.Struct {
+			typ = kindTypes[kind]
+		}
+		if err := checkFields(kind, typ, fieldPaths, expandPaths); err != nil {
+			return nil, err
+		}
+	}
+	var generic interface{}
+	if err := toGeneric(res, &generic); err != nil {
+		return nil, err
+	}
+	if s.Expand != "" {
+		if err := expand(coreApi, forUser, kind, objects(generic), expandPaths); err != nil {
+			return nil, err
+		}
+	}
+	if s.Fields != "" {
+		prune(generic, fieldPaths)
+	}
+	return generic, nil
+}
+
+// checkExpansions rejects expansions kind doesn't have.
+func checkExpansions(kind string, paths pathTree) error {
+	for name, subPaths := range paths {
+		variants, exists := expansions[kind][name]
+		if !exists {
+			return newHttpError(http.StatusBadRequest, fmt.Errorf("unknown expansion %q on %s", name, kind))
+		}
+		if err := checkVariants(variants, subPaths, func(exp *expansion, paths pathTree) error {
+			return checkExpansions(exp.kind, paths)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVariants checks each of paths against the variants of an expansion, a
+// path only has to be valid for one of them.
+func checkVariants(variants []*expansion, paths pathTree, check func(*expansion, pathTree) error) error {
+	for name, subPaths := range paths {
+		var err error
+		for _, exp := range variants {
+			if err = check(exp, pathTree{name: subPaths}); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFields rejects fields typ has no json property for, unless they name an
+// expansion of kind being made. Properties of maps and values that marshal
+// themselves, like metadata and cameras, aren't checked.
+func checkFields(kind string, typ reflect.Type, paths pathTree, expanded pathTree) error {
+	props, opaque := jsonProperties(typ)
+	if opaque {
+		return nil
+	}
+	for name, subPaths := range paths {
+		if subExpanded, isExpanded := expanded[name]; isExpanded {
+			if err := checkVariants(expansions[kind][name], subPaths, func(exp *expansion, paths pathTree) error {
+				return checkFields(exp.kind, kindTypes[exp.kind], paths, subExpanded)
+			}); err != nil {
+				return err
+			}
+		} else if propType, exists := props[name]; !exists {
+			return newHttpError(http.StatusBadRequest, fmt.Errorf("unknown field %q on %s", name, kind))
+		} else if len(subPaths) > 0 {
+			if err := checkFields(name, propType, subPaths, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// jsonProperties returns the properties typ is marshalled with, opaque is set
+// if they can't be known from the type.
+func jsonProperties(typ reflect.Type) (props map[string]reflect.Type, opaque bool) {
+	typ = elemType(typ)
+	if typ == nil || typ.Implements(jsonMarshaler) || reflect.PtrTo(typ).Implements(jsonMarshaler) {
+		return nil, true
+	}
+	switch typ.Kind() {
+	case reflect.Map, reflect.Interface:
+		return nil, true
+	case reflect.Struct:
+	default:
+		return nil, false
+	}
+	props = map[string]reflect.Type{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		} else if f.Anonymous && name == "" {
+			embedded, embeddedOpaque := jsonProperties(f.Type)
+			if embeddedOpaque {
+				return nil, true
+			}
+			for k, v := range embedded {
+				props[k] = v
+			}
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+		props[name] = f.Type
+	}
+	return props, false
+}
+
+// elemType strips pointers, slices and arrays from typ.
+func elemType(typ reflect.Type) reflect.Type {
+	for typ != nil && (typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+func expand(coreApi core.CoreApi, forUser string, kind string, objs []map[string]interface{}, paths pathTree) error {
+	for name, subPaths := range paths {
+		for _, exp := range expansions[kind][name] {
+			targets := make([]map[string]interface{}, 0, len(objs))
+			ids := make([]string, 0, len(objs))
+			seen := map[string]bool{}
+			for _, obj := range objs {
+				if exp.when != nil && !exp.when(obj) {
+					continue
+				}
+				if id, ok := obj[exp.src].(string); ok && id != "" {
+					targets = append(targets, obj)
+					if !seen[id] {
+						seen[id] = true
+						ids = append(ids, id)
+					}
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			fetched, err := exp.fetch(coreApi, forUser, ids)
+			if err != nil {
+				return err
+			}
+			var generic interface{}
+			if err := toGeneric(fetched, &generic); err != nil {
+				return err
+			}
+			expanded := objects(generic)
+			byId := make(map[string]map[string]interface{}, len(expanded))
+			for _, e := range expanded {
+				if id, ok := e[exp.matchOn].(string); ok {
+					byId[id] = e
+				}
+			}
+			for _, obj := range targets {
+				if e, exists := byId[obj[exp.src].(string)]; exists {
+					obj[name] = e
+				} else if exp.src != name {
+					obj[name] = nil
+				}
+			}
+			// nested expansions only apply to the variants that have them
+			variantPaths := pathTree{}
+			for subName, subSubPaths := range subPaths {
+				if _, exists := expansions[exp.kind][subName]; exists {
+					variantPaths[subName] = subSubPaths
+				}
+			}
+			if len(variantPaths) > 0 {
+				if err := expand(coreApi, forUser, exp.kind, expanded, variantPaths); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func prune(v interface{}, paths pathTree) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			prune(e, paths)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if subPaths, keep := paths[k]; !keep {
+				delete(v, k)
+			} else if len(subPaths) > 0 {
+				prune(e, subPaths)
+			}
+		}
+	}
+}
+
+func objects(v interface{}) []map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []interface{}:
+		objs := make([]map[string]interface{}, 0, len(v))
+		for _, e := range v {
+			if obj, ok := e.(map[string]interface{}); ok {
+				objs = append(objs, obj)
+			}
+		}
+		return objs
+	}
+	return nil
+}
+
+func toGeneric(src interface{}, dst *interface{}) error {
+	if b, err := json.Marshal(src); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(b, dst)
+	}
+}
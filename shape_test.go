@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"github.com/modelhub/core/project"
+	"github.com/modelhub/core/treenode"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestShapeRejectsUnknownPaths(t *testing.T) {
+	for _, args := range []*shapeArgs{
+		{Expand: "nope"},
+		{Expand: "latestVersion.nope"},
+		{Fields: "id,nope"},
+		{Fields: "lock.nope"},
+		{Fields: "name.length"},
+		{Fields: "latestVersion.id"},
+		{Expand: "latestVersion", Fields: "latestVersion.nope"},
+	} {
+		_, err := args.shape(nil, "", "treeNode", []*treenode.TreeNode{})
+		if he, ok := err.(*httpError); !ok || he.status != http.StatusBadRequest {
+			t.Errorf("%+v: got %v, want a 400", args, err)
+		}
+	}
+}
+
+func TestShapeAcceptsKnownPaths(t *testing.T) {
+	for _, args := range []*shapeArgs{
+		{Fields: "id,name,lock.owner,metadata.anything"},
+		{Expand: "latestVersion.firstSheet", Fields: "id,latestVersion.version,latestVersion.firstSheet.name,latestVersion.projectSpace"},
+		{Expand: "parent", Fields: "parent.name"},
+	} {
+		if err := checkExpansions("treeNode", parsePaths(args.Expand)); err != nil {
+			t.Errorf("%+v: %v", args, err)
+		} else if err := checkFields("treeNode", kindTypes["treeNode"], parsePaths(args.Fields), parsePaths(args.Expand)); err != nil {
+			t.Errorf("%+v: %v", args, err)
+		}
+	}
+}
+
+func TestShapeFieldsUseResultType(t *testing.T) {
+	res := []*project.ProjectInUserContext{{Project: project.Project{Id: "p", Name: "n"}, Role: "owner"}}
+	shaped, err := (&shapeArgs{Fields: "id,role"}).shape(nil, "", "project", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{map[string]interface{}{"id": "p", "role": "owner"}}
+	if !reflect.DeepEqual(shaped, want) {
+		t.Fatalf("got %v, want %v", shaped, want)
+	}
+}
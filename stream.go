@@ -0,0 +1,142 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/modelhub/core/paging"
+	"github.com/robsix/golog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	ndjsonMediaType        = "application/x-ndjson"
+	defaultStreamChunkSize = 100
+	defaultStreamPages     = 100
+)
+
+// wantsNdjson reports whether the client prefers a newline delimited JSON
+// stream of results over a single encoded page.
+func wantsNdjson(w http.ResponseWriter) bool {
+	if rw, ok := w.(*responseWriter); ok {
+		for _, mediaType := range acceptedMediaTypes(rw.req.Header.Get("Accept")) {
+			if mediaType == ndjsonMediaType {
+				return true
+			} else if _, exists := rw.opts.codecs[mediaType]; exists || mediaType == "*/*" || mediaType == "application/*" {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// chunkFetcher returns the next chunk of at most limit results to stream, the
+// total (-1 if it was skipped) and whether there are more results after it.
+type chunkFetcher func(limit int) (interface{}, int, bool, error)
+
+func offsetChunks(fetch pageFetcher, offset int) chunkFetcher {
+	return func(limit int) (interface{}, int, bool, error) {
+		res, total, err := fetch(offset, limit)
+		n := resultSlice(res).Len()
+		offset += n
+		return res, total, n == limit && offset < total, err
+	}
+}
+
+// keysetChunks continues each chunk after the last item of the one before, only
+// the first chunk is counted.
+func keysetChunks(fetch keysetFetcher, query *paging.Query) chunkFetcher {
+	return func(limit int) (interface{}, int, bool, error) {
+		query.Limit = limit
+		res, info, err := fetch(query)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		query.Offset, query.After, query.SkipTotal = 0, info.Last, true
+		return res, info.Total, info.HasAfter && info.Last != nil, nil
+	}
+}
+
+// checkStreamLimit rejects streams longer than Limits allow, a page.Limit of
+// zero or less asks for every result.
+func checkStreamLimit(w http.ResponseWriter, page *pageArgs) error {
+	if rw, ok := w.(*responseWriter); ok {
+		if max := rw.opts.limits.maxStreamResults(); max > 0 && (page.Limit <= 0 || page.Limit > max) {
+			return newHttpError(http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d when streaming", max))
+		}
+	}
+	return nil
+}
+
+// streamNdjson writes one result per line, fetching them from core a chunk at a
+// time and flushing after each chunk. A page.Limit of zero or less streams every
+// result. The total, unless skipped, is sent in the X-Total-Results header. Once
+// the first line is written errors can no longer change the status code, so
+// they are reported as a final {"error": logId} line instead.
+func streamNdjson(w http.ResponseWriter, page *pageArgs, shape shaper, next chunkFetcher, log golog.Log) error {
+	if err := checkStreamLimit(w, page); err != nil {
+		return err
+	}
+	chunkSize := defaultStreamChunkSize
+	if rw, ok := w.(*responseWriter); ok && rw.opts.limits.StreamChunkSize > 0 {
+		chunkSize = rw.opts.limits.StreamChunkSize
+	}
+	flusher, _ := w.(http.Flusher)
+
+	remaining := page.Limit
+	started := false
+	for {
+		limit := chunkSize
+		if page.Limit > 0 && remaining < limit {
+			limit = remaining
+		}
+		res, total, more, err := next(limit)
+		if err == nil && shape != nil {
+			res, err = shape(res)
+		}
+		if err != nil {
+			if !started {
+				return err
+			}
+			writeStreamError(w, err, log)
+			return nil
+		}
+
+		if !started {
+			w.Header().Set("Content-Type", ndjsonMediaType)
+			w.Header().Add("Vary", "Accept")
+			if total >= 0 {
+				w.Header().Set("X-Total-Results", strconv.Itoa(total))
+			}
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+
+		items := resultSlice(res)
+		for i := 0; i < items.Len(); i++ {
+			if b, err := json.Marshal(items.Index(i).Interface()); err != nil {
+				writeStreamError(w, err, log)
+				return nil
+			} else if _, err := w.Write(append(b, '\n')); err != nil {
+				// client went away
+				return nil
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		remaining -= items.Len()
+		if !more || items.Len() == 0 || (page.Limit > 0 && remaining <= 0) {
+			return nil
+		}
+	}
+}
+
+// writeStreamError ends a stream that has started with an {"error": logId}
+// line, so the client can tell it was cut short.
+func writeStreamError(w http.ResponseWriter, err error, log golog.Log) {
+	le := log.Error("RestApi stream error: %v", err)
+	b, _ := json.Marshal(map[string]string{"error": le.LogId})
+	w.Write(append(b, '\n'))
+}
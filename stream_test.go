@@ -0,0 +1,78 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/robsix/golog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckStreamLimit(t *testing.T) {
+	for _, c := range []struct {
+		limits Limits
+		limit  int
+		status int
+	}{
+		{Limits{}, 0, 0},
+		{Limits{MaxPageLimit: 10}, 1000, 0},
+		{Limits{MaxPageLimit: 10}, 1001, http.StatusBadRequest},
+		{Limits{MaxPageLimit: 10}, 0, http.StatusBadRequest},
+		{Limits{MaxPageLimit: 10, MaxStreamResults: 50}, 50, 0},
+		{Limits{MaxPageLimit: 10, MaxStreamResults: 50}, 51, http.StatusBadRequest},
+		{Limits{MaxStreamResults: 50}, -1, http.StatusBadRequest},
+	} {
+		opts := newOptions([]Option{WithLimits(c.limits)})
+		r := withOptions(httptest.NewRequest(http.MethodGet, "/", nil), opts)
+		w := &responseWriter{ResponseWriter: httptest.NewRecorder(), req: r, opts: opts}
+		err := checkStreamLimit(w, &pageArgs{Limit: c.limit})
+		if c.status == 0 && err != nil {
+			t.Errorf("%+v limit %d: %v", c.limits, c.limit, err)
+		} else if he, ok := err.(*httpError); c.status != 0 && (!ok || he.status != c.status) {
+			t.Errorf("%+v limit %d: got %v, want a %d", c.limits, c.limit, err, c.status)
+		}
+	}
+}
+
+func TestStreamNdjsonRespectsLimit(t *testing.T) {
+	s := testSource("a", "b", "c", "d", "e")
+	opts := newOptions([]Option{WithLimits(Limits{StreamChunkSize: 2, MaxStreamResults: 10})})
+	r := withOptions(httptest.NewRequest(http.MethodGet, "/", nil), opts)
+	r.Header.Set("Accept", ndjsonMediaType)
+	rec := httptest.NewRecorder()
+	w := &responseWriter{ResponseWriter: rec, req: r, opts: opts}
+	if err := writeKeysetJson(w, &pageArgs{Offset: 1, Limit: 3}, "", nil, s.fetch, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"id\":\"b\",\"name\":\"b\"}\n{\"id\":\"c\",\"name\":\"c\"}\n{\"id\":\"d\",\"name\":\"d\"}\n"
+	if rec.Body.String() != want || rec.Header().Get("X-Total-Results") != "5" {
+		t.Fatalf("got %q total %q", rec.Body.String(), rec.Header().Get("X-Total-Results"))
+	}
+}
+
+// testLog records errors and answers them with a fixed log id.
+type testLog struct {
+	golog.Log
+	errors []string
+}
+
+func (l *testLog) Error(format string, args ...interface{}) *golog.LogEntry {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+	return &golog.LogEntry{LogId: "log1"}
+}
+
+func TestStreamNdjsonReportsMarshalErrors(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	log := &testLog{}
+	next := func(limit int) (interface{}, int, bool, error) {
+		return []interface{}{map[string]string{"id": "a"}, func() {}}, 2, false, nil
+	}
+	if err := streamNdjson(&responseWriter{ResponseWriter: rec, req: r, opts: newOptions(nil)}, &pageArgs{}, nil, next, log); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"id\":\"a\"}\n{\"error\":\"log1\"}\n"
+	if rec.Body.String() != want || len(log.errors) != 1 {
+		t.Fatalf("got %q, logged %v", rec.Body.String(), log.errors)
+	}
+}
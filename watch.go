@@ -0,0 +1,283 @@
+package rest
+
+import (
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/clashtest"
+	"github.com/modelhub/core/documentversion"
+	"github.com/robsix/golog"
+	"sync"
+	"time"
+)
+
+const (
+	translationPollInterval = 10 * time.Second
+	maxTranslationWatch     = 2 * time.Hour
+	maxClashTestWatch       = time.Hour
+	maxFirstVersionWatch    = time.Minute
+	maxWatches              = 10000
+)
+
+// statusWatcher publishes events for the changes core makes asynchronously,
+// translations progressing and clash tests finishing, by polling it. One
+// goroutine polls for everything watched, batching core calls per user, and
+// exits when nothing is left to watch or the api's context is done. Watching
+// something already watched does nothing and at most maxWatches are held,
+// beyond that new watches are dropped.
+type statusWatcher struct {
+	coreApi core.CoreApi
+	opts    *options
+	log     golog.Log
+
+	mtx                 sync.Mutex
+	running             bool
+	nextTranslationPoll time.Time
+	// documents are waiting for their first version, by document id
+	documents map[string]*watch
+	// translations by document version id
+	translations map[string]*watch
+	// clashTests by clash test id
+	clashTests map[string]*watch
+}
+
+type watch struct {
+	forUser             string
+	project             string
+	projectSpaceVersion string
+	status              string
+	deadline            time.Time
+}
+
+func newStatusWatcher(coreApi core.CoreApi, opts *options, log golog.Log) *statusWatcher {
+	return &statusWatcher{
+		coreApi:      coreApi,
+		opts:         opts,
+		log:          log,
+		documents:    map[string]*watch{},
+		translations: map[string]*watch{},
+		clashTests:   map[string]*watch{},
+	}
+}
+
+// watchFirstVersion publishes versionUploaded for the version a document was
+// created with, then watches its translation.
+func (w *statusWatcher) watchFirstVersion(forUser string, document string) {
+	w.add(w.documents, document, &watch{forUser: forUser}, maxFirstVersionWatch)
+}
+
+// watchTranslation publishes translationStatusChanged each time dv's status
+// changes until its translation finishes or maxTranslationWatch passes.
+func (w *statusWatcher) watchTranslation(forUser string, dv *documentversion.DocumentVersion) {
+	if !translationFinished(dv.Status) {
+		w.add(w.translations, dv.Id, &watch{forUser: forUser, project: dv.Project, status: string(dv.Status)}, maxTranslationWatch)
+	}
+}
+
+// watchClashTests publishes clashTestFinished for each of tests as it finishes,
+// until maxClashTestWatch passes.
+func (w *statusWatcher) watchClashTests(forUser string, projectSpaceVersion string, tests []*clashtest.ClashTest) {
+	for _, test := range tests {
+		w.add(w.clashTests, test.Id, &watch{forUser: forUser, projectSpaceVersion: projectSpaceVersion}, maxClashTestWatch)
+	}
+}
+
+func (w *statusWatcher) add(watches map[string]*watch, id string, wa *watch, ttl time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, exists := watches[id]; exists || w.opts.ctx.Err() != nil {
+		return
+	} else if len(w.documents)+len(w.translations)+len(w.clashTests) >= maxWatches {
+		w.log.Warning("RestApi is already watching %d items, not watching %s", maxWatches, id)
+		return
+	}
+	wa.deadline = w.opts.clock().Add(ttl)
+	watches[id] = wa
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+func (w *statusWatcher) run() {
+	ticker := time.NewTicker(clashTestPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.opts.ctx.Done():
+			w.mtx.Lock()
+			w.running = false
+			w.mtx.Unlock()
+			return
+		case <-ticker.C:
+			if !w.poll() {
+				return
+			}
+		}
+	}
+}
+
+// poll fetches the state of everything watched and publishes the changes,
+// translations only every translationPollInterval. It returns false, having
+// marked the watcher stopped, once nothing is left to watch.
+func (w *statusWatcher) poll() bool {
+	now := w.opts.clock()
+	w.mtx.Lock()
+	expireWatches(w.documents, now)
+	expireWatches(w.translations, now)
+	expireWatches(w.clashTests, now)
+	documents, translations, clashTests := watchesByUser(w.documents), map[string][]string{}, watchesByUser(w.clashTests)
+	if !now.Before(w.nextTranslationPoll) {
+		w.nextTranslationPoll = now.Add(translationPollInterval)
+		translations = watchesByUser(w.translations)
+	}
+	w.mtx.Unlock()
+
+	for forUser, ids := range documents {
+		w.pollDocuments(forUser, ids)
+	}
+	for forUser, ids := range translations {
+		w.pollTranslations(forUser, ids)
+	}
+	for forUser, ids := range clashTests {
+		w.pollClashTests(forUser, ids)
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(w.documents)+len(w.translations)+len(w.clashTests) == 0 {
+		w.running = false
+	}
+	return w.running
+}
+
+func (w *statusWatcher) pollDocuments(forUser string, ids []string) {
+	dvs, err := w.coreApi.DocumentVersion().GetLatestForDocuments(forUser, ids)
+	if err != nil {
+		w.log.Warning("RestApi failed to get the first versions of documents %v: %v", ids, err)
+		return
+	}
+	// documents without a version yet are still being uploaded, their watches
+	// are kept until they have one or expire
+	w.mtx.Lock()
+	for _, dv := range dvs {
+		delete(w.documents, dv.Document)
+	}
+	w.mtx.Unlock()
+	for _, dv := range dvs {
+		publishEvent(w.opts, versionUploaded, dv.Project, nil, dv)
+		w.watchTranslation(forUser, dv)
+	}
+}
+
+func (w *statusWatcher) pollTranslations(forUser string, ids []string) {
+	dvs, err := w.coreApi.DocumentVersion().Get(forUser, ids)
+	if err != nil {
+		w.log.Warning("RestApi failed to poll translation of document versions %v: %v", ids, err)
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	gone := idSet(ids)
+	for _, dv := range dvs {
+		delete(gone, dv.Id)
+		if wa, exists := w.translations[dv.Id]; !exists {
+			continue
+		} else if string(dv.Status) != wa.status {
+			wa.status = string(dv.Status)
+			publishEvent(w.opts, translationStatusChanged, dv.Project, nil, dv)
+		}
+		if translationFinished(dv.Status) {
+			delete(w.translations, dv.Id)
+		}
+	}
+	for id := range gone {
+		delete(w.translations, id)
+	}
+}
+
+func (w *statusWatcher) pollClashTests(forUser string, ids []string) {
+	if err := w.setClashTestProjects(forUser, ids); err != nil {
+		w.log.Warning("RestApi failed to get project space versions to watch clash tests: %v", err)
+		return
+	}
+	tests, err := w.coreApi.ClashTest().Get(forUser, ids)
+	if err != nil {
+		w.log.Warning("RestApi failed to poll clash tests: %v", err)
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	gone := idSet(ids)
+	for _, test := range tests {
+		delete(gone, test.Id)
+		if wa, exists := w.clashTests[test.Id]; exists && clashTestsFinished([]*clashtest.ClashTest{test}) {
+			delete(w.clashTests, test.Id)
+			publishEvent(w.opts, clashTestFinished, wa.project, nil, test)
+		}
+	}
+	for id := range gone {
+		delete(w.clashTests, id)
+	}
+}
+
+// setClashTestProjects fills in the project of clash tests being watched for
+// the first time, events are published to the project and clash tests only
+// know their project space version.
+func (w *statusWatcher) setClashTestProjects(forUser string, ids []string) error {
+	w.mtx.Lock()
+	psvIds := []string{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if wa, exists := w.clashTests[id]; exists && wa.project == "" && !seen[wa.projectSpaceVersion] {
+			seen[wa.projectSpaceVersion] = true
+			psvIds = append(psvIds, wa.projectSpaceVersion)
+		}
+	}
+	w.mtx.Unlock()
+	if len(psvIds) == 0 {
+		return nil
+	}
+	psvs, err := w.coreApi.ProjectSpaceVersion().Get(forUser, psvIds)
+	if err != nil {
+		return err
+	}
+	projects := map[string]string{}
+	for _, psv := range psvs {
+		projects[psv.Id] = psv.Project
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, id := range ids {
+		if wa, exists := w.clashTests[id]; exists && wa.project == "" {
+			if project, found := projects[wa.projectSpaceVersion]; found {
+				wa.project = project
+			} else {
+				delete(w.clashTests, id)
+			}
+		}
+	}
+	return nil
+}
+
+func expireWatches(watches map[string]*watch, now time.Time) {
+	for id, wa := range watches {
+		if now.After(wa.deadline) {
+			delete(watches, id)
+		}
+	}
+}
+
+func watchesByUser(watches map[string]*watch) map[string][]string {
+	res := map[string][]string{}
+	for id, wa := range watches {
+		res[wa.forUser] = append(res[wa.forUser], id)
+	}
+	return res
+}
+
+func idSet(ids []string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
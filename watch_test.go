@@ -0,0 +1,270 @@
+package rest
+
+import (
+	"context"
+	"github.com/modelhub/core"
+	"github.com/modelhub/core/clashtest"
+	"github.com/modelhub/core/documentversion"
+	"github.com/modelhub/core/projectspaceversion"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWatchCore answers the polls the watcher makes from in memory document
+// versions and clash tests, every project space version is in project "p".
+type testWatchCore struct {
+	core.CoreApi
+	mtx        sync.Mutex
+	versions   *testWatchVersions
+	clashTests *testWatchClashTests
+}
+
+type testWatchVersions struct {
+	documentversion.DocumentVersionApi
+	core *testWatchCore
+	byId map[string]*documentversion.DocumentVersion
+}
+
+type testWatchClashTests struct {
+	clashtest.ClashTestApi
+	core *testWatchCore
+	byId map[string]*clashtest.ClashTest
+}
+
+type testWatchProjectSpaceVersions struct {
+	projectspaceversion.ProjectSpaceVersionApi
+}
+
+func newTestWatchCore() *testWatchCore {
+	c := &testWatchCore{}
+	c.versions = &testWatchVersions{core: c, byId: map[string]*documentversion.DocumentVersion{}}
+	c.clashTests = &testWatchClashTests{core: c, byId: map[string]*clashtest.ClashTest{}}
+	return c
+}
+
+func (c *testWatchCore) DocumentVersion() documentversion.DocumentVersionApi { return c.versions }
+func (c *testWatchCore) ClashTest() clashtest.ClashTestApi                   { return c.clashTests }
+func (c *testWatchCore) ProjectSpaceVersion() projectspaceversion.ProjectSpaceVersionApi {
+	return testWatchProjectSpaceVersions{}
+}
+
+func (c *testWatchCore) setVersion(dv documentversion.DocumentVersion) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.versions.byId[dv.Id] = &dv
+}
+
+func (c *testWatchCore) setClashTest(test clashtest.ClashTest) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.clashTests.byId[test.Id] = &test
+}
+
+func (v *testWatchVersions) Get(forUser string, ids []string) ([]*documentversion.DocumentVersion, error) {
+	v.core.mtx.Lock()
+	defer v.core.mtx.Unlock()
+	res := []*documentversion.DocumentVersion{}
+	for _, id := range ids {
+		if dv, exists := v.byId[id]; exists {
+			copied := *dv
+			res = append(res, &copied)
+		}
+	}
+	return res, nil
+}
+
+func (v *testWatchVersions) GetLatestForDocuments(forUser string, documents []string) ([]*documentversion.DocumentVersion, error) {
+	v.core.mtx.Lock()
+	defer v.core.mtx.Unlock()
+	res := []*documentversion.DocumentVersion{}
+	for _, document := range documents {
+		for _, dv := range v.byId {
+			if dv.Document == document {
+				copied := *dv
+				res = append(res, &copied)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *testWatchClashTests) Get(forUser string, ids []string) ([]*clashtest.ClashTest, error) {
+	c.core.mtx.Lock()
+	defer c.core.mtx.Unlock()
+	res := []*clashtest.ClashTest{}
+	for _, id := range ids {
+		if test, exists := c.byId[id]; exists {
+			copied := *test
+			res = append(res, &copied)
+		}
+	}
+	return res, nil
+}
+
+func (testWatchProjectSpaceVersions) Get(forUser string, ids []string) ([]*projectspaceversion.ProjectSpaceVersion, error) {
+	res := []*projectspaceversion.ProjectSpaceVersion{}
+	for _, id := range ids {
+		res = append(res, &projectspaceversion.ProjectSpaceVersion{Id: id, Project: "p"})
+	}
+	return res, nil
+}
+
+// testWatcher returns a watcher the test polls itself, marking it running
+// stops adds from starting the polling goroutine.
+func testWatcher(c *testWatchCore, now *time.Time, opts ...Option) (*statusWatcher, *eventSubscription) {
+	o := newOptions(append(opts, WithClock(func() time.Time { return *now })))
+	w := newStatusWatcher(c, o, nil)
+	w.running = true
+	sub, _, _ := o.events.subscribe("", allEvents)
+	return w, sub
+}
+
+func receivedEvents(sub *eventSubscription) []*event {
+	res := []*event{}
+	for {
+		select {
+		case ev := <-sub.events:
+			res = append(res, ev)
+		default:
+			return res
+		}
+	}
+}
+
+func assertEvents(t *testing.T, sub *eventSubscription, types ...eventType) []*event {
+	t.Helper()
+	got := receivedEvents(sub)
+	if len(got) != len(types) {
+		t.Fatalf("got %d events, want %v", len(got), types)
+	}
+	for i, ev := range got {
+		if ev.Type != types[i] {
+			t.Fatalf("got %s at %d, want %v", ev.Type, i, types)
+		}
+	}
+	return got
+}
+
+func TestWatchTranslation(t *testing.T) {
+	c := newTestWatchCore()
+	now := time.Unix(0, 0)
+	w, sub := testWatcher(c, &now)
+	c.setVersion(documentversion.DocumentVersion{Id: "dv", Project: "p", Status: documentversion.Pending})
+	w.watchTranslation("u", c.versions.byId["dv"])
+	w.watchTranslation("u", c.versions.byId["dv"])
+	if len(w.translations) != 1 {
+		t.Fatalf("watching %d translations", len(w.translations))
+	}
+
+	if !w.poll() {
+		t.Fatal("stopped while translating")
+	}
+	assertEvents(t, sub)
+	c.setVersion(documentversion.DocumentVersion{Id: "dv", Project: "p", Status: documentversion.InProgress})
+	// translations are polled less often than clash tests
+	w.poll()
+	assertEvents(t, sub)
+	now = now.Add(translationPollInterval)
+	w.poll()
+	if ev := assertEvents(t, sub, translationStatusChanged)[0]; ev.Project != "p" {
+		t.Fatalf("event %+v", ev)
+	}
+
+	c.setVersion(documentversion.DocumentVersion{Id: "dv", Project: "p", Status: documentversion.Success})
+	now = now.Add(translationPollInterval)
+	if w.poll() || w.running {
+		t.Fatal("still running with nothing to watch")
+	}
+	assertEvents(t, sub, translationStatusChanged)
+}
+
+func TestWatchFirstVersion(t *testing.T) {
+	c := newTestWatchCore()
+	now := time.Unix(0, 0)
+	w, sub := testWatcher(c, &now)
+	w.watchFirstVersion("u", "d")
+	// the upload is still being processed
+	if !w.poll() || w.documents["d"] == nil {
+		t.Fatal("stopped watching a document without a version")
+	}
+	assertEvents(t, sub)
+	c.setVersion(documentversion.DocumentVersion{Id: "dv", Document: "d", Project: "p", Status: documentversion.Pending})
+	w.poll()
+	assertEvents(t, sub, versionUploaded)
+	if len(w.documents) != 0 || w.translations["dv"] == nil {
+		t.Fatalf("documents %v, translations %v", w.documents, w.translations)
+	}
+}
+
+func TestWatchClashTests(t *testing.T) {
+	c := newTestWatchCore()
+	now := time.Unix(0, 0)
+	w, sub := testWatcher(c, &now)
+	tests := []*clashtest.ClashTest{{Id: "a", Status: clashtest.Pending}, {Id: "b", Status: clashtest.Running}}
+	for _, test := range tests {
+		c.setClashTest(*test)
+	}
+	w.watchClashTests("u", "psv", tests)
+	w.poll()
+	assertEvents(t, sub)
+	if w.clashTests["a"].project != "p" {
+		t.Fatalf("project %q", w.clashTests["a"].project)
+	}
+
+	c.setClashTest(clashtest.ClashTest{Id: "a", Status: clashtest.Succeeded})
+	if !w.poll() {
+		t.Fatal("stopped with b running")
+	}
+	if ev := assertEvents(t, sub, clashTestFinished)[0]; ev.Project != "p" || ev.Data.(*clashtest.ClashTest).Id != "a" {
+		t.Fatalf("event %+v", ev)
+	}
+	// a test core no longer knows of is dropped
+	c.mtx.Lock()
+	delete(c.clashTests.byId, "b")
+	c.mtx.Unlock()
+	if w.poll() {
+		t.Fatal("still running with nothing to watch")
+	}
+	assertEvents(t, sub)
+}
+
+func TestWatchExpires(t *testing.T) {
+	c := newTestWatchCore()
+	now := time.Unix(0, 0)
+	w, sub := testWatcher(c, &now)
+	c.setClashTest(clashtest.ClashTest{Id: "a", Status: clashtest.Running})
+	w.watchClashTests("u", "psv", []*clashtest.ClashTest{{Id: "a"}})
+	w.watchFirstVersion("u", "d")
+	now = now.Add(maxClashTestWatch + time.Second)
+	if w.poll() {
+		t.Fatal("still running after the watch expired")
+	}
+	assertEvents(t, sub)
+}
+
+func TestWatchStopsWithContext(t *testing.T) {
+	c := newTestWatchCore()
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Unix(0, 0)
+	o := newOptions([]Option{WithContext(ctx), WithClock(func() time.Time { return now })})
+	w := newStatusWatcher(c, o, nil)
+	c.setClashTest(clashtest.ClashTest{Id: "a", Status: clashtest.Running})
+	w.watchClashTests("u", "psv", []*clashtest.ClashTest{{Id: "a"}})
+	cancel()
+	for i := 0; ; i++ {
+		w.mtx.Lock()
+		running := w.running
+		w.mtx.Unlock()
+		if !running {
+			break
+		} else if i == 100 {
+			t.Fatal("watcher didn't stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.watchClashTests("u", "psv", []*clashtest.ClashTest{{Id: "b"}})
+	if w.clashTests["b"] != nil || w.running {
+		t.Fatal("watch added after the context was done")
+	}
+}